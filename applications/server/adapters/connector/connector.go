@@ -0,0 +1,39 @@
+// Package connector opens clients of storages of every supported type.
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/log"
+
+	"github.com/donmikel/karma8/applications/server/adapters/httpstorage"
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type connector struct {
+	client *http.Client
+	logger log.Logger
+}
+
+// New returns a connector opening memory storages, and HTTP storage nodes through client.
+func New(client *http.Client, logger log.Logger) interfaces.StorageConnector {
+	return &connector{
+		client: client,
+		logger: logger,
+	}
+}
+
+func (c *connector) Connect(ctx context.Context, registration domain.StorageRegistration) (interfaces.Storage, error) {
+	switch registration.Type {
+	case domain.StorageTypeMemory:
+		return inmemory.NewStorage(registration.URL, c.logger, inmemory.WithCapacity(registration.Capacity)), nil
+	case domain.StorageTypeHTTP:
+		return httpstorage.NewStorage(registration.URL, c.client), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown storage type %q", domain.ErrInvalid, registration.Type)
+	}
+}
@@ -0,0 +1,178 @@
+// Package httpstorage is a client of storage nodes serving parts over HTTP.
+//
+// A node serves:
+//
+//	PUT    /parts/{path}  stores the request body as a part
+//	GET    /parts/{path}  returns a part
+//	DELETE /parts/{path}  deletes a part
+//	GET    /free          returns {"free_space": bytes}
+//	GET    /ping          answers 200 while the node is serving
+//
+// The part path is escaped as a single path segment.
+package httpstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// freeSpaceTimeout bounds GetFreeSpace, which takes no context.
+const freeSpaceTimeout = 5 * time.Second
+
+type storage struct {
+	url    string
+	client *http.Client
+}
+
+type freeSpaceResponse struct {
+	FreeSpace int `json:"free_space"`
+}
+
+// NewStorage returns a client of the storage node at storageURL.
+func NewStorage(storageURL string, client *http.Client) interfaces.Storage {
+	return &storage{
+		url:    strings.TrimRight(storageURL, "/"),
+		client: client,
+	}
+}
+
+func (s *storage) GetStorageURL() string {
+	return s.url
+}
+
+func (s *storage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	resp, err := s.do(ctx, http.MethodPut, s.partURL(path), body)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	return checkStatus(resp, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+}
+
+func (s *storage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.partURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkStatus(resp, http.StatusOK); err != nil {
+		drain(resp)
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *storage) DeleteFilePart(ctx context.Context, path string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.partURL(path), nil)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	return checkStatus(resp, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+}
+
+func (s *storage) GetFreeSpace() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), freeSpaceTimeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodGet, s.url+"/free", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer drain(resp)
+
+	if err = checkStatus(resp, http.StatusOK); err != nil {
+		return 0, err
+	}
+
+	var free freeSpaceResponse
+	if err = json.NewDecoder(resp.Body).Decode(&free); err != nil {
+		return 0, fmt.Errorf("can't decode free space: %w", err)
+	}
+
+	return free.FreeSpace, nil
+}
+
+func (s *storage) Ping(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodGet, s.url+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	return checkStatus(resp, http.StatusOK)
+}
+
+func (s *storage) partURL(path string) string {
+	return s.url + "/parts/" + url.PathEscape(path)
+}
+
+func (s *storage) do(ctx context.Context, method, target string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request: %w", err)
+	}
+
+	// Nodes continue the trace and log the ID of the request the part is transferred for.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// A node that can't be reached is unavailable, unless the request was just given up on.
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("can't send request: %w", err)
+		}
+
+		return nil, fmt.Errorf("%w: can't send request: %v", domain.ErrUnavailable, err)
+	}
+
+	return resp, nil
+}
+
+func checkStatus(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("unexpected status %d from %s %s: %s", resp.StatusCode, resp.Request.Method, resp.Request.URL,
+		strings.TrimSpace(string(msg)))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %v", domain.ErrPartNotFound, err)
+	case http.StatusInsufficientStorage:
+		return fmt.Errorf("%w: %v", domain.ErrNoSpace, err)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("%w: %v", domain.ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
+// drain reads the rest of the body, so the connection can be reused.
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
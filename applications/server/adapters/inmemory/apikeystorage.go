@@ -0,0 +1,81 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type inMemoryAPIKeyStorage struct {
+	keysByHash map[string]domain.APIKey
+	hashByID   map[string]string
+	mutex      sync.RWMutex
+}
+
+func NewAPIKeyStorage() interfaces.APIKeyStorage {
+	return &inMemoryAPIKeyStorage{
+		keysByHash: map[string]domain.APIKey{},
+		hashByID:   map[string]string{},
+	}
+}
+
+func (i *inMemoryAPIKeyStorage) PutKey(ctx context.Context, key domain.APIKey) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, ok := i.hashByID[key.ID]; ok {
+		return fmt.Errorf("%w: %s", domain.ErrKeyExists, key.ID)
+	}
+
+	i.keysByHash[key.Hash] = key
+	i.hashByID[key.ID] = key.Hash
+
+	return nil
+}
+
+func (i *inMemoryAPIKeyStorage) GetKeyByHash(ctx context.Context, hash string) (domain.APIKey, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	key, ok := i.keysByHash[hash]
+	if !ok {
+		return domain.APIKey{}, domain.ErrKeyNotFound
+	}
+
+	return key, nil
+}
+
+func (i *inMemoryAPIKeyStorage) DeleteKey(ctx context.Context, id string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	hash, ok := i.hashByID[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", domain.ErrKeyNotFound, id)
+	}
+
+	delete(i.keysByHash, hash)
+	delete(i.hashByID, id)
+
+	return nil
+}
+
+func (i *inMemoryAPIKeyStorage) ListKeys(ctx context.Context) ([]domain.APIKey, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	result := make([]domain.APIKey, 0, len(i.keysByHash))
+	for _, key := range i.keysByHash {
+		result = append(result, key)
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].CreatedAt.Before(result[b].CreatedAt)
+	})
+
+	return result, nil
+}
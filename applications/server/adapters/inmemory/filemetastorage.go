@@ -3,6 +3,8 @@ package inmemory
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/donmikel/karma8/applications/server/domain"
@@ -14,14 +16,21 @@ type fileMeta struct {
 	inProgress bool
 }
 
+type partRef struct {
+	part domain.FilePart
+	refs int
+}
+
 type inMemoryFileMetaStorage struct {
 	metaData map[string]fileMeta
+	parts    map[string]partRef
 	mutex    sync.RWMutex
 }
 
 func NewFileMetaStorage() interfaces.FileMetaStorage {
 	return &inMemoryFileMetaStorage{
 		metaData: map[string]fileMeta{},
+		parts:    map[string]partRef{},
 	}
 }
 
@@ -37,15 +46,17 @@ func (i *inMemoryFileMetaStorage) StartProcessingFileMeta(ctx context.Context, m
 	return nil
 }
 
-func (i *inMemoryFileMetaStorage) CompleteFileMeta(ctx context.Context, id string) error {
+func (i *inMemoryFileMetaStorage) CompleteFileMeta(ctx context.Context, meta domain.FileMeta) error {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
+	id := meta.Name
 	m, ok := i.metaData[id]
 	if !ok {
-		return fmt.Errorf("file with id = %s not found", id)
+		return fmt.Errorf("%w: %s", domain.ErrFileNotFound, id)
 	}
 
+	m.meta = meta
 	m.inProgress = false
 
 	i.metaData[id] = m
@@ -59,8 +70,218 @@ func (i *inMemoryFileMetaStorage) GetFileMeta(ctx context.Context, id string) (d
 
 	m, ok := i.metaData[id]
 	if !ok {
-		return domain.FileMeta{}, fmt.Errorf("file with id = %s not found", id)
+		return domain.FileMeta{}, fmt.Errorf("%w: %s", domain.ErrFileNotFound, id)
+	}
+
+	return m.meta, nil
+}
+
+func (i *inMemoryFileMetaStorage) DeleteFileMeta(ctx context.Context, id string) (domain.FileMeta, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	m, ok := i.metaData[id]
+	if !ok {
+		return domain.FileMeta{}, fmt.Errorf("%w: %s", domain.ErrFileNotFound, id)
 	}
 
+	delete(i.metaData, id)
+
 	return m.meta, nil
 }
+
+func (i *inMemoryFileMetaStorage) AcquirePart(ctx context.Context, hash string) (domain.FilePart, bool, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	ref, ok := i.parts[hash]
+	if !ok {
+		return domain.FilePart{}, false, nil
+	}
+
+	ref.refs++
+	i.parts[hash] = ref
+
+	return ref.part, true, nil
+}
+
+func (i *inMemoryFileMetaStorage) PutPart(ctx context.Context, hash string, part domain.FilePart) (domain.FilePart, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	ref, ok := i.parts[hash]
+	if !ok {
+		ref.part = part
+	}
+
+	ref.refs++
+	i.parts[hash] = ref
+
+	return ref.part, nil
+}
+
+func (i *inMemoryFileMetaStorage) ReleasePart(ctx context.Context, hash string) (int, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	ref, ok := i.parts[hash]
+	if !ok {
+		return 0, fmt.Errorf("%w: hash %s", domain.ErrPartNotFound, hash)
+	}
+
+	ref.refs--
+	if ref.refs <= 0 {
+		delete(i.parts, hash)
+		return 0, nil
+	}
+
+	i.parts[hash] = ref
+
+	return ref.refs, nil
+}
+
+func (i *inMemoryFileMetaStorage) ListFiles(ctx context.Context) ([]domain.FileMeta, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	result := make([]domain.FileMeta, 0, len(i.metaData))
+	for _, m := range i.metaData {
+		if !m.inProgress {
+			result = append(result, m.meta)
+		}
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Name < result[b].Name
+	})
+
+	return result, nil
+}
+
+func (i *inMemoryFileMetaStorage) ListParts(ctx context.Context) ([]domain.FilePart, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var result []domain.FilePart
+	seen := map[string]bool{}
+	add := func(part domain.FilePart) {
+		// Files share deduplicated parts, so a part is told apart by its path and locations.
+		key := part.Path + "\x00" + strings.Join(part.Locations(), ",")
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, part)
+		}
+	}
+
+	for _, m := range i.metaData {
+		for _, part := range m.meta.Parts {
+			add(part)
+		}
+	}
+
+	for _, ref := range i.parts {
+		add(ref.part)
+	}
+
+	return result, nil
+}
+
+func (i *inMemoryFileMetaStorage) MovePart(ctx context.Context, path, checksum, from, to string) (bool, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, m := range i.metaData {
+		if m.inProgress && referencesPart(m.meta.Parts, path, from) {
+			return false, nil
+		}
+		if replacedPart(m.meta.Parts, path, checksum) {
+			return false, nil
+		}
+	}
+
+	for _, ref := range i.parts {
+		if replacedPart([]domain.FilePart{ref.part}, path, checksum) {
+			return false, nil
+		}
+	}
+
+	var moved bool
+	for id, m := range i.metaData {
+		if !referencesPart(m.meta.Parts, path, from) {
+			continue
+		}
+
+		// Parts are copied so that metadata handed out earlier doesn't change under its readers.
+		parts := make([]domain.FilePart, len(m.meta.Parts))
+		for n, part := range m.meta.Parts {
+			parts[n] = movePartLocation(part, path, from, to)
+		}
+
+		m.meta.Parts = parts
+		i.metaData[id] = m
+		moved = true
+	}
+
+	for hash, ref := range i.parts {
+		if referencesPart([]domain.FilePart{ref.part}, path, from) {
+			ref.part = movePartLocation(ref.part, path, from, to)
+			i.parts[hash] = ref
+			moved = true
+		}
+	}
+
+	return moved, nil
+}
+
+func referencesPart(parts []domain.FilePart, path, location string) bool {
+	for _, part := range parts {
+		if part.Path != path {
+			continue
+		}
+
+		for _, l := range part.Locations() {
+			if l == location {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// replacedPart reports whether one of parts is stored at path with a checksum other than checksum.
+// Parts stored before checksums were kept can't be told apart, so they are taken to match.
+func replacedPart(parts []domain.FilePart, path, checksum string) bool {
+	for _, part := range parts {
+		if part.Path == path && part.StoredChecksum() != "" && part.StoredChecksum() != checksum {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i *inMemoryFileMetaStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func movePartLocation(part domain.FilePart, path, from, to string) domain.FilePart {
+	if part.Path != path {
+		return part
+	}
+
+	if part.StorageURL == from {
+		part.StorageURL = to
+	}
+
+	replicas := make([]string, len(part.Replicas))
+	for n, replica := range part.Replicas {
+		if replica == from {
+			replica = to
+		}
+		replicas[n] = replica
+	}
+	part.Replicas = replicas
+
+	return part
+}
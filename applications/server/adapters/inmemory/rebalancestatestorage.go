@@ -0,0 +1,45 @@
+package inmemory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type inMemoryRebalanceStateStorage struct {
+	status domain.RebalanceStatus
+	mutex  sync.Mutex
+}
+
+func NewRebalanceStateStorage() interfaces.RebalanceStateStorage {
+	return &inMemoryRebalanceStateStorage{}
+}
+
+func (i *inMemoryRebalanceStateStorage) GetRebalanceStatus(ctx context.Context) (domain.RebalanceStatus, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	status := i.status
+	if status.Current != nil {
+		current := *status.Current
+		status.Current = &current
+	}
+
+	return status, nil
+}
+
+func (i *inMemoryRebalanceStateStorage) PutRebalanceStatus(ctx context.Context, status domain.RebalanceStatus) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if status.Current != nil {
+		current := *status.Current
+		status.Current = &current
+	}
+
+	i.status = status
+
+	return nil
+}
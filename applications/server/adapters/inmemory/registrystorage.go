@@ -0,0 +1,68 @@
+package inmemory
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type inMemoryRegistryStorage struct {
+	registrations map[string]domain.StorageRegistration
+	mutex         sync.RWMutex
+}
+
+func NewRegistryStorage() interfaces.RegistryStorage {
+	return &inMemoryRegistryStorage{
+		registrations: map[string]domain.StorageRegistration{},
+	}
+}
+
+func (i *inMemoryRegistryStorage) PutRegistration(ctx context.Context, registration domain.StorageRegistration) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.registrations[registration.URL] = registration
+
+	return nil
+}
+
+func (i *inMemoryRegistryStorage) GetRegistration(ctx context.Context, storageURL string) (domain.StorageRegistration, bool, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	registration, ok := i.registrations[storageURL]
+
+	return registration, ok, nil
+}
+
+func (i *inMemoryRegistryStorage) DeleteRegistration(ctx context.Context, storageURL string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	delete(i.registrations, storageURL)
+
+	return nil
+}
+
+func (i *inMemoryRegistryStorage) ListRegistrations(ctx context.Context) ([]domain.StorageRegistration, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	result := make([]domain.StorageRegistration, 0, len(i.registrations))
+	for _, registration := range i.registrations {
+		result = append(result, registration)
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		if !result[a].RegisteredAt.Equal(result[b].RegisteredAt) {
+			return result[a].RegisteredAt.Before(result[b].RegisteredAt)
+		}
+
+		return result[a].URL < result[b].URL
+	})
+
+	return result, nil
+}
@@ -12,7 +12,9 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"github.com/donmikel/karma8/applications/server/domain"
 	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/logging"
 )
 
 const defaultFreeSpaceInBytes = 100 * 1024 * 1024 // 100 Mb
@@ -25,13 +27,31 @@ type inMemoryStorage struct {
 	mutex      sync.RWMutex
 }
 
-func NewStorage(url string, logger log.Logger) interfaces.Storage {
-	return &inMemoryStorage{
+// StorageOption configures optional behaviour of the in-memory storage.
+type StorageOption func(m *inMemoryStorage)
+
+// WithCapacity sets how many bytes the storage holds.
+func WithCapacity(capacity int64) StorageOption {
+	return func(m *inMemoryStorage) {
+		if capacity > 0 {
+			m.freeSpace = int(capacity)
+		}
+	}
+}
+
+func NewStorage(url string, logger log.Logger, opts ...StorageOption) interfaces.Storage {
+	m := &inMemoryStorage{
 		url:        url,
 		log:        logger,
 		dataByPath: map[string][]byte{},
 		freeSpace:  defaultFreeSpaceInBytes,
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
 func (m *inMemoryStorage) GetStorageURL() string {
@@ -47,14 +67,15 @@ func (m *inMemoryStorage) UploadFilePart(ctx context.Context, path string, body
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	dataLen := binary.Size(data)
-	if dataLen > m.freeSpace {
-		return fmt.Errorf("not enough free space")
+	replacedLen := len(m.dataByPath[path])
+	if dataLen > m.freeSpace+replacedLen {
+		return fmt.Errorf("%w: %d bytes needed, %d free", domain.ErrNoSpace, dataLen, m.freeSpace+replacedLen)
 	}
 
 	m.dataByPath[path] = data
-	m.freeSpace -= dataLen
+	m.freeSpace += replacedLen - dataLen
 
-	level.Info(m.log).Log("msg", "file part uploaded",
+	level.Info(logging.With(ctx, m.log)).Log("msg", "file part uploaded",
 		"path", path,
 		"storage", m.url,
 		"size", humanize.Bytes(uint64(dataLen)),
@@ -68,12 +89,17 @@ func (m *inMemoryStorage) ReadFilePart(ctx context.Context, path string) (io.Rea
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	level.Info(m.log).Log("msg", "file part read",
+	data, ok := m.dataByPath[path]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", domain.ErrPartNotFound, path)
+	}
+
+	level.Info(logging.With(ctx, m.log)).Log("msg", "file part read",
 		"path", path,
 		"storage", m.url,
 	)
 
-	return io.NopCloser(bytes.NewReader(m.dataByPath[path])), nil
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
 func (m *inMemoryStorage) DeleteFilePart(ctx context.Context, path string) error {
@@ -87,6 +113,10 @@ func (m *inMemoryStorage) DeleteFilePart(ctx context.Context, path string) error
 	return nil
 }
 
+func (m *inMemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
 func (m *inMemoryStorage) GetFreeSpace() (int, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -3,97 +3,211 @@ package inmemory
 import (
 	"context"
 	"fmt"
-	"sort"
 	"strings"
 	"sync"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"github.com/donmikel/karma8/applications/server/domain"
 	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/logging"
+	"github.com/donmikel/karma8/applications/server/placement"
 )
 
 type storages []interfaces.Storage
 
 type sm struct {
 	hostToStorage map[string]interfaces.Storage
+	labels        map[string]domain.StorageLabels
+	draining      map[string]bool
+	health        map[string]domain.StorageHealth
 	storages      storages
+	policy        interfaces.PlacementPolicy
 	m             sync.Mutex
 	logger        log.Logger
 }
 
-func NewStorageManager(logger log.Logger) interfaces.StorageManager {
+func NewStorageManager(logger log.Logger, policy interfaces.PlacementPolicy) interfaces.StorageManager {
 	return &sm{
 		hostToStorage: map[string]interfaces.Storage{},
+		labels:        map[string]domain.StorageLabels{},
+		draining:      map[string]bool{},
+		health:        map[string]domain.StorageHealth{},
 		storages:      []interfaces.Storage{},
+		policy:        policy,
 		logger:        logger,
 	}
 }
 
-func (s *sm) GetStorages(ctx context.Context, count int) ([]interfaces.Storage, error) {
+func (s *sm) GetStorages(ctx context.Context, key string, parts, replicas int) ([][]interfaces.Storage, error) {
+	// The policy may query storages, so it works on a snapshot instead of holding the lock.
 	s.m.Lock()
-	defer s.m.Unlock()
+	candidates := make([]interfaces.Storage, 0, len(s.storages))
+	for _, st := range s.storages {
+		url := st.GetStorageURL()
+		if !s.draining[url] && s.health[url] == domain.HealthHealthy {
+			candidates = append(candidates, st)
+		}
+	}
+	labels := make(map[string]domain.StorageLabels, len(s.labels))
+	for url, l := range s.labels {
+		labels[url] = l
+	}
+	s.m.Unlock()
 
-	sort.Sort(s.storages)
+	// The policy ranks every candidate; spreading parts and replicas over zones is up to placement.Spread.
+	ranked, err := s.policy.Rank(ctx, key, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("can't select storages: %w", err)
+	}
 
-	result := make(storages, 0, count)
-	storagesCount := len(s.storages)
-	for i := storagesCount - 1; i >= storagesCount-count; i-- {
-		result = append(result, s.storages[i])
+	result, err := placement.Spread(ranked, func(url string) domain.StorageLabels { return labels[url] }, parts, replicas)
+	if err != nil {
+		return nil, fmt.Errorf("can't spread parts over storages: %w", err)
 	}
 
-	level.Info(s.logger).Log("msg", "selected storages",
-		"storages", result,
-	)
+	for i, selected := range result {
+		level.Info(logging.With(ctx, s.logger)).Log("msg", "selected storages",
+			"key", key,
+			"part", i,
+			"storages", storages(selected),
+		)
+	}
 
 	return result, nil
 }
 
+func (s *sm) GetStorageLabels(ctx context.Context, storageURL string) (domain.StorageLabels, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return domain.StorageLabels{}, fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
+	}
+
+	return s.labels[storageURL], nil
+}
+
 func (s *sm) GetStorage(ctx context.Context, storageURL string) (interfaces.Storage, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
 	st, ok := s.hostToStorage[storageURL]
 	if !ok {
-		return nil, fmt.Errorf("storage with URL = %s not found", storageURL)
+		return nil, fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
 	}
 
 	return st, nil
 }
 
-func (s *sm) AddStorage(ctx context.Context, storageURL string, st interfaces.Storage) error {
+func (s *sm) ListStorages(ctx context.Context) ([]interfaces.Storage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	result := make([]interfaces.Storage, len(s.storages))
+	copy(result, s.storages)
+
+	return result, nil
+}
+
+func (s *sm) AddStorage(ctx context.Context, storageURL string, st interfaces.Storage, labels domain.StorageLabels) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	if _, ok := s.hostToStorage[storageURL]; ok {
+		return fmt.Errorf("%w: %s", domain.ErrStorageExists, storageURL)
+	}
+
 	s.storages = append(
 		s.storages,
 		st,
 	)
 
 	s.hostToStorage[storageURL] = st
+	s.labels[storageURL] = labels
+	s.health[storageURL] = domain.HealthHealthy
+
+	return nil
+}
+
+func (s *sm) DrainStorage(ctx context.Context, storageURL string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
+	}
+
+	s.draining[storageURL] = true
+
+	level.Info(logging.With(ctx, s.logger)).Log("msg", "storage draining",
+		"storage", storageURL,
+	)
 
 	return nil
 }
 
-func (s storages) Len() int {
-	return len(s)
+func (s *sm) IsDraining(ctx context.Context, storageURL string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return false, fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
+	}
+
+	return s.draining[storageURL], nil
 }
 
-func (s storages) Less(i, j int) bool {
-	si, err := s[i].GetFreeSpace()
-	if err != nil {
-		return false
+func (s *sm) SetStorageHealth(ctx context.Context, storageURL string, health domain.StorageHealth) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
 	}
-	sj, err := s[j].GetFreeSpace()
-	if err != nil {
-		return false
+
+	s.health[storageURL] = health
+
+	return nil
+}
+
+func (s *sm) GetStorageHealth(ctx context.Context, storageURL string) (domain.StorageHealth, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return "", fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
 	}
 
-	return si < sj
+	return s.health[storageURL], nil
 }
 
-func (s storages) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+func (s *sm) RemoveStorage(ctx context.Context, storageURL string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hostToStorage[storageURL]; !ok {
+		return fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
+	}
+
+	for i, st := range s.storages {
+		if st.GetStorageURL() == storageURL {
+			s.storages = append(s.storages[:i], s.storages[i+1:]...)
+			break
+		}
+	}
+
+	delete(s.hostToStorage, storageURL)
+	delete(s.labels, storageURL)
+	delete(s.draining, storageURL)
+	delete(s.health, storageURL)
+
+	level.Info(logging.With(ctx, s.logger)).Log("msg", "storage removed",
+		"storage", storageURL,
+	)
+
+	return nil
 }
 
 func (s storages) String() string {
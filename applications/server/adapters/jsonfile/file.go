@@ -0,0 +1,37 @@
+package jsonfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFile writes data to a temporary file and renames it over the file at path, so a crash never leaves
+// a half-written file behind.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can't replace file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package jsonfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type partMove struct {
+	Path      string `json:"path"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Committed bool   `json:"committed"`
+}
+
+type rebalanceStatus struct {
+	Running     bool      `json:"running"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	MovedParts  int       `json:"moved_parts"`
+	MovedBytes  int64     `json:"moved_bytes"`
+	FailedMoves int       `json:"failed_moves"`
+	Current     *partMove `json:"current,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type rebalanceStateStorage struct {
+	path   string
+	status domain.RebalanceStatus
+	mutex  sync.Mutex
+}
+
+// NewRebalanceStateStorage returns rebalancing progress kept in the file at path, so an interrupted run is resumed
+// after a restart. The file is read at once, and rewritten on every change. A missing file means no run yet.
+func NewRebalanceStateStorage(path string) (interfaces.RebalanceStateStorage, error) {
+	r := &rebalanceStateStorage{path: filepath.Clean(path)}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read rebalance state file: %w", err)
+	}
+
+	var stored rebalanceStatus
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("can't decode rebalance state file %s: %w", r.path, err)
+	}
+
+	r.status = domain.RebalanceStatus{
+		Running:     stored.Running,
+		StartedAt:   stored.StartedAt,
+		FinishedAt:  stored.FinishedAt,
+		MovedParts:  stored.MovedParts,
+		MovedBytes:  stored.MovedBytes,
+		FailedMoves: stored.FailedMoves,
+		LastError:   stored.LastError,
+	}
+	if stored.Current != nil {
+		r.status.Current = &domain.PartMove{
+			Path:      stored.Current.Path,
+			From:      stored.Current.From,
+			To:        stored.Current.To,
+			Committed: stored.Current.Committed,
+		}
+	}
+
+	return r, nil
+}
+
+func (r *rebalanceStateStorage) GetRebalanceStatus(ctx context.Context) (domain.RebalanceStatus, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := r.status
+	if status.Current != nil {
+		current := *status.Current
+		status.Current = &current
+	}
+
+	return status, nil
+}
+
+func (r *rebalanceStateStorage) PutRebalanceStatus(ctx context.Context, status domain.RebalanceStatus) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored := rebalanceStatus{
+		Running:     status.Running,
+		StartedAt:   status.StartedAt,
+		FinishedAt:  status.FinishedAt,
+		MovedParts:  status.MovedParts,
+		MovedBytes:  status.MovedBytes,
+		FailedMoves: status.FailedMoves,
+		LastError:   status.LastError,
+	}
+	if status.Current != nil {
+		current := *status.Current
+		status.Current = &current
+		stored.Current = &partMove{
+			Path:      current.Path,
+			From:      current.From,
+			To:        current.To,
+			Committed: current.Committed,
+		}
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode rebalance state: %w", err)
+	}
+
+	if err = writeFile(r.path, data); err != nil {
+		return fmt.Errorf("can't write rebalance state file: %w", err)
+	}
+
+	r.status = status
+
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package jsonfile keeps small amounts of server state in JSON files.
+package jsonfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type labels struct {
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+type registration struct {
+	URL          string    `json:"url"`
+	Type         string    `json:"type"`
+	Labels       labels    `json:"labels"`
+	Capacity     int64     `json:"capacity,omitempty"`
+	Self         bool      `json:"self"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+type registryStorage struct {
+	path          string
+	registrations map[string]domain.StorageRegistration
+	mutex         sync.RWMutex
+}
+
+// NewRegistryStorage returns a registry kept in the file at path. The file is read at once, and rewritten
+// on every change. A missing file means an empty registry.
+func NewRegistryStorage(path string) (interfaces.RegistryStorage, error) {
+	r := &registryStorage{
+		path:          filepath.Clean(path),
+		registrations: map[string]domain.StorageRegistration{},
+	}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read registry file: %w", err)
+	}
+
+	var stored []registration
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("can't decode registry file %s: %w", r.path, err)
+	}
+
+	for _, s := range stored {
+		r.registrations[s.URL] = domain.StorageRegistration{
+			URL:          s.URL,
+			Type:         s.Type,
+			Labels:       domain.StorageLabels(s.Labels),
+			Capacity:     s.Capacity,
+			Self:         s.Self,
+			RegisteredAt: s.RegisteredAt,
+		}
+	}
+
+	return r, nil
+}
+
+func (r *registryStorage) PutRegistration(ctx context.Context, reg domain.StorageRegistration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.registrations[reg.URL]
+	r.registrations[reg.URL] = reg
+
+	if err := r.save(); err != nil {
+		if existed {
+			r.registrations[reg.URL] = previous
+		} else {
+			delete(r.registrations, reg.URL)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (r *registryStorage) GetRegistration(ctx context.Context, storageURL string) (domain.StorageRegistration, bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	reg, ok := r.registrations[storageURL]
+
+	return reg, ok, nil
+}
+
+func (r *registryStorage) DeleteRegistration(ctx context.Context, storageURL string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.registrations[storageURL]
+	if !existed {
+		return nil
+	}
+
+	delete(r.registrations, storageURL)
+
+	if err := r.save(); err != nil {
+		r.registrations[storageURL] = previous
+		return err
+	}
+
+	return nil
+}
+
+func (r *registryStorage) ListRegistrations(ctx context.Context) ([]domain.StorageRegistration, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.sorted(), nil
+}
+
+func (r *registryStorage) sorted() []domain.StorageRegistration {
+	result := make([]domain.StorageRegistration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		result = append(result, reg)
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		if !result[a].RegisteredAt.Equal(result[b].RegisteredAt) {
+			return result[a].RegisteredAt.Before(result[b].RegisteredAt)
+		}
+
+		return result[a].URL < result[b].URL
+	})
+
+	return result
+}
+
+// save writes the registry to its file, replacing the old one at once.
+func (r *registryStorage) save() error {
+	regs := r.sorted()
+	stored := make([]registration, 0, len(regs))
+	for _, reg := range regs {
+		stored = append(stored, registration{
+			URL:          reg.URL,
+			Type:         reg.Type,
+			Labels:       labels(reg.Labels),
+			Capacity:     reg.Capacity,
+			Self:         reg.Self,
+			RegisteredAt: reg.RegisteredAt,
+		})
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode registry: %w", err)
+	}
+
+	if err = writeFile(r.path, data); err != nil {
+		return fmt.Errorf("can't write registry file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package localkms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+// MasterKeySize is a size of an AES-256 master key.
+const MasterKeySize = 32
+
+type keyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewKeyWrapper returns a KeyWrapper sealing data keys with AES-256-GCM under a master key held in memory.
+func NewKeyWrapper(masterKey []byte) (interfaces.KeyWrapper, error) {
+	if len(masterKey) != MasterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(masterKey))
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("can't create GCM: %w", err)
+	}
+
+	return &keyWrapper{aead: aead}, nil
+}
+
+// LoadMasterKey decodes a base64 master key, or reads it from a file when encoded is empty.
+// The file may hold either raw key bytes or their base64 form.
+func LoadMasterKey(encoded, path string) ([]byte, error) {
+	if encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode master key: %w", err)
+		}
+
+		return key, nil
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("neither master key nor master key file is set")
+	}
+
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read master key file: %s, err: %w", path, err)
+	}
+
+	if len(data) == MasterKeySize {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode master key file: %s, err: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func (k *keyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %w", err)
+	}
+
+	return k.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (k *keyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+
+	dataKey, err := k.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap data key: %w", err)
+	}
+
+	return dataKey, nil
+}
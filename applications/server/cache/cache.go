@@ -0,0 +1,455 @@
+// Package cache keeps copies of parts read often in memory, and optionally on local disk, in front of storages.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultMaxEntrySize caps parts kept when no limit is given; bigger parts are streamed past the cache.
+const defaultMaxEntrySize = 8 * 1024 * 1024 // 8 MB
+
+// diskFileExt names files of the disk tier, so that only they are cleared at startup.
+const diskFileExt = ".part"
+
+// Stats are counters of a cache since it was created, and how much it holds.
+type Stats struct {
+	MemoryHits      uint64
+	DiskHits        uint64
+	Misses          uint64
+	MemoryEvictions uint64
+	DiskEvictions   uint64
+	MemoryBytes     int64
+	DiskBytes       int64
+}
+
+// Cache is a least-recently-used cache of parts keyed by storage and path. Parts evicted from memory move to disk
+// when the disk tier is enabled, and parts found on disk move back to memory.
+type Cache struct {
+	maxEntrySize int64
+	memory       *tier
+	// disk is nil unless the disk tier is enabled.
+	disk    *tier
+	diskDir string
+	// writeFile writes files of the disk tier.
+	writeFile func(name string, data []byte, perm os.FileMode) error
+
+	// m guards the index of the tiers only; files of the disk tier are read and written without holding it.
+	m sync.Mutex
+	// fills are reads in progress that will add what they read; invalidation marks them stale.
+	fills map[*fill]struct{}
+	// diskFiles counts files of the disk tier created, so every entry gets a file of its own.
+	diskFiles uint64
+	stats     Stats
+}
+
+// Option configures optional behaviour of the cache.
+type Option func(c *Cache)
+
+// WithDisk keeps parts evicted from memory in dir, up to size bytes. Files left in dir by earlier runs are removed.
+func WithDisk(dir string, size int64) Option {
+	return func(c *Cache) {
+		if dir != "" && size > 0 {
+			c.diskDir = dir
+			c.disk = newTier(size)
+		}
+	}
+}
+
+// WithMaxEntrySize leaves parts bigger than size bytes out of the cache.
+func WithMaxEntrySize(size int64) Option {
+	return func(c *Cache) {
+		if size > 0 {
+			c.maxEntrySize = size
+		}
+	}
+}
+
+// New returns a cache keeping up to memorySize bytes of parts in memory.
+func New(memorySize int64, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxEntrySize: defaultMaxEntrySize,
+		memory:       newTier(memorySize),
+		writeFile:    os.WriteFile,
+		fills:        map[*fill]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.maxEntrySize > memorySize {
+		c.maxEntrySize = memorySize
+	}
+
+	if c.disk != nil {
+		if err := clearDir(c.diskDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// clearDir creates dir, removing parts left there by an earlier run, as their index is kept in memory only.
+func clearDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("can't create cache dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("can't list cache dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), diskFileExt) {
+			if err = os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return fmt.Errorf("can't clear cache dir: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stats returns counters of the cache.
+func (c *Cache) Stats() Stats {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	stats := c.stats
+	stats.MemoryBytes = c.memory.used
+	if c.disk != nil {
+		stats.DiskBytes = c.disk.used
+	}
+
+	return stats
+}
+
+// key identifies a copy of a part. Copies on different storages are cached apart, as a storage may be written
+// to while others aren't.
+func key(storageURL, path string) string {
+	return storageURL + "\x00" + path
+}
+
+// get returns a cached part. A part found on disk is moved back to memory.
+func (c *Cache) get(k string) ([]byte, bool) {
+	c.m.Lock()
+
+	if e, ok := c.memory.get(k); ok {
+		c.stats.MemoryHits++
+		c.m.Unlock()
+
+		return e.data, true
+	}
+
+	var e *entry
+	if c.disk != nil {
+		e, _ = c.disk.get(k)
+	}
+
+	if e == nil {
+		c.stats.Misses++
+		c.m.Unlock()
+
+		return nil, false
+	}
+
+	if e.data != nil {
+		// The part is still being written to disk, so it's at hand.
+		c.stats.DiskHits++
+		var ops diskOps
+		c.removeFromDisk(k, &ops)
+		c.addToMemory(k, e.data, &ops)
+		c.m.Unlock()
+
+		c.apply(ops)
+
+		return e.data, true
+	}
+
+	// The file is taken out of the tier to be read; a fill notices the part invalidated meanwhile.
+	c.disk.remove(k)
+	f := &fill{key: k}
+	c.fills[f] = struct{}{}
+	c.m.Unlock()
+
+	data, err := os.ReadFile(e.file)
+	os.Remove(e.file)
+
+	c.m.Lock()
+	delete(c.fills, f)
+	// A file gone or cut short is as good as missing.
+	if err != nil || int64(len(data)) != e.size {
+		c.stats.Misses++
+		c.m.Unlock()
+
+		return nil, false
+	}
+
+	c.stats.DiskHits++
+	var ops diskOps
+	if !f.stale {
+		c.addToMemory(k, data, &ops)
+	}
+	c.m.Unlock()
+
+	c.apply(ops)
+
+	return data, true
+}
+
+// startFill registers a read of the part that will be added to the cache when it completes.
+func (c *Cache) startFill(k string) *fill {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f := &fill{key: k}
+	c.fills[f] = struct{}{}
+
+	return f
+}
+
+// finishFill adds what the read got, unless the part was written or deleted while it was being read.
+func (c *Cache) finishFill(f *fill, data []byte) {
+	var ops diskOps
+	c.m.Lock()
+
+	delete(c.fills, f)
+	if !f.stale && data != nil {
+		c.removeFromDisk(f.key, &ops)
+		c.addToMemory(f.key, data, &ops)
+	}
+	c.m.Unlock()
+
+	c.apply(ops)
+}
+
+// invalidate drops the part from every tier and keeps reads in progress from adding it back.
+func (c *Cache) invalidate(k string) {
+	c.invalidateMatching(func(candidate string) bool { return candidate == k })
+}
+
+// invalidateStorage drops every part of the storage at url.
+func (c *Cache) invalidateStorage(url string) {
+	prefix := key(url, "")
+	c.invalidateMatching(func(candidate string) bool { return strings.HasPrefix(candidate, prefix) })
+}
+
+func (c *Cache) invalidateMatching(match func(k string) bool) {
+	var ops diskOps
+	c.m.Lock()
+
+	for f := range c.fills {
+		if match(f.key) {
+			f.stale = true
+		}
+	}
+
+	for _, k := range c.memory.keys(match) {
+		c.memory.remove(k)
+	}
+
+	if c.disk != nil {
+		for _, k := range c.disk.keys(match) {
+			c.removeFromDisk(k, &ops)
+		}
+	}
+	c.m.Unlock()
+
+	c.apply(ops)
+}
+
+// diskOps are file operations of the disk tier decided on under the lock, carried out once it's released.
+type diskOps struct {
+	// writes are entries reserved in the disk tier whose files are yet to be written.
+	writes  []*entry
+	removes []string
+}
+
+// addToMemory adds the part to memory, moving parts evicted to make room for it to disk.
+func (c *Cache) addToMemory(k string, data []byte, ops *diskOps) {
+	c.memory.remove(k)
+	for _, evicted := range c.memory.add(&entry{key: k, size: int64(len(data)), data: data}) {
+		c.stats.MemoryEvictions++
+		c.addToDisk(evicted, ops)
+	}
+}
+
+// addToDisk reserves room for the part in the disk tier. It's served from data until its file is written.
+func (c *Cache) addToDisk(e *entry, ops *diskOps) {
+	if c.disk == nil || e.size > c.disk.limit {
+		return
+	}
+
+	c.diskFiles++
+	reserved := &entry{key: e.key, size: e.size, data: e.data, file: c.diskPath(e.key, c.diskFiles)}
+	for _, evicted := range c.disk.add(reserved) {
+		c.stats.DiskEvictions++
+		c.dropFile(evicted, ops)
+	}
+	ops.writes = append(ops.writes, reserved)
+}
+
+func (c *Cache) removeFromDisk(k string, ops *diskOps) {
+	if c.disk == nil {
+		return
+	}
+
+	if e, ok := c.disk.get(k); ok {
+		c.disk.remove(k)
+		c.dropFile(e, ops)
+	}
+}
+
+// dropFile removes the file of an entry no longer in the disk tier. Files still being written are removed by
+// their writers, which find their entries gone.
+func (c *Cache) dropFile(e *entry, ops *diskOps) {
+	if e.data == nil {
+		ops.removes = append(ops.removes, e.file)
+	}
+}
+
+// apply carries out ops. It must be called without holding the lock.
+func (c *Cache) apply(ops diskOps) {
+	for _, name := range ops.removes {
+		os.Remove(name)
+	}
+
+	for _, e := range ops.writes {
+		c.commitDisk(e, c.writeDiskFile(e))
+	}
+}
+
+// writeDiskFile writes the part to a temporary file first, so its file is never seen half written.
+func (c *Cache) writeDiskFile(e *entry) error {
+	tmp := strings.TrimSuffix(e.file, diskFileExt) + ".tmp" + diskFileExt
+	if err := c.writeFile(tmp, e.data, 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, e.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// commitDisk makes the entry read from its file once it's written. An entry dropped from the tier meanwhile,
+// or whose file couldn't be written, leaves no file behind.
+func (c *Cache) commitDisk(e *entry, writeErr error) {
+	c.m.Lock()
+
+	current, ok := c.disk.entries[e.key]
+	kept := ok && current.Value.(*entry) == e
+	switch {
+	case kept && writeErr == nil:
+		e.data = nil
+	case kept:
+		// The disk tier is best effort; the part is read from its storage next time.
+		c.disk.remove(e.key)
+	}
+	c.m.Unlock()
+
+	if !kept && writeErr == nil {
+		os.Remove(e.file)
+	}
+}
+
+// diskPath names a file of a part after a hash of its key, as paths may contain anything, and a sequence number,
+// as a part may be written again while its earlier file is being removed.
+func (c *Cache) diskPath(k string, seq uint64) string {
+	sum := sha256.Sum256([]byte(k))
+	return filepath.Join(c.diskDir, fmt.Sprintf("%s-%d%s", hex.EncodeToString(sum[:]), seq, diskFileExt))
+}
+
+// fill is a read of a part whose result is to be cached.
+type fill struct {
+	key   string
+	stale bool
+}
+
+type entry struct {
+	key  string
+	size int64
+	// data is nil for entries of the disk tier, which keep it in files, once their files are written.
+	data []byte
+	// file is where an entry of the disk tier is kept.
+	file string
+}
+
+// tier is a least-recently-used index of entries taking up to limit bytes.
+type tier struct {
+	limit   int64
+	used    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newTier(limit int64) *tier {
+	return &tier{
+		limit:   limit,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (t *tier) get(k string) (*entry, bool) {
+	el, ok := t.entries[k]
+	if !ok {
+		return nil, false
+	}
+
+	t.order.MoveToFront(el)
+
+	return el.Value.(*entry), true
+}
+
+// add puts e first and returns entries evicted to make room for it.
+func (t *tier) add(e *entry) []*entry {
+	var evicted []*entry
+	for t.used+e.size > t.limit && t.order.Len() > 0 {
+		last := t.order.Back().Value.(*entry)
+		t.remove(last.key)
+		evicted = append(evicted, last)
+	}
+
+	t.entries[e.key] = t.order.PushFront(e)
+	t.used += e.size
+
+	return evicted
+}
+
+// remove reports whether there was an entry to remove.
+func (t *tier) remove(k string) bool {
+	el, ok := t.entries[k]
+	if !ok {
+		return false
+	}
+
+	t.order.Remove(el)
+	delete(t.entries, k)
+	t.used -= el.Value.(*entry).size
+
+	return true
+}
+
+func (t *tier) keys(match func(k string) bool) []string {
+	var result []string
+	for k := range t.entries {
+		if match(k) {
+			result = append(result, k)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+// countingStorage counts reads reaching the storage.
+type countingStorage struct {
+	interfaces.Storage
+	reads int32
+}
+
+func (c *countingStorage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.Storage.ReadFilePart(ctx, path)
+}
+
+func readPart(t *testing.T, storage interfaces.Storage, ctx context.Context, path string) []byte {
+	t.Helper()
+
+	body, err := storage.ReadFilePart(ctx, path)
+	require.NoError(t, err)
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(1024, WithMaxEntrySize(512))
+	require.NoError(t, err)
+
+	next := &countingStorage{Storage: inmemory.NewStorage("storage_0", log.NewNopLogger())}
+	storage := NewStorage(next, c)
+
+	require.NoError(t, storage.UploadFilePart(ctx, "a", bytes.NewReader([]byte("first"))))
+	assert.Equal(t, []byte("first"), readPart(t, storage, ctx, "a"))
+	assert.Equal(t, []byte("first"), readPart(t, storage, ctx, "a"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&next.reads))
+
+	// Overwriting drops the cached part.
+	require.NoError(t, storage.UploadFilePart(ctx, "a", bytes.NewReader([]byte("second"))))
+	assert.Equal(t, []byte("second"), readPart(t, storage, ctx, "a"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&next.reads))
+
+	// Verifying reads go past the cache.
+	readPart(t, storage, Bypass(ctx), "a")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&next.reads))
+
+	require.NoError(t, storage.DeleteFilePart(ctx, "a"))
+	_, err = storage.ReadFilePart(ctx, "a")
+	assert.ErrorIs(t, err, domain.ErrPartNotFound)
+
+	// Parts read partly and parts too big aren't kept.
+	require.NoError(t, storage.UploadFilePart(ctx, "b", bytes.NewReader([]byte("partly"))))
+	body, err := storage.ReadFilePart(ctx, "b")
+	require.NoError(t, err)
+	_, err = body.Read(make([]byte, 2))
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+
+	require.NoError(t, storage.UploadFilePart(ctx, "c", bytes.NewReader(make([]byte, 513))))
+	readPart(t, storage, ctx, "c")
+
+	assert.Equal(t, Stats{MemoryHits: 1, Misses: 5}, c.Stats())
+}
+
+func TestStaleFill(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(1024)
+	require.NoError(t, err)
+	storage := NewStorage(inmemory.NewStorage("storage_0", log.NewNopLogger()), c)
+
+	require.NoError(t, storage.UploadFilePart(ctx, "a", bytes.NewReader([]byte("old"))))
+	body, err := storage.ReadFilePart(ctx, "a")
+	require.NoError(t, err)
+
+	// The part is overwritten while the old one is being read, so what's read isn't kept.
+	require.NoError(t, storage.UploadFilePart(ctx, "a", bytes.NewReader([]byte("new"))))
+	old, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	assert.Equal(t, []byte("old"), old)
+
+	assert.Equal(t, []byte("new"), readPart(t, storage, ctx, "a"))
+}
+
+func TestDiskTier(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/stale"+diskFileExt, []byte("left over"), 0o600))
+
+	c, err := New(100, WithDisk(dir, 1000))
+	require.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	next := &countingStorage{Storage: inmemory.NewStorage("storage_0", log.NewNopLogger())}
+	storage := NewStorage(next, c)
+
+	parts := map[string][]byte{}
+	for _, path := range []string{"a", "b", "c"} {
+		parts[path] = make([]byte, 60)
+		_, err = rand.Read(parts[path])
+		require.NoError(t, err)
+		require.NoError(t, storage.UploadFilePart(ctx, path, bytes.NewReader(parts[path])))
+		readPart(t, storage, ctx, path)
+	}
+
+	// Only one part fits in memory; the others were moved to disk, and are moved back when read.
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for _, path := range []string{"a", "b", "c"} {
+		assert.Equal(t, parts[path], readPart(t, storage, ctx, path))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&next.reads))
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(3), stats.DiskHits)
+	assert.Equal(t, int64(60), stats.MemoryBytes)
+	assert.Equal(t, int64(120), stats.DiskBytes)
+
+	// Removing a storage drops its parts from every tier.
+	storageManager := NewStorageManager(inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree()), c)
+	require.NoError(t, storageManager.AddStorage(ctx, "storage_0", next, domain.StorageLabels{}))
+	require.NoError(t, storageManager.RemoveStorage(ctx, "storage_0"))
+	stats = c.Stats()
+	assert.Zero(t, stats.MemoryBytes)
+	assert.Zero(t, stats.DiskBytes)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDiskWriteDoesNotBlockHits(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(100, WithDisk(t.TempDir(), 1000))
+	require.NoError(t, err)
+
+	// The first write hangs until released.
+	writing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	c.writeFile = func(name string, data []byte, perm os.FileMode) error {
+		once.Do(func() {
+			close(writing)
+			<-release
+		})
+
+		return os.WriteFile(name, data, perm)
+	}
+
+	storage := NewStorage(inmemory.NewStorage("storage_0", log.NewNopLogger()), c)
+	for _, path := range []string{"a", "b"} {
+		require.NoError(t, storage.UploadFilePart(ctx, path, bytes.NewReader(bytes.Repeat([]byte(path), 60))))
+	}
+	readPart(t, storage, ctx, "a")
+
+	// Reading b moves a to disk.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readPart(t, storage, ctx, "b")
+	}()
+	<-writing
+
+	hit := make(chan []byte)
+	go func() {
+		data, _ := c.get(key("storage_0", "b"))
+		hit <- data
+	}()
+	select {
+	case data := <-hit:
+		assert.Equal(t, bytes.Repeat([]byte("b"), 60), data)
+	case <-time.After(time.Second):
+		t.Fatal("memory hit waits for a disk write")
+	}
+
+	close(release)
+	<-done
+	assert.Equal(t, int64(60), c.Stats().DiskBytes)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 60), readPart(t, storage, ctx, "a"))
+	assert.Equal(t, uint64(1), c.Stats().DiskHits)
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type bypassKey struct{}
+
+// Bypass marks reads that must reach storages themselves, like verifying what they keep.
+// They are neither served from the cache nor added to it.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+func bypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassKey{}).(bool)
+	return bypass
+}
+
+type storage struct {
+	interfaces.Storage
+	cache *Cache
+}
+
+// NewStorage returns next serving parts read before from the cache. Parts written or deleted through it
+// are dropped from the cache.
+func NewStorage(next interfaces.Storage, cache *Cache) interfaces.Storage {
+	return &storage{
+		Storage: next,
+		cache:   cache,
+	}
+}
+
+func (s *storage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	if bypassed(ctx) {
+		return s.Storage.ReadFilePart(ctx, path)
+	}
+
+	k := key(s.GetStorageURL(), path)
+	if data, ok := s.cache.get(k); ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	f := s.cache.startFill(k)
+	body, err := s.Storage.ReadFilePart(ctx, path)
+	if err != nil {
+		s.cache.finishFill(f, nil)
+		return nil, err
+	}
+
+	return &fillingBody{ReadCloser: body, cache: s.cache, fill: f, limit: s.cache.maxEntrySize}, nil
+}
+
+func (s *storage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	// Dropped both before, so reads during the upload don't get the old part, and after, so reads that started
+	// before the upload don't add it back.
+	s.cache.invalidate(key(s.GetStorageURL(), path))
+	defer s.cache.invalidate(key(s.GetStorageURL(), path))
+
+	return s.Storage.UploadFilePart(ctx, path, body)
+}
+
+func (s *storage) DeleteFilePart(ctx context.Context, path string) error {
+	s.cache.invalidate(key(s.GetStorageURL(), path))
+	defer s.cache.invalidate(key(s.GetStorageURL(), path))
+
+	return s.Storage.DeleteFilePart(ctx, path)
+}
+
+// fillingBody keeps what is read of a part, and adds it to the cache once the part is read to the end.
+// Parts bigger than limit and parts not read to the end aren't added.
+type fillingBody struct {
+	io.ReadCloser
+	cache    *Cache
+	fill     *fill
+	limit    int64
+	buf      []byte
+	overflow bool
+	finished bool
+}
+
+func (b *fillingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow && !b.finished {
+		if int64(len(b.buf)+n) > b.limit {
+			b.overflow = true
+			b.buf = nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+
+	if errors.Is(err, io.EOF) && !b.finished {
+		b.finish(!b.overflow)
+	} else if err != nil && !b.finished {
+		b.finish(false)
+	}
+
+	return n, err
+}
+
+func (b *fillingBody) Close() error {
+	if !b.finished {
+		b.finish(false)
+	}
+
+	return b.ReadCloser.Close()
+}
+
+func (b *fillingBody) finish(complete bool) {
+	b.finished = true
+
+	var data []byte
+	if complete {
+		data = b.buf
+		if data == nil {
+			data = []byte{}
+		}
+	}
+	b.buf = nil
+
+	b.cache.finishFill(b.fill, data)
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type storageManager struct {
+	interfaces.StorageManager
+	cache *Cache
+}
+
+// NewStorageManager returns next with storages added through it cached with NewStorage.
+// Parts of a removed storage are dropped from the cache.
+func NewStorageManager(next interfaces.StorageManager, cache *Cache) interfaces.StorageManager {
+	return &storageManager{
+		StorageManager: next,
+		cache:          cache,
+	}
+}
+
+func (m *storageManager) AddStorage(ctx context.Context, storageURL string, storage interfaces.Storage,
+	labels domain.StorageLabels) error {
+	return m.StorageManager.AddStorage(ctx, storageURL, NewStorage(storage, m.cache), labels)
+}
+
+func (m *storageManager) RemoveStorage(ctx context.Context, storageURL string) error {
+	if err := m.StorageManager.RemoveStorage(ctx, storageURL); err != nil {
+		return err
+	}
+
+	m.cache.invalidateStorage(storageURL)
+
+	return nil
+}
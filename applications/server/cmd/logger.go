@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// levelLogger writes records of a level and more severe ones in a format; both can be changed while the server runs.
+type levelLogger struct {
+	w io.Writer
+
+	m        sync.Mutex
+	format   string
+	allow    level.Option
+	filtered atomic.Value
+}
+
+// newLevelLogger returns a logger writing every record to w as JSON until a level or a format is set.
+func newLevelLogger(w io.Writer) *levelLogger {
+	l := &levelLogger{
+		w:      log.NewSyncWriter(w),
+		format: "json",
+		allow:  level.AllowAll(),
+	}
+	l.filtered.Store(level.NewFilter(log.NewJSONLogger(l.w), l.allow))
+
+	return l
+}
+
+func (l *levelLogger) Log(keyvals ...interface{}) error {
+	return l.filtered.Load().(log.Logger).Log(keyvals...)
+}
+
+// SetLevel logs records of level name and more severe ones from now on.
+func (l *levelLogger) SetLevel(name string) error {
+	var allow level.Option
+	switch name {
+	case "debug":
+		allow = level.AllowDebug()
+	case "info":
+		allow = level.AllowInfo()
+	case "warn":
+		allow = level.AllowWarn()
+	case "error":
+		allow = level.AllowError()
+	default:
+		return fmt.Errorf("unknown log level %q", name)
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.allow = allow
+
+	return l.rebuild()
+}
+
+// SetFormat writes records as "json" or "logfmt" from now on.
+func (l *levelLogger) SetFormat(format string) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	previous := l.format
+	l.format = format
+	if err := l.rebuild(); err != nil {
+		l.format = previous
+		return err
+	}
+
+	return nil
+}
+
+func (l *levelLogger) rebuild() error {
+	var next log.Logger
+	switch l.format {
+	case "json":
+		next = log.NewJSONLogger(l.w)
+	case "logfmt":
+		next = log.NewLogfmtLogger(l.w)
+	default:
+		return fmt.Errorf("unknown log format %q", l.format)
+	}
+
+	l.filtered.Store(level.NewFilter(next, l.allow))
+
+	return nil
+}
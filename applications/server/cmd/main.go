@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	nethttp "net/http"
 	"os"
 	"os/signal"
 	"runtime/debug"
@@ -12,14 +14,25 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/adapters/connector"
 	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/jsonfile"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/cache"
 	"github.com/donmikel/karma8/applications/server/config"
+	"github.com/donmikel/karma8/applications/server/domain"
 	"github.com/donmikel/karma8/applications/server/handlers/http"
 	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/metrics"
+	"github.com/donmikel/karma8/applications/server/placement"
 	"github.com/donmikel/karma8/applications/server/services"
+	"github.com/donmikel/karma8/applications/server/tracing"
 )
 
 // exitCode is a process termination code.
@@ -33,7 +46,8 @@ const (
 	exitFailure exitCode = 1
 )
 
-const storageCount = 7
+// bootstrapKeyID is an ID of the admin key taken from config.
+const bootstrapKeyID = "bootstrap"
 
 // Kubernetes (rolling update) doesn't wait until a pod is out of rotation before sending SIGTERM,
 // and external LB could still route traffic to a non-existing pod resulting in a surge of 50x API errors.
@@ -58,14 +72,16 @@ func main() {
 // nolint
 func gracefulMain() exitCode {
 	var logger log.Logger
+	levelLogger := newLevelLogger(os.Stderr)
 	{
-		logger = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(levelLogger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	configPath := fs.String("config", "", "path to the config file")
 	v := fs.Bool("v", false, "Show version")
+	printConfig := fs.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	configFlags := config.RegisterFlags(fs)
 
 	err := fs.Parse(os.Args[1:])
 	if err == flag.ErrHelp {
@@ -88,38 +104,169 @@ func gracefulMain() exitCode {
 
 	logger.Log("configPath", *configPath)
 
-	cfg, err := config.Parse(*configPath)
+	cfg, err := config.Load(*configPath, os.LookupEnv, configFlags)
 	if err != nil {
 		logger.Log("msg", "cannot parse service config", "err", err)
 		return exitFailure
 	}
 
+	if *printConfig {
+		out, err := cfg.Redacted().Marshal()
+		if err != nil {
+			logger.Log("msg", "cannot print service config", "err", err)
+			return exitFailure
+		}
+
+		fmt.Print(string(out))
+
+		return exitSuccess
+	}
+
 	err = cfg.Validate()
 	if err != nil {
 		logger.Log("msg", "config validation failed", "err", err)
 		return exitFailure
 	}
 
+	if err = levelLogger.SetLevel(cfg.Log.Level); err != nil {
+		logger.Log("msg", "can't set log level", "err", err)
+		return exitFailure
+	}
+
+	if err = levelLogger.SetFormat(cfg.Log.Format); err != nil {
+		logger.Log("msg", "can't set log format", "err", err)
+		return exitFailure
+	}
+
 	// It's nice to be able to see panics in Logs, hence we monitor for panics after
 	// logger has been bootstrapped.
 	defer monitorPanic(logger)
 	ctx := context.Background()
 
+	instruments := metrics.New()
+
+	var tracerProvider trace.TracerProvider
+	if cfg.Tracing.Exporter != "" {
+		provider, err := tracing.NewProvider(ctx, cfg.Tracing.Exporter,
+			tracing.WithEndpoint(cfg.Tracing.Endpoint, cfg.Tracing.Insecure),
+			tracing.WithSampleRatio(cfg.Tracing.SampleRatio),
+			tracing.WithVersion(version),
+		)
+		if err != nil {
+			level.Error(logger).Log("msg", "can't create tracer provider",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+
+		// Spans still batched are flushed on the way out.
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			if err := provider.Shutdown(shutdownCtx); err != nil {
+				level.Error(logger).Log("msg", "can't flush spans",
+					"err", err,
+				)
+			}
+		}()
+
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			level.Warn(logger).Log("msg", "can't export spans",
+				"err", err,
+			)
+		}))
+
+		tracerProvider = provider
+	}
+
+	// Memory is the only metadata backend config validation lets through so far.
 	var fileMetaStorage interfaces.FileMetaStorage
 	{
 		fileMetaStorage = inmemory.NewFileMetaStorage()
+		fileMetaStorage = metrics.NewFileMetaStorage(fileMetaStorage, instruments)
+		if tracerProvider != nil {
+			fileMetaStorage = tracing.NewFileMetaStorage(fileMetaStorage, tracerProvider)
+		}
+	}
+
+	policy, err := placement.New(cfg.Placement.Policy)
+	if err != nil {
+		level.Error(logger).Log("msg", "can't create placement policy",
+			"err", err,
+		)
+
+		return exitFailure
+	}
+
+	var partCache *cache.Cache
+	if cfg.Cache.MemorySize > 0 {
+		partCache, err = cache.New(cfg.Cache.MemorySize,
+			cache.WithMaxEntrySize(cfg.Cache.MaxPartSize),
+			cache.WithDisk(cfg.Cache.DiskDir, cfg.Cache.DiskSize),
+		)
+		if err != nil {
+			level.Error(logger).Log("msg", "can't create part cache",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+
+		instruments.WatchCache(partCache)
 	}
 
 	var storageManager interfaces.StorageManager
 	{
-		storageManager = inmemory.NewStorageManager(logger)
+		storageManager = inmemory.NewStorageManager(logger, policy)
+		// Cached parts are served before storages are instrumented, so storage metrics and spans count real reads.
+		if partCache != nil {
+			storageManager = cache.NewStorageManager(storageManager, partCache)
+		}
+		storageManager = metrics.NewStorageManager(storageManager, instruments)
+		if tracerProvider != nil {
+			storageManager = tracing.NewStorageManager(storageManager, tracerProvider)
+		}
 	}
+	instruments.WatchStorages(storageManager, fileMetaStorage)
 
-	for i := 0; i < storageCount; i++ {
-		storageURL := fmt.Sprintf("storage_%d", i)
-		err = storageManager.AddStorage(ctx, storageURL, inmemory.NewStorage(storageURL, logger))
+	var registryStorage interfaces.RegistryStorage
+	if cfg.Registration.File != "" {
+		registryStorage, err = jsonfile.NewRegistryStorage(cfg.Registration.File)
 		if err != nil {
+			level.Error(logger).Log("msg", "can't open storage registry",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+	} else {
+		registryStorage = inmemory.NewRegistryStorage()
+	}
+
+	var registry server.StorageRegistry
+	{
+		registry = services.NewStorageRegistry(storageManager, registryStorage, connector.New(&nethttp.Client{}, logger), logger,
+			services.WithNodeKey(cfg.Registration.Key),
+			services.WithHeartbeatTimeout(cfg.Registration.HeartbeatTimeout),
+		)
+	}
+
+	if err = registry.Restore(ctx); err != nil {
+		level.Error(logger).Log("msg", "can't restore storage registry",
+			"err", err,
+		)
+
+		return exitFailure
+	}
+
+	// Configured storages are registered once; later starts find them restored.
+	for _, storage := range cfg.Storages {
+		if _, err = registry.Register(ctx, registration(storage)); err != nil {
 			level.Error(logger).Log("msg", "error adding storage",
+				"storage", storage.URL,
 				"err", err,
 			)
 
@@ -127,26 +274,213 @@ func gracefulMain() exitCode {
 		}
 	}
 
+	var (
+		serviceOpts []services.ServiceOption
+		keyWrapper  interfaces.KeyWrapper
+	)
+	if cfg.Encryption.Enabled {
+		masterKey, err := localkms.LoadMasterKey(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "can't load master key",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+
+		keyWrapper, err = localkms.NewKeyWrapper(masterKey)
+		if err != nil {
+			level.Error(logger).Log("msg", "can't create key wrapper",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+
+		serviceOpts = append(serviceOpts, services.WithEncryption(keyWrapper))
+	}
+
+	if cfg.Compression.Codec != "" {
+		serviceOpts = append(serviceOpts, services.WithCompression(cfg.Compression.Codec, cfg.Compression.SkipContentTypes))
+	}
+
+	if cfg.Dedup.Enabled {
+		chunkSize := cfg.Dedup.ChunkSize
+		if cfg.Dedup.Chunking == services.ChunkingCDC {
+			chunkSize = cfg.Dedup.AvgChunkSize
+		}
+		serviceOpts = append(serviceOpts, services.WithDeduplication(cfg.Dedup.Chunking, chunkSize))
+	}
+
+	serviceOpts = append(serviceOpts,
+		services.WithSplit(cfg.Split.Parts, cfg.Split.MinPartSize),
+		services.WithParallelUploads(cfg.Upload.Concurrency, cfg.Upload.MemoryBudget),
+		services.WithPrefetch(cfg.Download.Prefetch, cfg.Download.MemoryBudget),
+		services.WithReplication(cfg.Placement.Replicas),
+		services.WithLogger(logger),
+	)
+
 	var fileService server.FileService
 	{
-		fileService = services.NewService(fileMetaStorage, storageManager)
+		fileService = services.NewService(fileMetaStorage, storageManager, serviceOpts...)
+		fileService = metrics.NewFileService(fileService, instruments)
 	}
 
-	hServer := http.NewHTTPServer(cfg.API, fileService, logger)
+	var authService server.AuthService
+	if cfg.Auth.Enabled {
+		keyStorage := inmemory.NewAPIKeyStorage()
+		if cfg.Auth.AdminKey != "" {
+			err = keyStorage.PutKey(ctx, domain.APIKey{
+				ID:        bootstrapKeyID,
+				Hash:      services.HashAPIKey(cfg.Auth.AdminKey),
+				Grants:    []domain.Grant{{Bucket: domain.AnyBucket, Scopes: []domain.Scope{domain.ScopeAdmin}}},
+				CreatedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "error adding bootstrap admin key",
+					"err", err,
+				)
+
+				return exitFailure
+			}
+		}
+
+		authService = services.NewAuthService(keyStorage)
+	} else {
+		level.Warn(logger).Log("msg", "auth is disabled, admin and debug routes are open to anyone reaching the server",
+			"addr", cfg.API.HTTPAddr,
+		)
+	}
+
+	var signer server.URLSigner
+	if cfg.Presign.Key != "" {
+		signer = services.NewURLSigner([]byte(cfg.Presign.Key), cfg.Presign.MaxExpiry)
+	}
+
+	var rebalanceStateStorage interfaces.RebalanceStateStorage
+	if cfg.Rebalance.StateFile != "" {
+		rebalanceStateStorage, err = jsonfile.NewRebalanceStateStorage(cfg.Rebalance.StateFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "can't open rebalance state",
+				"err", err,
+			)
+
+			return exitFailure
+		}
+	} else {
+		rebalanceStateStorage = inmemory.NewRebalanceStateStorage()
+	}
+
+	var rebalancer server.Rebalancer
+	{
+		rebalancer = services.NewRebalancer(fileMetaStorage, storageManager, rebalanceStateStorage, logger,
+			services.WithRebalanceThreshold(cfg.Rebalance.Threshold),
+			services.WithRebalanceRateLimit(cfg.Rebalance.RateLimit),
+		)
+	}
+
+	if err = rebalancer.Resume(ctx); err != nil {
+		level.Error(logger).Log("msg", "can't resume rebalancing",
+			"err", err,
+		)
+
+		return exitFailure
+	}
+
+	var healthChecker server.HealthChecker
+	{
+		healthChecker = services.NewHealthChecker(storageManager, logger,
+			services.WithHealthInterval(cfg.Health.Interval),
+			services.WithHealthTimeout(cfg.Health.Timeout),
+			services.WithSlowPing(cfg.Health.SlowPing),
+			services.WithDownAfter(cfg.Health.DownAfter),
+			services.WithLivenessCheck(registry.CheckHeartbeat),
+		)
+	}
+
+	var scrubber server.Scrubber
+	{
+		scrubOpts := []services.ScrubberOption{
+			services.WithScrubRateLimit(cfg.Scrub.RateLimit),
+			services.WithScrubInterval(cfg.Scrub.Interval),
+		}
+		if keyWrapper != nil {
+			scrubOpts = append(scrubOpts, services.WithScrubDecryption(keyWrapper))
+		}
+
+		scrubber = services.NewScrubber(fileMetaStorage, storageManager, logger, scrubOpts...)
+	}
+
+	minStorages := cfg.Health.MinStorages
+	if minStorages == 0 {
+		minStorages = cfg.Placement.Replicas
+	}
+
+	var statusReporter server.StatusReporter
+	{
+		statusReporter = services.NewStatusReporter(fileMetaStorage, storageManager, healthChecker,
+			services.WithMinStorages(minStorages),
+			services.WithVersion(version),
+		)
+	}
+
+	uploadAdmission := services.NewUploadAdmission(
+		services.WithUploadLimits(cfg.Admission.MaxUploads, cfg.Admission.MaxBytes),
+		services.WithClientUploadLimits(cfg.Admission.ClientMaxUploads, cfg.Admission.ClientMaxBytes),
+		services.WithAdmissionQueue(cfg.Admission.QueueSize, cfg.Admission.QueueTimeout),
+		services.WithRetryAfter(cfg.Admission.RetryAfter),
+	)
+	instruments.WatchAdmission(uploadAdmission)
+
+	hServer := http.NewHTTPServer(cfg.API, fileService, logger,
+		http.WithAuth(authService),
+		http.WithSigner(signer),
+		http.WithRebalancer(rebalancer),
+		http.WithHealth(healthChecker),
+		http.WithRegistry(registry),
+		http.WithScrubber(scrubber),
+		http.WithStatus(statusReporter),
+		http.WithAdmission(uploadAdmission),
+		http.WithMetrics(instruments),
+		http.WithTracerProvider(tracerProvider),
+	)
+
+	reloader := &reloader{
+		load: func() (config.Server, error) {
+			return config.Load(*configPath, os.LookupEnv, configFlags)
+		},
+		current:     cfg,
+		levelLogger: levelLogger,
+		registry:    registry,
+		rebalancer:  rebalancer,
+		scrubber:    scrubber,
+		admission:   uploadAdmission,
+		logger:      logger,
+	}
 
 	group, ctx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case s := <-sig:
-			level.Info(logger).Log("msg", fmt.Sprintf("signal received (waiting %v before terminating): %v", preStopWait, s))
-			time.Sleep(preStopWait)
-			level.Info(logger).Log("msg", "terminating...")
-
-			return fmt.Errorf("signal received: %s", s)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case s := <-sig:
+				if s == syscall.SIGHUP {
+					level.Info(logger).Log("msg", "reloading config")
+					reloader.reload(ctx)
+					continue
+				}
+
+				// Readiness fails at once, so the pod is out of rotation by the time the server stops.
+				statusReporter.BeginShutdown()
+				level.Info(logger).Log("msg", fmt.Sprintf("signal received (waiting %v before terminating): %v", preStopWait, s))
+				time.Sleep(preStopWait)
+				level.Info(logger).Log("msg", "terminating...")
+
+				return fmt.Errorf("signal received: %s", s)
+			}
 		}
 	})
 
@@ -157,6 +491,40 @@ func gracefulMain() exitCode {
 		return nil
 	})
 
+	group.Go(func() error {
+		return healthChecker.Run(ctx)
+	})
+
+	group.Go(func() error {
+		return registry.Run(ctx)
+	})
+
+	if cfg.Scrub.Interval > 0 {
+		group.Go(func() error {
+			return scrubber.Run(ctx)
+		})
+	}
+
+	if cfg.Rebalance.Interval > 0 {
+		group.Go(func() error {
+			ticker := time.NewTicker(cfg.Rebalance.Interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-ticker.C:
+					if err := rebalancer.Start(ctx); err != nil && !errors.Is(err, domain.ErrRebalanceRunning) {
+						level.Error(logger).Log("msg", "can't start rebalancing",
+							"err", err,
+						)
+					}
+				}
+			}
+		})
+	}
+
 	group.Go(func() error {
 		<-ctx.Done()
 
@@ -166,6 +534,7 @@ func gracefulMain() exitCode {
 		if err = hServer.Shutdown(shutdownCtx); err != nil {
 			return fmt.Errorf("shutdown error: %w", err)
 		}
+		// A rebalancing run is not stopped: with a state file it's resumed after restart, and a move in flight is settled then.
 
 		return ctx.Err()
 	})
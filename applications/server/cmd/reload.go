@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/config"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// liveSettings are applied by reload without a restart. Storages are only added live: removed ones must be drained.
+var liveSettings = map[string]bool{
+	"log.level":                    true,
+	"log.format":                   true,
+	"rebalance.threshold":          true,
+	"rebalance.rate_limit":         true,
+	"scrub.rate_limit":             true,
+	"storages":                     true,
+	"admission.max_uploads":        true,
+	"admission.max_bytes":          true,
+	"admission.client_max_uploads": true,
+	"admission.client_max_bytes":   true,
+	"admission.queue_size":         true,
+	"admission.queue_timeout":      true,
+	"admission.retry_after":        true,
+}
+
+// reloader applies a config read again to the running server.
+type reloader struct {
+	load        func() (config.Server, error)
+	current     config.Server
+	levelLogger *levelLogger
+	registry    server.StorageRegistry
+	rebalancer  server.Rebalancer
+	scrubber    server.Scrubber
+	admission   server.UploadAdmission
+	logger      log.Logger
+}
+
+// reload reads the config again and applies what it can live. A config failing validation is ignored as a whole,
+// and settings only applied on restart are reported.
+func (r *reloader) reload(ctx context.Context) {
+	cfg, err := r.load()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		level.Error(r.logger).Log("msg", "config not reloaded",
+			"err", err,
+		)
+		return
+	}
+
+	changed := config.Changed(r.current, cfg)
+
+	var restartNeeded []string
+	for _, name := range changed {
+		if !liveSettings[name] {
+			restartNeeded = append(restartNeeded, name)
+		}
+	}
+
+	if err = r.levelLogger.SetLevel(cfg.Log.Level); err != nil {
+		level.Error(r.logger).Log("msg", "can't set log level",
+			"err", err,
+		)
+	}
+
+	if err = r.levelLogger.SetFormat(cfg.Log.Format); err != nil {
+		level.Error(r.logger).Log("msg", "can't set log format",
+			"err", err,
+		)
+	}
+
+	r.rebalancer.SetThreshold(cfg.Rebalance.Threshold)
+	r.rebalancer.SetRateLimit(cfg.Rebalance.RateLimit)
+	r.scrubber.SetRateLimit(cfg.Scrub.RateLimit)
+	r.admission.SetLimits(admissionLimits(cfg.Admission))
+
+	// Unapplied settings keep their old values, so they are reported again on the next reload.
+	live := r.current
+	live.Log = cfg.Log
+	live.Rebalance.Threshold = cfg.Rebalance.Threshold
+	live.Rebalance.RateLimit = cfg.Rebalance.RateLimit
+	live.Scrub.RateLimit = cfg.Scrub.RateLimit
+	live.Admission = cfg.Admission
+	live.Storages = r.addStorages(ctx, cfg.Storages)
+	r.current = live
+
+	level.Info(r.logger).Log("msg", "config reloaded",
+		"changed", len(changed)-len(restartNeeded),
+	)
+
+	if len(restartNeeded) > 0 {
+		level.Warn(r.logger).Log("msg", "changed settings are applied on restart",
+			"settings", restartNeeded,
+		)
+	}
+}
+
+// addStorages registers storages new to the config and returns the storages list as applied. Storages left out
+// of the config stay registered until drained.
+func (r *reloader) addStorages(ctx context.Context, storages []config.Storage) []config.Storage {
+	known := make(map[string]config.Storage, len(r.current.Storages))
+	for _, storage := range r.current.Storages {
+		known[storage.URL] = storage
+	}
+
+	applied := make([]config.Storage, 0, len(storages))
+	for _, storage := range storages {
+		previous, ok := known[storage.URL]
+		delete(known, storage.URL)
+		if ok {
+			if previous != storage {
+				level.Warn(r.logger).Log("msg", "changed storage settings are not applied, drain and add it again",
+					"storage", storage.URL,
+				)
+			}
+
+			applied = append(applied, previous)
+			continue
+		}
+
+		if _, err := r.registry.Register(ctx, registration(storage)); err != nil {
+			level.Error(r.logger).Log("msg", "can't add storage",
+				"storage", storage.URL,
+				"err", err,
+			)
+			continue
+		}
+
+		level.Info(r.logger).Log("msg", "storage added from config",
+			"storage", storage.URL,
+		)
+		applied = append(applied, storage)
+	}
+
+	for url := range known {
+		level.Warn(r.logger).Log("msg", "storage removed from config stays registered, drain it to remove",
+			"storage", url,
+		)
+	}
+
+	return applied
+}
+
+// admissionLimits are the limits uploads are admitted within.
+func admissionLimits(cfg config.Admission) domain.AdmissionLimits {
+	return domain.AdmissionLimits{
+		MaxUploads:       cfg.MaxUploads,
+		MaxBytes:         cfg.MaxBytes,
+		ClientMaxUploads: cfg.ClientMaxUploads,
+		ClientMaxBytes:   cfg.ClientMaxBytes,
+		QueueSize:        cfg.QueueSize,
+		QueueTimeout:     cfg.QueueTimeout,
+		RetryAfter:       cfg.RetryAfter,
+	}
+}
+
+// registration is how a storage listed in config is registered.
+func registration(storage config.Storage) domain.StorageRegistration {
+	return domain.StorageRegistration{
+		URL:      storage.URL,
+		Type:     storage.Type,
+		Labels:   domain.StorageLabels{Zone: storage.Zone, Rack: storage.Rack, Host: storage.Host},
+		Capacity: storage.Capacity,
+	}
+}
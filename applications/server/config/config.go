@@ -2,23 +2,49 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
 )
 
 // Server contains all configuration settings related to server binary.
 type Server struct {
-	API Api `yaml:"api"`
+	Log          Log          `yaml:"log"`
+	API          Api          `yaml:"api"`
+	Auth         Auth         `yaml:"auth"`
+	Presign      Presign      `yaml:"presign"`
+	Encryption   Encryption   `yaml:"encryption"`
+	Compression  Compression  `yaml:"compression"`
+	Dedup        Dedup        `yaml:"dedup"`
+	Placement    Placement    `yaml:"placement"`
+	Rebalance    Rebalance    `yaml:"rebalance"`
+	Health       Health       `yaml:"health"`
+	Registration Registration `yaml:"registration"`
+	Storages     []Storage    `yaml:"storages"`
+	Metadata     Metadata     `yaml:"metadata"`
+	Split        Split        `yaml:"split"`
+	Upload       Upload       `yaml:"upload"`
+	Admission    Admission    `yaml:"admission"`
+	Download     Download     `yaml:"download"`
+	Cache        Cache        `yaml:"cache"`
+	Scrub        Scrub        `yaml:"scrub"`
+	Tracing      Tracing      `yaml:"tracing"`
 }
 
-// Guide section describe settings for guide host.
-type Guide struct {
-	// Host is an address of guide instance.
-	Host string
-	// Key is a secret key shared between server and guide.
-	Key string
+// Log section describes logging.
+type Log struct {
+	// Level is the least severe level logged: "debug", "info", "warn" or "error".
+	Level string `yaml:"level"`
+	// Format is "json" or "logfmt".
+	Format string `yaml:"format"`
 }
 
 // Api section describes settings for API.
@@ -27,14 +53,416 @@ type Api struct {
 	HTTPAddr string `yaml:"http_addr"`
 }
 
+// Auth section describes settings for API key authentication.
+type Auth struct {
+	// Enabled turns on API key checks for every route.
+	Enabled bool `yaml:"enabled"`
+	// AdminKey is a bootstrap key with admin scope on all buckets, used to create other keys.
+	AdminKey string `yaml:"admin_key" secret:"true"`
+}
+
+// Presign section describes settings for presigned URLs.
+type Presign struct {
+	// Key is an HMAC key presigned URLs are signed with. Presigned URLs are disabled when it's empty.
+	Key string `yaml:"key" secret:"true"`
+	// MaxExpiry is the longest lifetime a presigned URL may be issued with.
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+}
+
+// Encryption section describes settings for encryption of stored parts.
+type Encryption struct {
+	// Enabled turns on encryption of newly uploaded files. Files stored encrypted can only be
+	// read back while encryption stays enabled with the same master key.
+	Enabled bool `yaml:"enabled"`
+	// MasterKey is a base64-encoded 32-byte key data keys are wrapped with.
+	MasterKey string `yaml:"master_key" secret:"true"`
+	// MasterKeyFile is a path to a file with the master key, used when MasterKey is empty.
+	MasterKeyFile string `yaml:"master_key_file"`
+}
+
+// Compression section describes settings for compression of stored parts.
+type Compression struct {
+	// Codec is "gzip" or "zstd"; parts are stored uncompressed when it's empty.
+	Codec string `yaml:"codec"`
+	// SkipContentTypes lists content types that are never compressed, e.g. "image/*" or "application/zip".
+	// A built-in list of already compressed types is used when it's empty.
+	SkipContentTypes []string `yaml:"skip_content_types"`
+}
+
+// Dedup section describes settings for content-addressed deduplication of parts.
+type Dedup struct {
+	// Enabled stores parts under their content hash so identical parts are kept once.
+	// It can't be combined with encryption.
+	Enabled bool `yaml:"enabled"`
+	// Chunking is "fixed" to cut parts of the same size, or "cdc" for content-defined chunking.
+	Chunking string `yaml:"chunking"`
+	// ChunkSize is a part size in bytes with fixed chunking.
+	ChunkSize int `yaml:"chunk_size"`
+	// AvgChunkSize is an average part size in bytes with content-defined chunking.
+	AvgChunkSize int `yaml:"avg_chunk_size"`
+}
+
+// Placement section describes how storages for new parts are chosen.
+type Placement struct {
+	// Policy is one of "most_free", "weighted_random", "rendezvous" or "round_robin".
+	Policy string `yaml:"policy"`
+	// Replicas is how many copies of every part are kept, each in a different zone.
+	Replicas int `yaml:"replicas"`
+}
+
+// Rebalance section describes moving parts from full storages to empty ones.
+type Rebalance struct {
+	// Threshold is a difference in free space of storages, in bytes, rebalancing stops at.
+	Threshold int64 `yaml:"threshold"`
+	// RateLimit caps how many bytes per second are copied between storages; zero means no limit.
+	RateLimit int64 `yaml:"rate_limit"`
+	// Interval starts a run periodically; runs are only started through the admin API when it's zero.
+	Interval time.Duration `yaml:"interval"`
+	// StateFile is a path progress of a run is persisted to, so a run interrupted by a restart is resumed;
+	// it's forgotten on restart when it's empty.
+	StateFile string `yaml:"state_file"`
+}
+
+// Health section describes probing of storages.
+type Health struct {
+	// Interval is how often every storage is probed.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long a probe may take before it counts as failed.
+	Timeout time.Duration `yaml:"timeout"`
+	// SlowPing marks storages answering slower than that as degraded.
+	SlowPing time.Duration `yaml:"slow_ping"`
+	// DownAfter is how many probes in a row must fail for a storage to be marked down.
+	DownAfter int `yaml:"down_after"`
+	// MinStorages is how many healthy storages must take new parts for the server to be ready;
+	// placement.replicas when it's zero.
+	MinStorages int `yaml:"min_storages"`
+}
+
+// Registration section describes the registry of storages and self-registration of storage nodes.
+type Registration struct {
+	// Key is a secret key shared between server and storage nodes. Nodes can't register themselves when it's empty.
+	Key string `yaml:"key" secret:"true"`
+	// File is a path registered storages are persisted to; they are forgotten on restart when it's empty.
+	File string `yaml:"file"`
+	// HeartbeatTimeout is how long a self-registered node may stay silent before it's marked down.
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+}
+
+// Storage describes a storage registered at startup. A storage already in the registry keeps its registered settings.
+type Storage struct {
+	// Type is "memory" or "http".
+	Type string `yaml:"type"`
+	// URL is a name of a memory storage, or a base URL of a storage node.
+	URL string `yaml:"url"`
+	// Capacity is a size of a memory storage in bytes; 100 MB when it's zero. Storage nodes report their own.
+	Capacity int64 `yaml:"capacity"`
+	// Zone, Rack and Host place the storage in failure domains.
+	Zone string `yaml:"zone"`
+	Rack string `yaml:"rack"`
+	Host string `yaml:"host"`
+}
+
+// Metadata section describes where file metadata is kept.
+type Metadata struct {
+	// Backend is "memory", the only backend so far; metadata is lost on restart.
+	Backend string `yaml:"backend"`
+}
+
+// Split section describes how files are split into parts.
+type Split struct {
+	// Parts is how many parts a file is split into at most.
+	Parts int `yaml:"parts"`
+	// MinPartSize is a size in bytes no part but the last one is smaller than, so small files get fewer parts.
+	MinPartSize int64 `yaml:"min_part_size"`
+}
+
+// Upload section describes how parts of a file are uploaded.
+type Upload struct {
+	// Concurrency is how many parts of a file are uploaded at once; parts are uploaded one after another when it's 1.
+	Concurrency int `yaml:"concurrency"`
+	// MemoryBudget caps bytes of parts read ahead of their upload, across all uploads. Parts bigger than that are
+	// streamed one after another.
+	MemoryBudget int64 `yaml:"memory_budget"`
+}
+
+// Admission section describes limits on uploads in progress, so a burst of them can't exhaust memory. Uploads over
+// the limits wait for room, and are turned away with 503 when too many wait or they wait too long. Zero limits
+// mean no limit.
+type Admission struct {
+	// MaxUploads caps uploads in progress.
+	MaxUploads int `yaml:"max_uploads"`
+	// MaxBytes caps declared sizes of uploads in progress, in bytes. A bigger upload is admitted once no other runs.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// ClientMaxUploads and ClientMaxBytes are the same limits for every client: an API key, or an address when
+	// the upload isn't authenticated with a key.
+	ClientMaxUploads int   `yaml:"client_max_uploads"`
+	ClientMaxBytes   int64 `yaml:"client_max_bytes"`
+	// QueueSize is how many uploads may wait for room; uploads over the limits are turned away at once when it's zero.
+	QueueSize int `yaml:"queue_size"`
+	// QueueTimeout is how long an upload waits for room before it's turned away.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// RetryAfter is how long clients turned away are told to wait before trying again.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// Download section describes how parts of a file are read.
+type Download struct {
+	// Prefetch is how many parts are read ahead of the one a download streams; parts are read as they are reached
+	// when it's zero.
+	Prefetch int `yaml:"prefetch"`
+	// MemoryBudget caps bytes of parts read ahead, across all downloads. Parts there's no room for are read when
+	// they are reached.
+	MemoryBudget int64 `yaml:"memory_budget"`
+}
+
+// Cache section describes caching parts read often in front of storages.
+type Cache struct {
+	// MemorySize is how many bytes of parts are kept in memory; parts aren't cached when it's zero.
+	MemorySize int64 `yaml:"memory_size"`
+	// MaxPartSize is a size in bytes of the biggest part cached; bigger parts are always read from storages.
+	MaxPartSize int64 `yaml:"max_part_size"`
+	// DiskDir is a directory parts evicted from memory are kept in; there's no disk tier when it's empty.
+	// Files left there by an earlier run are removed at startup.
+	DiskDir string `yaml:"disk_dir"`
+	// DiskSize is how many bytes of parts are kept in DiskDir.
+	DiskSize int64 `yaml:"disk_size"`
+}
+
+// Default returns settings used for everything the config file, environment and flags leave unset.
+func Default() Server {
+	return Server{
+		Log:       Log{Level: "info", Format: "json"},
+		API:       Api{HTTPAddr: "0.0.0.0:8002"},
+		Presign:   Presign{MaxExpiry: time.Hour},
+		Dedup:     Dedup{Chunking: "fixed", ChunkSize: 1024 * 1024, AvgChunkSize: 1024 * 1024},
+		Placement: Placement{Policy: "most_free", Replicas: 1},
+		Rebalance: Rebalance{Threshold: 16 * 1024 * 1024},
+		Health: Health{
+			Interval:  10 * time.Second,
+			Timeout:   2 * time.Second,
+			SlowPing:  500 * time.Millisecond,
+			DownAfter: 3,
+		},
+		Registration: Registration{HeartbeatTimeout: 30 * time.Second},
+		Metadata:     Metadata{Backend: "memory"},
+		Split:        Split{Parts: 5, MinPartSize: 10 * 1024},
+		Upload:       Upload{Concurrency: 1, MemoryBudget: 64 * 1024 * 1024},
+		Admission: Admission{
+			MaxUploads:   64,
+			MaxBytes:     1024 * 1024 * 1024,
+			QueueSize:    128,
+			QueueTimeout: 30 * time.Second,
+			RetryAfter:   5 * time.Second,
+		},
+		Download: Download{MemoryBudget: 64 * 1024 * 1024},
+		Cache:    Cache{MaxPartSize: 8 * 1024 * 1024},
+		Scrub:    Scrub{Interval: 24 * time.Hour, RateLimit: 10 * 1024 * 1024},
+		Tracing:  Tracing{SampleRatio: 1},
+	}
+}
+
+// Scrub section describes background verification of stored parts.
+type Scrub struct {
+	// Interval is how often every stored part is read back; scrubs are only started through the admin API when it's zero.
+	Interval time.Duration `yaml:"interval"`
+	// RateLimit caps how many bytes per second are read from storages; zero means no limit.
+	RateLimit int64 `yaml:"rate_limit"`
+}
+
+// Tracing section describes exporting of OpenTelemetry traces.
+type Tracing struct {
+	// Exporter is "stdout" or "otlp"; requests are not traced when it's empty.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is a host:port of an OTLP/HTTP collector, e.g. "localhost:4318".
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans to the collector over plain HTTP.
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is a share of requests traced, from 0 to 1. Requests the caller traces are always traced.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
 // Validate validates some configuration settings to catch configuration errors early.
 func (cfg *Server) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch cfg.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		addProblem("unknown log.level %q, expected \"debug\", \"info\", \"warn\" or \"error\"", cfg.Log.Level)
+	}
+
+	switch cfg.Log.Format {
+	case "json", "logfmt":
+	default:
+		addProblem("unknown log.format %q, expected \"json\" or \"logfmt\"", cfg.Log.Format)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.API.HTTPAddr); err != nil {
+		addProblem("api.http_addr %q is not a host:port address", cfg.API.HTTPAddr)
+	}
+
+	if cfg.Presign.MaxExpiry < 0 {
+		addProblem("presign.max_expiry must not be negative")
+	}
+	if cfg.Presign.Key != "" && cfg.Presign.MaxExpiry == 0 {
+		addProblem("presign.max_expiry must be set along with presign.key")
+	}
+
+	if cfg.Encryption.Enabled && cfg.Encryption.MasterKey == "" && cfg.Encryption.MasterKeyFile == "" {
+		addProblem("encryption.master_key or encryption.master_key_file must be set when encryption is enabled")
+	}
+
+	switch cfg.Compression.Codec {
+	case domain.CodecNone, domain.CodecGzip, domain.CodecZstd:
+	default:
+		addProblem("unknown compression.codec %q, expected %q or %q", cfg.Compression.Codec, domain.CodecGzip, domain.CodecZstd)
+	}
+
+	if cfg.Dedup.Enabled {
+		if cfg.Encryption.Enabled {
+			addProblem("dedup can't be combined with encryption: per-file keys make identical parts differ")
+		}
+
+		switch cfg.Dedup.Chunking {
+		case "fixed":
+			if cfg.Dedup.ChunkSize <= 0 {
+				addProblem("dedup.chunk_size must be positive, got %d", cfg.Dedup.ChunkSize)
+			}
+		case "cdc":
+		default:
+			addProblem("unknown dedup.chunking %q, expected \"fixed\" or \"cdc\"", cfg.Dedup.Chunking)
+		}
+	}
+
+	if _, err := placement.New(cfg.Placement.Policy); err != nil {
+		addProblem("placement.policy: %v", err)
+	}
+	if cfg.Placement.Replicas < 1 {
+		addProblem("placement.replicas must be at least 1, got %d", cfg.Placement.Replicas)
+	}
+
+	if cfg.Rebalance.Threshold <= 0 {
+		addProblem("rebalance.threshold must be positive, got %d", cfg.Rebalance.Threshold)
+	}
+
+	if cfg.Rebalance.RateLimit < 0 || cfg.Rebalance.Interval < 0 {
+		addProblem("rebalance.rate_limit and rebalance.interval must not be negative")
+	}
+
+	if cfg.Health.Interval < 0 || cfg.Health.Timeout < 0 || cfg.Health.SlowPing < 0 || cfg.Health.DownAfter < 0 ||
+		cfg.Health.MinStorages < 0 {
+		addProblem("health.interval, health.timeout, health.slow_ping, health.down_after and health.min_storages " +
+			"must not be negative")
+	}
+
+	if cfg.Scrub.Interval < 0 || cfg.Scrub.RateLimit < 0 {
+		addProblem("scrub.interval and scrub.rate_limit must not be negative")
+	}
+
+	if cfg.Registration.HeartbeatTimeout < 0 {
+		addProblem("registration.heartbeat_timeout must not be negative")
+	}
+
+	urls := make(map[string]bool, len(cfg.Storages))
+	for i, storage := range cfg.Storages {
+		if storage.URL == "" {
+			addProblem("storages[%d].url is empty", i)
+		} else if urls[storage.URL] {
+			addProblem("storages[%d].url %q is listed twice", i, storage.URL)
+		}
+		urls[storage.URL] = true
+
+		switch storage.Type {
+		case domain.StorageTypeMemory:
+		case domain.StorageTypeHTTP:
+			if u, err := url.Parse(storage.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				addProblem("storages[%d].url %q is not an http(s) URL", i, storage.URL)
+			}
+			if storage.Capacity != 0 {
+				addProblem("storages[%d].capacity is only set for memory storages", i)
+			}
+		default:
+			addProblem("storages[%d].type %q is unknown, expected %q or %q", i, storage.Type,
+				domain.StorageTypeMemory, domain.StorageTypeHTTP)
+		}
+
+		if storage.Capacity < 0 {
+			addProblem("storages[%d].capacity must not be negative", i)
+		}
+	}
+
+	if cfg.Metadata.Backend != "memory" {
+		addProblem("unknown metadata.backend %q, only \"memory\" is supported", cfg.Metadata.Backend)
+	}
+
+	if cfg.Split.Parts < 1 {
+		addProblem("split.parts must be at least 1, got %d", cfg.Split.Parts)
+	}
+	if cfg.Split.MinPartSize < 1 {
+		addProblem("split.min_part_size must be at least 1 byte, got %d", cfg.Split.MinPartSize)
+	}
+
+	if cfg.Upload.Concurrency < 1 {
+		addProblem("upload.concurrency must be at least 1, got %d", cfg.Upload.Concurrency)
+	}
+	if cfg.Upload.Concurrency > 1 && cfg.Upload.MemoryBudget < 1 {
+		addProblem("upload.memory_budget must be at least 1 byte for parallel uploads, got %d", cfg.Upload.MemoryBudget)
+	}
+
+	if cfg.Admission.MaxUploads < 0 || cfg.Admission.MaxBytes < 0 || cfg.Admission.ClientMaxUploads < 0 ||
+		cfg.Admission.ClientMaxBytes < 0 || cfg.Admission.QueueSize < 0 {
+		addProblem("admission limits and admission.queue_size must not be negative")
+	}
+	if cfg.Admission.QueueSize > 0 && cfg.Admission.QueueTimeout <= 0 {
+		addProblem("admission.queue_timeout must be positive for uploads to wait, got %v", cfg.Admission.QueueTimeout)
+	}
+	if cfg.Admission.RetryAfter < 0 {
+		addProblem("admission.retry_after must not be negative")
+	}
+
+	if cfg.Download.Prefetch < 0 {
+		addProblem("download.prefetch must not be negative, got %d", cfg.Download.Prefetch)
+	}
+	if cfg.Download.Prefetch > 0 && cfg.Download.MemoryBudget < 1 {
+		addProblem("download.memory_budget must be at least 1 byte for prefetching, got %d", cfg.Download.MemoryBudget)
+	}
+
+	if cfg.Cache.MemorySize < 0 || cfg.Cache.MaxPartSize < 0 || cfg.Cache.DiskSize < 0 {
+		addProblem("cache sizes must not be negative")
+	}
+	if cfg.Cache.DiskDir != "" && cfg.Cache.MemorySize == 0 {
+		addProblem("cache.disk_dir needs cache.memory_size, as parts reach disk on eviction from memory")
+	}
+	if cfg.Cache.DiskDir != "" && cfg.Cache.DiskSize == 0 {
+		addProblem("cache.disk_size must be set with cache.disk_dir")
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if cfg.Tracing.Endpoint == "" {
+			addProblem("tracing.endpoint must be set for the \"otlp\" exporter")
+		}
+	default:
+		addProblem("unknown tracing.exporter %q, expected \"stdout\" or \"otlp\"", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		addProblem("tracing.sample_ratio must be from 0 to 1, got %v", cfg.Tracing.SampleRatio)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
 	return nil
 }
 
-// Parse YAML configuration file.
+// Parse YAML configuration file. Settings missing in the file keep their defaults.
 func Parse(filePath string) (Server, error) {
-	c := Server{}
+	c := Default()
 
 	f, err := os.Open(filepath.Clean(filePath))
 	if err != nil {
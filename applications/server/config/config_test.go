@@ -1,14 +1,46 @@
 package config
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseConfig(t *testing.T) {
 	want := Server{
-		API: Api{HTTPAddr: "0.0.0.0:8002"},
+		Log:       Log{Level: "info", Format: "json"},
+		API:       Api{HTTPAddr: "0.0.0.0:8002"},
+		Presign:   Presign{MaxExpiry: time.Hour},
+		Dedup:     Dedup{Chunking: "fixed", ChunkSize: 1048576, AvgChunkSize: 1048576},
+		Placement: Placement{Policy: "most_free", Replicas: 1},
+		Rebalance: Rebalance{Threshold: 16777216},
+		Health: Health{
+			Interval:  10 * time.Second,
+			Timeout:   2 * time.Second,
+			SlowPing:  500 * time.Millisecond,
+			DownAfter: 3,
+		},
+		Registration: Registration{HeartbeatTimeout: 30 * time.Second},
+		Metadata:     Metadata{Backend: "memory"},
+		Split:        Split{Parts: 5, MinPartSize: 10240},
+		Upload:       Upload{Concurrency: 1, MemoryBudget: 67108864},
+		Admission: Admission{
+			MaxUploads:   64,
+			MaxBytes:     1073741824,
+			QueueSize:    128,
+			QueueTimeout: 30 * time.Second,
+			RetryAfter:   5 * time.Second,
+		},
+		Download: Download{MemoryBudget: 67108864},
+		Cache:    Cache{MaxPartSize: 8388608},
+		Scrub:    Scrub{Interval: 24 * time.Hour, RateLimit: 10485760},
+		Tracing:  Tracing{SampleRatio: 1},
+	}
+	for i := 0; i < 7; i++ {
+		want.Storages = append(want.Storages, Storage{Type: "memory", URL: fmt.Sprintf("storage_%d", i), Capacity: 104857600})
 	}
 
 	got, err := Parse("config.yml")
@@ -17,3 +49,119 @@ func TestParseConfig(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, want, got)
 }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Server)
+		want   string
+	}{
+		{
+			name:   "bad address",
+			modify: func(cfg *Server) { cfg.API.HTTPAddr = "8002" },
+			want:   `api.http_addr "8002" is not a host:port address`,
+		},
+		{
+			name:   "unknown codec",
+			modify: func(cfg *Server) { cfg.Compression.Codec = "lz4" },
+			want:   `unknown compression.codec "lz4"`,
+		},
+		{
+			name: "dedup with encryption",
+			modify: func(cfg *Server) {
+				cfg.Dedup.Enabled = true
+				cfg.Encryption = Encryption{Enabled: true, MasterKey: "key"}
+			},
+			want: "dedup can't be combined with encryption",
+		},
+		{
+			name: "dedup without chunk size",
+			modify: func(cfg *Server) {
+				cfg.Dedup.Enabled = true
+				cfg.Dedup.ChunkSize = 0
+			},
+			want: "dedup.chunk_size must be positive, got 0",
+		},
+		{
+			name:   "encryption without key",
+			modify: func(cfg *Server) { cfg.Encryption.Enabled = true },
+			want:   "encryption.master_key or encryption.master_key_file must be set",
+		},
+		{
+			name:   "unknown policy",
+			modify: func(cfg *Server) { cfg.Placement.Policy = "random" },
+			want:   `placement.policy: unknown placement policy "random"`,
+		},
+		{
+			name:   "no replicas",
+			modify: func(cfg *Server) { cfg.Placement.Replicas = 0 },
+			want:   "placement.replicas must be at least 1, got 0",
+		},
+		{
+			name:   "no rebalance threshold",
+			modify: func(cfg *Server) { cfg.Rebalance.Threshold = 0 },
+			want:   "rebalance.threshold must be positive, got 0",
+		},
+		{
+			name:   "duplicate storage",
+			modify: func(cfg *Server) { cfg.Storages[1].URL = "storage_0" },
+			want:   `storages[1].url "storage_0" is listed twice`,
+		},
+		{
+			name:   "unknown storage type",
+			modify: func(cfg *Server) { cfg.Storages[2].Type = "tape" },
+			want:   `storages[2].type "tape" is unknown`,
+		},
+		{
+			name:   "node without scheme",
+			modify: func(cfg *Server) { cfg.Storages = []Storage{{Type: "http", URL: "node-1:9000"}} },
+			want:   `storages[0].url "node-1:9000" is not an http(s) URL`,
+		},
+		{
+			name:   "otlp without endpoint",
+			modify: func(cfg *Server) { cfg.Tracing.Exporter = "otlp" },
+			want:   `tracing.endpoint must be set for the "otlp" exporter`,
+		},
+		{
+			name:   "unknown metadata backend",
+			modify: func(cfg *Server) { cfg.Metadata.Backend = "postgres" },
+			want:   `unknown metadata.backend "postgres"`,
+		},
+		{
+			name: "parallel uploads without memory",
+			modify: func(cfg *Server) {
+				cfg.Upload.Concurrency = 4
+				cfg.Upload.MemoryBudget = 0
+			},
+			want: "upload.memory_budget must be at least 1 byte for parallel uploads, got 0",
+		},
+		{
+			name:   "cache disk without size",
+			modify: func(cfg *Server) { cfg.Cache = Cache{MemorySize: 1024, DiskDir: "/var/cache/karma8"} },
+			want:   "cache.disk_size must be set with cache.disk_dir",
+		},
+		{
+			name:   "admission queue without timeout",
+			modify: func(cfg *Server) { cfg.Admission.QueueTimeout = 0 },
+			want:   "admission.queue_timeout must be positive for uploads to wait",
+		},
+		{
+			name:   "no parts",
+			modify: func(cfg *Server) { cfg.Split.Parts = 0 },
+			want:   "split.parts must be at least 1, got 0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse("config.yml")
+			require.NoError(t, err)
+
+			tt.modify(&cfg)
+
+			err = cfg.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts names of environment variables overriding settings, e.g. KARMA8_API_HTTP_ADDR.
+const envPrefix = "KARMA8_"
+
+// redacted replaces secrets in a printed config.
+const redacted = "<redacted>"
+
+// setting is a single config value, named by the path of YAML keys leading to it.
+type setting struct {
+	path   []string
+	value  reflect.Value
+	secret bool
+}
+
+// flagName is e.g. api.http_addr.
+func (s setting) flagName() string {
+	return strings.Join(s.path, ".")
+}
+
+// envName is e.g. KARMA8_API_HTTP_ADDR.
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(strings.Join(s.path, "_"))
+}
+
+// set parses raw as the setting's value. Strings are taken as they are, everything else is YAML,
+// e.g. "10s" for durations or "[image/*, video/*]" for lists.
+func (s setting) set(raw string) error {
+	if s.value.Kind() == reflect.String {
+		s.value.SetString(raw)
+		return nil
+	}
+
+	parsed := reflect.New(s.value.Type())
+	if err := yaml.UnmarshalStrict([]byte(raw), parsed.Interface()); err != nil {
+		return fmt.Errorf("can't parse %q: %w", raw, err)
+	}
+	s.value.Set(parsed.Elem())
+
+	return nil
+}
+
+// settings lists every value of cfg, descending into sections.
+func settings(cfg *Server) []setting {
+	var result []setting
+
+	var walk func(v reflect.Value, path []string)
+	walk = func(v reflect.Value, path []string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+
+			fieldPath := append(append([]string(nil), path...), name)
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), fieldPath)
+				continue
+			}
+
+			result = append(result, setting{
+				path:   fieldPath,
+				value:  v.Field(i),
+				secret: field.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), nil)
+
+	return result
+}
+
+// Flags are settings given on the command line.
+type Flags struct {
+	values map[string]string
+}
+
+type flagValue struct {
+	name   string
+	values map[string]string
+}
+
+func (f flagValue) String() string {
+	return ""
+}
+
+func (f flagValue) Set(raw string) error {
+	f.values[f.name] = raw
+	return nil
+}
+
+// RegisterFlags adds a flag to fs for every setting, named by its YAML path, e.g. -api.http_addr.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	flags := &Flags{values: map[string]string{}}
+
+	for _, s := range settings(&Server{}) {
+		fs.Var(flagValue{name: s.flagName(), values: flags.values}, s.flagName(),
+			fmt.Sprintf("overrides %s of the config file and %s", s.flagName(), s.envName()))
+	}
+
+	return flags
+}
+
+// Load builds the effective config. Defaults are overridden by the YAML file at filePath unless it's empty,
+// then by environment variables found with lookupEnv, then by flags.
+func Load(filePath string, lookupEnv func(key string) (string, bool), flags *Flags) (Server, error) {
+	cfg := Default()
+	if filePath != "" {
+		var err error
+		if cfg, err = Parse(filePath); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range settings(&cfg) {
+		raw, ok := lookupEnv(s.envName())
+		if !ok {
+			continue
+		}
+
+		if err := s.set(raw); err != nil {
+			return cfg, fmt.Errorf("can't apply %s: %w", s.envName(), err)
+		}
+	}
+
+	if flags == nil {
+		return cfg, nil
+	}
+
+	for _, s := range settings(&cfg) {
+		raw, ok := flags.values[s.flagName()]
+		if !ok {
+			continue
+		}
+
+		if err := s.set(raw); err != nil {
+			return cfg, fmt.Errorf("can't apply -%s: %w", s.flagName(), err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Redacted returns a copy of the config with secrets, tagged secret:"true", replaced so it can be printed.
+func (cfg Server) Redacted() Server {
+	for _, s := range settings(&cfg) {
+		if s.secret && s.value.String() != "" {
+			s.value.SetString(redacted)
+		}
+	}
+
+	return cfg
+}
+
+// Marshal encodes the config as YAML the way it's written in a config file, with durations as e.g. "1m30s"
+// rather than nanoseconds.
+func (cfg Server) Marshal() ([]byte, error) {
+	return yaml.Marshal(printable(reflect.ValueOf(cfg)))
+}
+
+// duration is written to YAML as a string time.ParseDuration reads back.
+type duration time.Duration
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// printable copies v into values YAML encodes as a config file is written: sections keep the order of their fields,
+// and durations are strings.
+func printable(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return duration(v.Int())
+	case v.Kind() == reflect.Struct:
+		var result yaml.MapSlice
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+
+			result = append(result, yaml.MapItem{Key: name, Value: printable(v.Field(i))})
+		}
+
+		return result
+	case v.Kind() == reflect.Slice && !v.IsNil():
+		result := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			result = append(result, printable(v.Index(i)))
+		}
+
+		return result
+	default:
+		return v.Interface()
+	}
+}
+
+// Changed lists settings differing between old and new by their YAML paths, e.g. "api.http_addr".
+func Changed(old, new Server) []string {
+	oldSettings, newSettings := settings(&old), settings(&new)
+
+	var result []string
+	for i := range oldSettings {
+		if !reflect.DeepEqual(oldSettings[i].value.Interface(), newSettings[i].value.Interface()) {
+			result = append(result, oldSettings[i].flagName())
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	env := map[string]string{
+		"KARMA8_API_HTTP_ADDR":                   "0.0.0.0:9000",
+		"KARMA8_HEALTH_INTERVAL":                 "1m",
+		"KARMA8_AUTH_ENABLED":                    "true",
+		"KARMA8_COMPRESSION_SKIP_CONTENT_TYPES":  "[image/*, video/*]",
+		"KARMA8_STORAGES":                        "[{type: http, url: 'http://node-1:9000', zone: a}]",
+		"KARMA8_REGISTRATION_KEY":                "from env",
+		"KARMA8_REGISTRATION_HEARTBEAT_TIMEOUT":  "1m",
+		"KARMA8_REBALANCE_RATE_LIMIT":            "1048576",
+		"KARMA8_PLACEMENT_REPLICAS_IGNORED_TYPO": "3",
+		"UNRELATED":                              "1",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-api.http_addr", "127.0.0.1:8080", "-split.parts=3"}))
+
+	cfg, err := Load("config.yml", lookupEnv, flags)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	// Flags win over env, env wins over the file, the file wins over defaults.
+	assert.Equal(t, "127.0.0.1:8080", cfg.API.HTTPAddr)
+	assert.Equal(t, 3, cfg.Split.Parts)
+	assert.Equal(t, time.Minute, cfg.Health.Interval)
+	assert.True(t, cfg.Auth.Enabled)
+	assert.Equal(t, []string{"image/*", "video/*"}, cfg.Compression.SkipContentTypes)
+	assert.Equal(t, []Storage{{Type: "http", URL: "http://node-1:9000", Zone: "a"}}, cfg.Storages)
+	assert.Equal(t, "from env", cfg.Registration.Key)
+	assert.Equal(t, int64(1048576), cfg.Rebalance.RateLimit)
+	assert.Equal(t, 2*time.Second, cfg.Health.Timeout)
+	assert.Equal(t, 1, cfg.Placement.Replicas)
+
+	withoutFile, err := Load("", lookupEnv, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:9000", withoutFile.API.HTTPAddr)
+	assert.Equal(t, 5, withoutFile.Split.Parts)
+
+	env["KARMA8_HEALTH_DOWN_AFTER"] = "three"
+	_, err = Load("config.yml", lookupEnv, flags)
+	assert.ErrorContains(t, err, "KARMA8_HEALTH_DOWN_AFTER")
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.AdminKey = "admin"
+	cfg.Presign.Key = "presign"
+	cfg.Encryption.MasterKey = "master"
+
+	got := cfg.Redacted()
+	assert.Equal(t, redacted, got.Auth.AdminKey)
+	assert.Equal(t, redacted, got.Presign.Key)
+	assert.Equal(t, redacted, got.Encryption.MasterKey)
+	assert.Empty(t, got.Registration.Key)
+	assert.Equal(t, cfg.API, got.API)
+
+	// The original config keeps its secrets.
+	assert.Equal(t, "admin", cfg.Auth.AdminKey)
+}
+
+func TestMarshal(t *testing.T) {
+	cfg, err := Parse("config.yml")
+	require.NoError(t, err)
+
+	out, err := cfg.Marshal()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "health:\n  interval: 10s\n  timeout: 2s\n  slow_ping: 500ms\n")
+	assert.Contains(t, string(out), "  max_expiry: 1h0m0s\n")
+
+	// What is printed reads back as the same config.
+	var got Server
+	require.NoError(t, yaml.UnmarshalStrict(out, &got))
+	assert.Equal(t, cfg.Health, got.Health)
+	assert.Equal(t, cfg.Presign, got.Presign)
+	assert.Equal(t, cfg.Admission, got.Admission)
+	assert.Equal(t, cfg.Storages, got.Storages)
+}
+
+func TestChanged(t *testing.T) {
+	old := Default()
+	assert.Empty(t, Changed(old, Default()))
+
+	changed := Default()
+	changed.Log.Level = "debug"
+	changed.Rebalance.RateLimit = 1024
+	changed.Storages = []Storage{{Type: "memory", URL: "storage_0"}}
+	assert.Equal(t, []string{"log.level", "rebalance.rate_limit", "storages"}, Changed(old, changed))
+}
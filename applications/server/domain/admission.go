@@ -0,0 +1,48 @@
+package domain
+
+import "time"
+
+// AdmissionStats are counts of uploads admitted and turned away since the server started, and of uploads
+// in progress and waiting right now.
+type AdmissionStats struct {
+	// Uploads are uploads admitted and still in progress, and Bytes their declared sizes.
+	Uploads int
+	Bytes   int64
+	// Queued are uploads waiting for room.
+	Queued   int
+	Admitted uint64
+	// QueueFull are uploads turned away as too many were waiting already, and TimedOut those that waited too long.
+	QueueFull uint64
+	TimedOut  uint64
+}
+
+// AdmissionLimits bound uploads in progress overall and per client. Zero limits mean no limit.
+type AdmissionLimits struct {
+	MaxUploads       int
+	MaxBytes         int64
+	ClientMaxUploads int
+	ClientMaxBytes   int64
+	// QueueSize uploads over the limits wait for room for up to QueueTimeout; the rest are told to retry after
+	// RetryAfter.
+	QueueSize    int
+	QueueTimeout time.Duration
+	RetryAfter   time.Duration
+}
+
+// ErrOverloaded is returned when the server turns work away to keep itself from running out of resources.
+var ErrOverloaded = newKindError(ErrUnavailable, "server is overloaded")
+
+// OverloadError tells why work was turned away and when it's worth trying again; errors.Is matches it as ErrOverloaded.
+type OverloadError struct {
+	Reason string
+	// RetryAfter is how long clients should wait before trying again.
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return ErrOverloaded.Error() + ": " + e.Reason
+}
+
+func (e *OverloadError) Unwrap() error {
+	return ErrOverloaded
+}
@@ -0,0 +1,68 @@
+package domain
+
+import "time"
+
+var (
+	// ErrKeyNotFound is returned for API keys never issued, or revoked.
+	ErrKeyNotFound = newKindError(ErrNotFound, "key not found")
+	// ErrKeyExists is returned when a key is stored under an ID already taken.
+	ErrKeyExists = newKindError(ErrConflict, "key already exists")
+)
+
+// DefaultBucket is a bucket files belong to when a request doesn't name one.
+const DefaultBucket = "default"
+
+// AnyBucket is a wildcard bucket name granting access to every bucket.
+const AnyBucket = "*"
+
+// Scope is a kind of access an API key may be granted.
+type Scope string
+
+// Supported scopes.
+const (
+	ScopeRead   Scope = "read"
+	ScopeWrite  Scope = "write"
+	ScopeDelete Scope = "delete"
+	ScopeAdmin  Scope = "admin"
+)
+
+// Valid reports whether s is one of the supported scopes.
+func (s Scope) Valid() bool {
+	switch s {
+	case ScopeRead, ScopeWrite, ScopeDelete, ScopeAdmin:
+		return true
+	}
+
+	return false
+}
+
+// Grant gives a set of scopes on a bucket.
+type Grant struct {
+	Bucket string
+	Scopes []Scope
+}
+
+// APIKey describes a key the server accepts. The key itself is never stored, only its hash.
+type APIKey struct {
+	ID        string
+	Hash      string
+	Grants    []Grant
+	CreatedAt time.Time
+}
+
+// Allows reports whether the key has scope on bucket. Admin scope implies every other scope.
+func (k APIKey) Allows(bucket string, scope Scope) bool {
+	for _, g := range k.Grants {
+		if g.Bucket != AnyBucket && g.Bucket != bucket {
+			continue
+		}
+
+		for _, s := range g.Scopes {
+			if s == scope || s == ScopeAdmin {
+				return true
+			}
+		}
+	}
+
+	return false
+}
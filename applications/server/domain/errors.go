@@ -0,0 +1,37 @@
+package domain
+
+import "errors"
+
+// Kinds of failures, telling callers what went wrong whichever component it went wrong in. Components wrap them,
+// e.g. fmt.Errorf("%w: file %s", ErrNotFound, id), and callers check them with errors.Is.
+var (
+	// ErrNotFound is returned for files, parts, keys and storages that don't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNoSpace is returned when storages have no room left for the data.
+	ErrNoSpace = errors.New("not enough free space")
+	// ErrConflict is returned when a request conflicts with the current state, e.g. something already exists or runs.
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable is returned when storages or other dependencies can't serve a request at the moment.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrInvalid is returned for malformed requests.
+	ErrInvalid = errors.New("invalid request")
+)
+
+// kindError is a specific error of a kind; errors.Is matches it both as itself and as the kind.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// newKindError returns a specific error with msg, matching kind.
+func newKindError(kind error, msg string) error {
+	return &kindError{msg: msg, kind: kind}
+}
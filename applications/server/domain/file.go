@@ -1,20 +1,130 @@
 package domain
 
-import "io"
+import (
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrFileNotFound is returned for files never stored, or deleted.
+	ErrFileNotFound = newKindError(ErrNotFound, "file not found")
+	// ErrPartNotFound is returned for parts missing from a storage or from file metadata.
+	ErrPartNotFound = newKindError(ErrNotFound, "part not found")
+	// ErrRangeNotSatisfiable is returned for ranges starting past the end of a file.
+	ErrRangeNotSatisfiable = newKindError(ErrInvalid, "range not satisfiable")
+)
+
+// Codecs parts may be compressed with. Names match HTTP content codings.
+const (
+	CodecNone = ""
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
 
 type FilePart struct {
-	StorageURL    string
+	StorageURL string
+	// Replicas are URLs of other storages keeping a copy of the part under the same path.
+	Replicas      []string
 	Path          string
 	ContentLength int64
+	// Codec is a compression the part is stored with.
+	Codec string
+	// CompressedLength is a size of the part after compression, before encryption.
+	CompressedLength int64
+	// Hash is a content hash of a deduplicated part, which may be shared with other files.
+	// It's empty for parts owned by a single file.
+	Hash string
+	// Checksum is a hex SHA-256 of the part as stored, compressed and encrypted. It's empty for parts stored
+	// before checksums were kept.
+	Checksum string
+}
+
+// Locations returns URLs of every storage keeping the part, the primary one first.
+func (p FilePart) Locations() []string {
+	return append([]string{p.StorageURL}, p.Replicas...)
+}
+
+// StoredChecksum returns a hex SHA-256 the part matches as stored, or "" for parts stored before checksums were kept.
+func (p FilePart) StoredChecksum() string {
+	if p.Checksum != "" {
+		return p.Checksum
+	}
+
+	// Deduplicated parts are stored under the same hash.
+	return p.Hash
+}
+
+// Encryption describes how parts of a file are encrypted. The zero value means they are stored in plaintext.
+type Encryption struct {
+	Algorithm string
+	// WrappedKey is the file's data key encrypted with the master key.
+	WrappedKey []byte
+	// ChunkSize is a size of plaintext sealed at once; parts are streamed chunk by chunk.
+	ChunkSize int
 }
 
 type FileMeta struct {
 	Name          string
+	ContentType   string
 	Parts         []FilePart
 	ContentLength int64
+	Encryption    Encryption
+}
+
+// Codec returns a compression all parts of the file share, or CodecNone if they don't share one.
+func (m FileMeta) Codec() string {
+	if len(m.Parts) == 0 {
+		return CodecNone
+	}
+
+	codec := m.Parts[0].Codec
+	for _, part := range m.Parts[1:] {
+		if part.Codec != codec {
+			return CodecNone
+		}
+	}
+
+	return codec
+}
+
+// CompressedLength returns a size of the file as its parts are compressed.
+func (m FileMeta) CompressedLength() int64 {
+	var total int64
+	for _, part := range m.Parts {
+		total += part.CompressedLength
+	}
+
+	return total
+}
+
+// ByteRange is a span of a file's content.
+type ByteRange struct {
+	// Start is an offset of the first byte. A negative Start asks for the last -Start bytes instead.
+	Start int64
+	// Length is how many bytes are asked for; a negative Length asks for everything up to the end.
+	Length int64
+}
+
+// RangeError tells that a range asked for is past the end of a file; errors.Is matches it as ErrRangeNotSatisfiable.
+type RangeError struct {
+	// Size is a content length of the file.
+	Size int64
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s: file is %d bytes long", ErrRangeNotSatisfiable, e.Size)
+}
+
+func (e *RangeError) Unwrap() error {
+	return ErrRangeNotSatisfiable
 }
 
 type File struct {
 	Meta FileMeta
-	Body io.ReadCloser
+	// ContentEncoding is set when Body is still compressed with that codec.
+	ContentEncoding string
+	// Range is the span of content Body holds when only a part of the file was asked for, with Start and Length
+	// resolved against the file's size.
+	Range *ByteRange
+	Body  io.ReadCloser
 }
@@ -0,0 +1,28 @@
+package domain
+
+import "time"
+
+// PartMove is a copy of a stored part from one storage to another.
+type PartMove struct {
+	Path string
+	From string
+	To   string
+	// Committed is set once file metadata points at To, so only the copy at From is left to delete.
+	Committed bool
+}
+
+// RebalanceStatus is the progress of a rebalancing run. It's kept between restarts, so an interrupted run can be resumed.
+type RebalanceStatus struct {
+	Running     bool
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	MovedParts  int
+	MovedBytes  int64
+	FailedMoves int
+	// Current is a move in flight; it's finished or rolled back on resume.
+	Current   *PartMove
+	LastError string
+}
+
+// ErrRebalanceRunning is returned when a rebalancing run is started while another one is running.
+var ErrRebalanceRunning = newKindError(ErrConflict, "rebalancing is already running")
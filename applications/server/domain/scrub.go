@@ -0,0 +1,34 @@
+package domain
+
+import "time"
+
+// ScrubFinding is a stored copy of a part found damaged or missing.
+type ScrubFinding struct {
+	File       string
+	Path       string
+	StorageURL string
+	Problem    string
+	// Repaired is set once the copy was replaced with an intact copy kept elsewhere.
+	Repaired    bool
+	RepairError string
+	FoundAt     time.Time
+}
+
+// ScrubReport is the progress and findings of the last scrub.
+type ScrubReport struct {
+	Running      bool
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	CheckedParts int
+	CheckedBytes int64
+	// SkippedParts are copies on storages not healthy at the time, left for the next scrub.
+	SkippedParts int
+	Damaged      int
+	Repaired     int
+	// Findings lists damaged copies; it's capped, so it may list fewer than Damaged.
+	Findings  []ScrubFinding
+	LastError string
+}
+
+// ErrScrubRunning is returned when a scrub is started while another one is running.
+var ErrScrubRunning = newKindError(ErrConflict, "scrub is already running")
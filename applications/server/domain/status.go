@@ -0,0 +1,31 @@
+package domain
+
+import "time"
+
+// Readiness tells whether the server may take traffic.
+type Readiness struct {
+	Ready bool
+	// Reasons tell what keeps the server from being ready.
+	Reasons []string
+}
+
+// StorageState is a status of a storage along with what it holds.
+type StorageState struct {
+	StorageStatus
+	FreeSpace int64
+	// FreeSpaceError is set when the storage couldn't tell its free space.
+	FreeSpaceError string
+	// Parts is how many part copies the storage keeps.
+	Parts int
+}
+
+// ServerStatus is a detailed state of the server for operators.
+type ServerStatus struct {
+	Readiness Readiness
+	Version   string
+	StartedAt time.Time
+	// AvailableStorages is how many storages take new parts; MinStorages of them are needed to be ready.
+	AvailableStorages int
+	MinStorages       int
+	Storages          []StorageState
+}
@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrStorageNotFound is returned for a storage URL no storage is registered under.
+	ErrStorageNotFound = newKindError(ErrNotFound, "storage not found")
+	// ErrStorageExists is returned when a storage is added under a URL already taken.
+	ErrStorageExists = newKindError(ErrConflict, "storage already exists")
+	// ErrInvalidNodeKey is returned when a storage node presents a wrong registration key,
+	// or self-registration is disabled.
+	ErrInvalidNodeKey = errors.New("invalid registration key")
+)
+
+// Types of storages, telling how a storage at a URL is reached.
+const (
+	// StorageTypeMemory storages keep parts in memory of the server process; the URL is just a name.
+	StorageTypeMemory = "memory"
+	// StorageTypeHTTP storages are storage nodes serving parts over HTTP at the URL.
+	StorageTypeHTTP = "http"
+)
+
+// StorageRegistration is a storage known to the server, added by an operator or by the storage node itself.
+type StorageRegistration struct {
+	URL    string
+	Type   string
+	Labels StorageLabels
+	// Capacity is a size of a memory storage in bytes, zero meaning the default. Storage nodes report their own free space.
+	Capacity int64
+	// Self is set for storage nodes that registered themselves and must keep sending heartbeats.
+	Self         bool
+	RegisteredAt time.Time
+	// LastHeartbeat is when a self-registered node last reported; it's not persisted.
+	LastHeartbeat time.Time
+}
+
+// StorageLabels place a storage in failure domains.
+type StorageLabels struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+// StorageRef names a storage along with its labels.
+type StorageRef struct {
+	URL    string
+	Labels StorageLabels
+}
+
+// PlannedPart shows where a part of a file would be stored.
+type PlannedPart struct {
+	ContentLength int64
+	// Storages keep copies of the part, the primary one first.
+	Storages []StorageRef
+}
+
+// DrainStatus is the progress of taking a storage out of service.
+type DrainStatus struct {
+	URL      string
+	Draining bool
+	// Removed is set once no part is left on the storage and it's unregistered.
+	Removed        bool
+	RemainingParts int
+	RemainingBytes int64
+}
+
+// StorageHealth tells whether a storage may take new parts.
+type StorageHealth string
+
+const (
+	// HealthHealthy storages answer probes in time.
+	HealthHealthy StorageHealth = "healthy"
+	// HealthDegraded storages answer slowly or failed recently; they take no new parts.
+	HealthDegraded StorageHealth = "degraded"
+	// HealthDown storages failed several probes in a row.
+	HealthDown StorageHealth = "down"
+)
+
+// StorageStatus describes a registered storage for operators.
+type StorageStatus struct {
+	URL      string
+	Labels   StorageLabels
+	Health   StorageHealth
+	Draining bool
+	// CheckedAt is when the storage was last probed; zero if it never was.
+	CheckedAt time.Time
+	LastError string
+}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/mux"
+
+	"github.com/donmikel/karma8/applications/server"
+)
+
+// AdmissionMiddleware holds uploads until admission makes room for them, and turns them away with 503 when it can't.
+// Uploads are admitted before their bodies are read, so uploads turned away take no memory.
+func AdmissionMiddleware(admission server.UploadAdmission, logger log.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := uploadClient(r)
+			release, err := admission.Admit(r.Context(), client, r.ContentLength)
+			if err != nil {
+				writeServiceErr(w, r, logger, "upload not admitted", err,
+					"client", client,
+				)
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// uploadClient names whom an upload counts against: the API key it's authenticated with, or else the address
+// it comes from.
+func uploadClient(r *http.Request) string {
+	if key, ok := apiKeyFromContext(r.Context()); ok {
+		return "key:" + key.ID
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "addr:" + host
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
+	"github.com/donmikel/karma8/applications/server/services"
+)
+
+func TestAdmissionMiddleware(t *testing.T) {
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	require.NoError(t, storageManager.AddStorage(context.Background(), "storage_0",
+		inmemory.NewStorage("storage_0", log.NewNopLogger()), domain.StorageLabels{}))
+	admission := services.NewUploadAdmission(
+		services.WithUploadLimits(1, 0),
+		services.WithAdmissionQueue(0, 0),
+		services.WithRetryAfter(1500*time.Millisecond),
+	)
+	router := NewRouter(services.NewService(inmemory.NewFileMetaStorage(), storageManager), log.NewNopLogger(),
+		WithAdmission(admission))
+
+	put := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/file/name", strings.NewReader("content")))
+		return rec
+	}
+
+	release, err := admission.Admit(context.Background(), "someone else", 0)
+	require.NoError(t, err)
+
+	rec := put()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "overloaded")
+
+	release()
+	assert.Equal(t, http.StatusOK, put().Code)
+
+	// Reads aren't limited.
+	release, err = admission.Admit(context.Background(), "someone else", 0)
+	require.NoError(t, err)
+	defer release()
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file/name", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
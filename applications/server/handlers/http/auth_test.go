@@ -0,0 +1,91 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
+	"github.com/donmikel/karma8/applications/server/services"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	auth := services.NewAuthService(inmemory.NewAPIKeyStorage())
+	_, reader, err := auth.CreateKey(context.Background(), []domain.Grant{
+		{Bucket: "logs", Scopes: []domain.Scope{domain.ScopeRead}},
+	})
+	require.NoError(t, err)
+
+	_, admin, err := auth.CreateKey(context.Background(), []domain.Grant{
+		{Bucket: domain.AnyBucket, Scopes: []domain.Scope{domain.ScopeAdmin}},
+	})
+	require.NoError(t, err)
+
+	router := NewRouter(nil, log.NewNopLogger(), WithAuth(auth))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{name: "no key", method: http.MethodGet, path: "/buckets/logs/file/a", want: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/buckets/logs/file/a", key: "nope", want: http.StatusUnauthorized},
+		{name: "other bucket", method: http.MethodGet, path: "/buckets/images/file/a", key: reader, want: http.StatusForbidden},
+		{name: "default bucket", method: http.MethodGet, path: "/file/a", key: reader, want: http.StatusForbidden},
+		{name: "missing scope", method: http.MethodPut, path: "/buckets/logs/file", key: reader, want: http.StatusForbidden},
+		{name: "admin route", method: http.MethodGet, path: "/admin/keys", key: reader, want: http.StatusForbidden},
+		{name: "admin", method: http.MethodGet, path: "/admin/keys", key: admin, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestRouterWithoutAuth(t *testing.T) {
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	require.NoError(t, storageManager.AddStorage(context.Background(), "storage_0",
+		inmemory.NewStorage("storage_0", log.NewNopLogger()), domain.StorageLabels{}))
+	router := NewRouter(services.NewService(inmemory.NewFileMetaStorage(), storageManager), log.NewNopLogger())
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "create key", method: http.MethodPost, path: "/admin/keys", want: http.StatusNotFound},
+		{name: "list keys", method: http.MethodGet, path: "/admin/keys", want: http.StatusNotFound},
+		{name: "revoke key", method: http.MethodDelete, path: "/admin/keys/id", want: http.StatusNotFound},
+		{name: "other admin route", method: http.MethodGet, path: "/admin/placement?size=1", want: http.StatusOK},
+		{name: "file", method: http.MethodGet, path: "/file/a", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
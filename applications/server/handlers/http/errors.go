@@ -0,0 +1,89 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// errorJSON is the body of every error response.
+type errorJSON struct {
+	// Error is a machine-readable code derived from the status, e.g. "not_found".
+	Error string `json:"error"`
+	// Message describes what went wrong.
+	Message string `json:"message"`
+}
+
+// errorStatus maps an error kind from domain to a status code. Errors of no known kind are internal.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrRangeNotSatisfiable):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, domain.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, domain.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, domain.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, domain.ErrNoSpace):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeServiceErr responds with the status err maps to. Only failures of the server itself are logged as
+// errors, the rest are the client's business. Work turned away under load is logged as a warning, and the client
+// is told when to retry. Clients asking for a range past the end of a file are told its size.
+func writeServiceErr(w http.ResponseWriter, r *http.Request, logger log.Logger, msg string, err error,
+	keyvals ...interface{}) {
+	status := errorStatus(err)
+
+	var (
+		overload *domain.OverloadError
+		rangeErr *domain.RangeError
+	)
+	l := level.Info(logging.With(r.Context(), logger))
+	switch {
+	case errors.As(err, &rangeErr):
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", rangeErr.Size))
+	case errors.As(err, &overload):
+		l = level.Warn(logging.With(r.Context(), logger))
+		if overload.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overload.RetryAfter.Seconds()))))
+		}
+	case status >= http.StatusInternalServerError:
+		l = level.Error(logging.With(r.Context(), logger))
+	}
+	l.Log(append(append([]interface{}{"msg", msg}, keyvals...), "status", status, "err", err)...)
+
+	writeErr(w, err, status)
+}
+
+func writeErr(w http.ResponseWriter, err error, status int) {
+	writeJSON(w, errorJSON{
+		Error:   errorCode(status),
+		Message: err.Error(),
+	}, status)
+}
+
+// errorCode turns a status into a snake_case code, e.g. 507 into "insufficient_storage".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return fmt.Sprintf("status_%d", status)
+	}
+
+	return strings.ToLower(strings.ReplaceAll(text, " ", "_"))
+}
@@ -0,0 +1,63 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
+	"github.com/donmikel/karma8/applications/server/services"
+)
+
+func TestErrorResponses(t *testing.T) {
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	require.NoError(t, storageManager.AddStorage(context.Background(), "storage_0",
+		inmemory.NewStorage("storage_0", log.NewNopLogger(), inmemory.WithCapacity(16)), domain.StorageLabels{}))
+	router := NewRouter(services.NewService(inmemory.NewFileMetaStorage(), storageManager), log.NewNopLogger())
+	// Two replicas can't be placed on a single storage.
+	replicated := NewRouter(services.NewService(inmemory.NewFileMetaStorage(), storageManager, services.WithReplication(2)),
+		log.NewNopLogger())
+
+	tests := []struct {
+		name   string
+		router http.Handler
+		method string
+		path   string
+		body   string
+		want   int
+		code   string
+	}{
+		{name: "missing file", router: router, method: http.MethodGet, path: "/file/missing", want: http.StatusNotFound, code: "not_found"},
+		{name: "no space", router: router, method: http.MethodPut, path: "/file/big", body: strings.Repeat("x", 1024),
+			want: http.StatusInsufficientStorage, code: "insufficient_storage"},
+		{name: "unplaceable", router: replicated, method: http.MethodGet, path: "/admin/placement?size=1",
+			want: http.StatusServiceUnavailable, code: "service_unavailable"},
+		{name: "bad size", router: router, method: http.MethodGet, path: "/admin/placement?size=-1", want: http.StatusBadRequest,
+			code: "bad_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			tt.router.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.want, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var body errorJSON
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+			assert.Equal(t, tt.code, body.Error)
+			assert.NotEmpty(t, body.Message)
+		})
+	}
+}
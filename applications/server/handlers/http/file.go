@@ -1,52 +1,254 @@
 package http
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/donmikel/karma8/applications/server"
 	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+	"github.com/donmikel/karma8/applications/server/metrics"
 )
 
-func NewRouter(svc server.FileService, logger log.Logger) http.Handler {
+// bucketPrefix is a route prefix addressing files in a named bucket.
+// Routes without it work with domain.DefaultBucket.
+const bucketPrefix = "/buckets/{bucket}"
+
+type routerOptions struct {
+	auth           server.AuthService
+	signer         server.URLSigner
+	rebalancer     server.Rebalancer
+	health         server.HealthChecker
+	registry       server.StorageRegistry
+	scrubber       server.Scrubber
+	status         server.StatusReporter
+	admission      server.UploadAdmission
+	metrics        *metrics.Metrics
+	tracerProvider trace.TracerProvider
+}
+
+// RouterOption adds optional routes and middlewares to the router.
+type RouterOption func(o *routerOptions)
+
+// WithAuth authenticates requests with API keys and adds key routes. Without it, admin and debug routes are open
+// to anyone reaching the server.
+func WithAuth(auth server.AuthService) RouterOption {
+	return func(o *routerOptions) {
+		o.auth = auth
+	}
+}
+
+// WithSigner issues presigned URLs and accepts requests carrying them.
+func WithSigner(signer server.URLSigner) RouterOption {
+	return func(o *routerOptions) {
+		o.signer = signer
+	}
+}
+
+// WithRebalancer adds rebalancing and drain routes.
+func WithRebalancer(rebalancer server.Rebalancer) RouterOption {
+	return func(o *routerOptions) {
+		o.rebalancer = rebalancer
+	}
+}
+
+// WithHealth adds the route listing storages with their health.
+func WithHealth(health server.HealthChecker) RouterOption {
+	return func(o *routerOptions) {
+		o.health = health
+	}
+}
+
+// WithRegistry adds routes adding storages and registering storage nodes.
+func WithRegistry(registry server.StorageRegistry) RouterOption {
+	return func(o *routerOptions) {
+		o.registry = registry
+	}
+}
+
+// WithScrubber adds scrub routes.
+func WithScrubber(scrubber server.Scrubber) RouterOption {
+	return func(o *routerOptions) {
+		o.scrubber = scrubber
+	}
+}
+
+// WithStatus adds the readiness probe and the debug status route.
+func WithStatus(status server.StatusReporter) RouterOption {
+	return func(o *routerOptions) {
+		o.status = status
+	}
+}
+
+// WithAdmission limits uploads in progress.
+func WithAdmission(admission server.UploadAdmission) RouterOption {
+	return func(o *routerOptions) {
+		o.admission = admission
+	}
+}
+
+// WithMetrics counts requests and serves metrics.
+func WithMetrics(m *metrics.Metrics) RouterOption {
+	return func(o *routerOptions) {
+		o.metrics = m
+	}
+}
+
+// WithTracerProvider traces requests.
+func WithTracerProvider(tracerProvider trace.TracerProvider) RouterOption {
+	return func(o *routerOptions) {
+		o.tracerProvider = tracerProvider
+	}
+}
+
+// NewRouter builds API routes. Routes and middlewares using services that aren't passed with options are absent;
+// nil services are the same as absent ones.
+func NewRouter(svc server.FileService, logger log.Logger, opts ...RouterOption) http.Handler {
+	var o routerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	r := mux.NewRouter()
-	r.HandleFunc("/file", PutFileHandler(svc, logger)).Methods(http.MethodPut)
-	r.HandleFunc("/file/{filename}", GetFileHandler(svc, logger)).Methods(http.MethodGet)
-	return r
+
+	if o.tracerProvider != nil {
+		r.Use(TracingMiddleware(o.tracerProvider))
+	}
+
+	if o.metrics != nil {
+		r.Handle("/metrics", o.metrics.Handler()).Methods(http.MethodGet)
+		r.Use(MetricsMiddleware(o.metrics))
+	}
+
+	// Probes of the orchestrator are never authenticated.
+	r.HandleFunc("/healthz", LivenessHandler()).Methods(http.MethodGet)
+	debug := r.PathPrefix("/debug").Subrouter()
+	if o.status != nil {
+		r.HandleFunc("/readyz", ReadinessHandler(o.status)).Methods(http.MethodGet)
+		debug.HandleFunc("/status", DebugStatusHandler(o.status, logger)).Methods(http.MethodGet)
+	}
+
+	if o.signer != nil {
+		presign := r.Path("/presign").Subrouter()
+		presign.Methods(http.MethodPost).HandlerFunc(PresignHandler(o.signer, logger))
+		if o.auth != nil {
+			presign.Use(AuthMiddleware(o.auth, authenticatedScope, logger))
+		}
+	}
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	if o.auth != nil {
+		admin.HandleFunc("/keys", CreateKeyHandler(o.auth, logger)).Methods(http.MethodPost)
+		admin.HandleFunc("/keys", ListKeysHandler(o.auth, logger)).Methods(http.MethodGet)
+		admin.HandleFunc("/keys/{id}", RevokeKeyHandler(o.auth, logger)).Methods(http.MethodDelete)
+	}
+	admin.HandleFunc("/placement", PlanPlacementHandler(svc, logger)).Methods(http.MethodGet)
+	if o.rebalancer != nil {
+		admin.HandleFunc("/rebalance", StartRebalanceHandler(o.rebalancer, logger)).Methods(http.MethodPost)
+		admin.HandleFunc("/rebalance", RebalanceStatusHandler(o.rebalancer, logger)).Methods(http.MethodGet)
+		admin.HandleFunc("/rebalance", StopRebalanceHandler(o.rebalancer, logger)).Methods(http.MethodDelete)
+		admin.HandleFunc("/drain", DrainHandler(o.rebalancer, logger)).Methods(http.MethodPost)
+		admin.HandleFunc("/drain", DrainStatusHandler(o.rebalancer, logger)).Methods(http.MethodGet)
+	}
+	if o.health != nil {
+		admin.HandleFunc("/storages", ListStoragesHandler(o.health, o.registry, logger)).Methods(http.MethodGet)
+	}
+	if o.scrubber != nil {
+		admin.HandleFunc("/scrub", StartScrubHandler(o.scrubber, logger)).Methods(http.MethodPost)
+		admin.HandleFunc("/scrub", ScrubReportHandler(o.scrubber, logger)).Methods(http.MethodGet)
+	}
+	if o.registry != nil {
+		admin.HandleFunc("/storages", AddStorageHandler(o.registry, logger)).Methods(http.MethodPost)
+
+		// Storage nodes authenticate with the registration key rather than API keys.
+		nodes := r.PathPrefix("/nodes").Subrouter()
+		nodes.HandleFunc("/register", RegisterNodeHandler(o.registry, logger)).Methods(http.MethodPost)
+		nodes.HandleFunc("/heartbeat", HeartbeatHandler(o.registry, logger)).Methods(http.MethodPost)
+		nodes.Use(NodeKeyMiddleware(o.registry, logger))
+	}
+
+	// Uploads are admitted once authenticated, so they count against their key.
+	admit := func(next http.Handler) http.Handler { return next }
+	if o.admission != nil {
+		admit = AdmissionMiddleware(o.admission, logger)
+	}
+
+	files := r.NewRoute().Subrouter()
+	for _, prefix := range []string{"", bucketPrefix} {
+		files.Handle(prefix+"/file", admit(PutFileHandler(svc, logger))).Methods(http.MethodPut)
+		files.Handle(prefix+"/file/{filename}", admit(PutFileByNameHandler(svc, logger))).Methods(http.MethodPut)
+		files.HandleFunc(prefix+"/file/{filename}", GetFileHandler(svc, logger)).Methods(http.MethodGet)
+		files.HandleFunc(prefix+"/file/{filename}", DeleteFileHandler(svc, logger)).Methods(http.MethodDelete)
+	}
+
+	if o.signer != nil {
+		files.Use(PresignMiddleware(o.signer, logger))
+	}
+
+	if o.auth != nil {
+		admin.Use(AuthMiddleware(o.auth, adminScope, logger))
+		debug.Use(AuthMiddleware(o.auth, adminScope, logger))
+		files.Use(AuthMiddleware(o.auth, methodScope, logger))
+	}
+
+	// Requests matching no route are logged too.
+	return RequestLogMiddleware(logger)(r)
+}
+
+// requestBucket returns a bucket addressed by the request.
+func requestBucket(r *http.Request) string {
+	if bucket := mux.Vars(r)["bucket"]; bucket != "" {
+		return bucket
+	}
+
+	return domain.DefaultBucket
 }
 
+// fileID returns an ID the file is known by to FileService. Files of the default bucket keep
+// their plain names, so files uploaded before buckets existed are still reachable.
+func fileID(bucket, filename string) string {
+	if bucket == domain.DefaultBucket {
+		return filename
+	}
+
+	return bucket + "/" + filename
+}
+
+// PutFileHandler stores the "file" field of a multipart form. The file is streamed to storages as the form is read,
+// so it's never held whole in memory or spooled to disk.
 func PutFileHandler(svc server.FileService, logger log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseMultipartForm(100 << 20)
-
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			level.Error(logger).Log("msg", "FormFile error",
-				"err", err,
-			)
-			writeErr(w, err, http.StatusInternalServerError)
+		if r.ContentLength == -1 {
+			writeErr(w, errors.New("content length is required"), http.StatusLengthRequired)
 			return
 		}
-		defer file.Close()
 
-		if r.ContentLength == -1 {
-			level.Error(logger).Log("msg", "wrong ContentLength",
+		file, err := formFile(r, "file")
+		if err != nil {
+			level.Info(logging.With(r.Context(), logger)).Log("msg", "form file error",
 				"err", err,
 			)
 			writeErr(w, err, http.StatusBadRequest)
 			return
 		}
+		defer file.Close()
 
 		up := domain.File{
 			Meta: domain.FileMeta{
-				Name:          header.Filename,
+				Name:        fileID(requestBucket(r), file.FileName()),
+				ContentType: file.Header.Get("Content-Type"),
+				// The size of the file is only known once it's read; it's no more than that of the request.
 				ContentLength: r.ContentLength,
 			},
 			Body: file,
@@ -54,15 +256,68 @@ func PutFileHandler(svc server.FileService, logger log.Logger) http.HandlerFunc
 
 		err = svc.PutFile(r.Context(), up)
 		if err != nil {
-			level.Error(logger).Log("msg", "PutFile error",
-				"err", err,
-			)
-			writeErr(w, err, http.StatusInternalServerError)
+			writeServiceErr(w, r, logger, "PutFile error", err)
+			return
+		}
+	}
+}
+
+// formFile returns the file in the named field of a multipart form, ready to be read from the request body.
+// Fields before it are skipped.
+func formFile(r *http.Request, name string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no file in form field %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read form: %w", err)
+		}
+
+		if part.FormName() == name && part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// PutFileByNameHandler stores a raw request body under the name from the path.
+// This is the upload form presigned URLs point at.
+func PutFileByNameHandler(svc server.FileService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename := mux.Vars(r)["filename"]
+		if filename == "" {
+			writeErr(w, errors.New("empty filename"), http.StatusBadRequest)
+			return
+		}
+
+		if r.ContentLength == -1 {
+			writeErr(w, errors.New("content length is required"), http.StatusLengthRequired)
+			return
+		}
+
+		up := domain.File{
+			Meta: domain.FileMeta{
+				Name:          fileID(requestBucket(r), filename),
+				ContentType:   r.Header.Get("Content-Type"),
+				ContentLength: r.ContentLength,
+			},
+			Body: r.Body,
+		}
+
+		if err := svc.PutFile(r.Context(), up); err != nil {
+			writeServiceErr(w, r, logger, "PutFile error", err)
 			return
 		}
 	}
 }
 
+// GetFileHandler serves a file, or the part of it a single-range Range header asks for. Other Range headers are
+// ignored, and the whole file is served.
 func GetFileHandler(svc server.FileService, logger log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		filename := mux.Vars(r)["filename"]
@@ -71,27 +326,133 @@ func GetFileHandler(svc server.FileService, logger log.Logger) http.HandlerFunc
 			return
 		}
 
-		file, err := svc.GetFile(r.Context(), filename)
+		id := fileID(requestBucket(r), filename)
+		var (
+			file domain.File
+			err  error
+		)
+		if rng, ok := parseRange(r.Header.Get("Range")); ok {
+			file, err = svc.GetFileRange(r.Context(), id, rng)
+		} else {
+			file, err = svc.GetFile(r.Context(), id, acceptedEncodings(r)...)
+		}
 		if err != nil {
-			writeErr(w, err, http.StatusInternalServerError)
+			writeServiceErr(w, r, logger, "GetFile error", err)
 			return
 		}
 		defer file.Body.Close()
 
-		w.Header().Set("Content-Length", strconv.FormatInt(file.Meta.ContentLength, 10))
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Accept-Ranges", "bytes")
+		if file.Meta.ContentType != "" {
+			w.Header().Set("Content-Type", file.Meta.ContentType)
+		}
+
+		status := http.StatusOK
+		switch {
+		case file.Range != nil:
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d",
+				file.Range.Start, file.Range.Start+file.Range.Length-1, file.Meta.ContentLength))
+			w.Header().Set("Content-Length", strconv.FormatInt(file.Range.Length, 10))
+		case file.ContentEncoding != "":
+			w.Header().Set("Content-Encoding", file.ContentEncoding)
+			w.Header().Set("Content-Length", strconv.FormatInt(file.Meta.CompressedLength(), 10))
+		default:
+			w.Header().Set("Content-Length", strconv.FormatInt(file.Meta.ContentLength, 10))
+		}
+		w.WriteHeader(status)
 
 		if _, err = io.Copy(w, file.Body); err != nil {
-			level.Error(logger).Log("msg", "error body copy", "err", err)
-			//writeErr(w, err, http.StatusInternalServerError)
+			level.Error(logging.With(r.Context(), logger)).Log("msg", "error body copy", "err", err)
+			// Headers are out already, so the only way left to tell the client the body is incomplete
+			// is to break the connection.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// parseRange parses a Range header asking for a single range of bytes, e.g. "bytes=0-99", "bytes=100-"
+// or "bytes=-100". It returns false for anything else.
+func parseRange(header string) (domain.ByteRange, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return domain.ByteRange{}, false
+	}
+	spec := strings.TrimPrefix(header, "bytes=")
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return domain.ByteRange{}, false
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return domain.ByteRange{}, false
+		}
+
+		return domain.ByteRange{Start: -suffix, Length: -1}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return domain.ByteRange{}, false
+	}
+
+	if last == "" {
+		return domain.ByteRange{Start: start, Length: -1}, true
+	}
+
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return domain.ByteRange{}, false
+	}
+
+	return domain.ByteRange{Start: start, Length: end - start + 1}, true
+}
+
+func DeleteFileHandler(svc server.FileService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename := mux.Vars(r)["filename"]
+		if filename == "" {
+			writeErr(w, errors.New("empty filename"), http.StatusBadRequest)
 			return
 		}
+
+		if err := svc.DeleteFile(r.Context(), fileID(requestBucket(r), filename)); err != nil {
+			writeServiceErr(w, r, logger, "DeleteFile error", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func writeErr(w http.ResponseWriter, err error, status int) {
+// acceptedEncodings returns content codings the client accepts, skipping those with q=0.
+func acceptedEncodings(r *http.Request) []string {
+	var result []string
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			if name, q, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "="); ok && name == "q" {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					continue
+				}
+			}
+
+			if coding != "" {
+				result = append(result, strings.ToLower(coding))
+			}
+		}
+	}
+
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	_, err = w.Write([]byte(err.Error()))
-	if err != nil {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
 		fmt.Println("can't write response ", err)
 	}
 }
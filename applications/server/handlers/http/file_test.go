@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
+	"github.com/donmikel/karma8/applications/server/services"
+)
+
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	require.NoError(t, storageManager.AddStorage(context.Background(), "storage_0",
+		inmemory.NewStorage("storage_0", log.NewNopLogger()), domain.StorageLabels{}))
+
+	return NewRouter(services.NewService(inmemory.NewFileMetaStorage(), storageManager), log.NewNopLogger())
+}
+
+func TestPutFileMultipart(t *testing.T) {
+	router := newTestRouter(t)
+	content := bytes.Repeat([]byte("streamed "), 10000)
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	require.NoError(t, writer.WriteField("comment", "fields before the file are skipped"))
+	part, err := writer.CreateFormFile("file", "report.txt")
+	require.NoError(t, err)
+	_, err = part.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPut, "/file", bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file/report.txt", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	// A form without a file is turned away.
+	form.Reset()
+	writer = multipart.NewWriter(&form)
+	require.NoError(t, writer.WriteField("comment", "no file"))
+	require.NoError(t, writer.Close())
+	req = httptest.NewRequest(http.MethodPut, "/file", bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetFileRange(t *testing.T) {
+	router := newTestRouter(t)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/file/name", strings.NewReader("0123456789")))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	tests := []struct {
+		header       string
+		want         int
+		contentRange string
+		body         string
+	}{
+		{header: "bytes=2-4", want: http.StatusPartialContent, contentRange: "bytes 2-4/10", body: "234"},
+		{header: "bytes=7-", want: http.StatusPartialContent, contentRange: "bytes 7-9/10", body: "789"},
+		{header: "bytes=-2", want: http.StatusPartialContent, contentRange: "bytes 8-9/10", body: "89"},
+		{header: "bytes=8-100", want: http.StatusPartialContent, contentRange: "bytes 8-9/10", body: "89"},
+		{header: "bytes=10-", want: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+		// Multiple ranges and malformed ones are ignored.
+		{header: "bytes=0-1,3-4", want: http.StatusOK, body: "0123456789"},
+		{header: "bytes=4-2", want: http.StatusOK, body: "0123456789"},
+		{header: "items=0-1", want: http.StatusOK, body: "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/file/name", nil)
+			req.Header.Set("Range", tt.header)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.want, rec.Code)
+			assert.Equal(t, tt.contentRange, rec.Header().Get("Content-Range"))
+			if tt.body != "" {
+				assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+				assert.Equal(t, tt.body, rec.Body.String())
+			}
+		})
+	}
+}
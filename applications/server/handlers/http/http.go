@@ -9,8 +9,8 @@ import (
 	"github.com/donmikel/karma8/applications/server/config"
 )
 
-func NewHTTPServer(conf config.Api, fileService server.FileService, logger log.Logger) *http.Server {
-	mux := NewRouter(fileService, logger)
+func NewHTTPServer(conf config.Api, fileService server.FileService, logger log.Logger, opts ...RouterOption) *http.Server {
+	mux := NewRouter(fileService, logger, opts...)
 	return &http.Server{
 		Addr:    conf.HTTPAddr,
 		Handler: mux,
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/mux"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+type grantJSON struct {
+	Bucket string         `json:"bucket"`
+	Scopes []domain.Scope `json:"scopes"`
+}
+
+type keyJSON struct {
+	ID        string      `json:"id"`
+	Key       string      `json:"key,omitempty"`
+	Grants    []grantJSON `json:"grants"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type createKeyRequest struct {
+	Grants []grantJSON `json:"grants"`
+}
+
+func CreateKeyHandler(auth server.AuthService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, fmt.Errorf("can't decode request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		grants := make([]domain.Grant, 0, len(req.Grants))
+		for _, g := range req.Grants {
+			grants = append(grants, domain.Grant{Bucket: g.Bucket, Scopes: g.Scopes})
+		}
+
+		key, secret, err := auth.CreateKey(r.Context(), grants)
+		if err != nil {
+			writeServiceErr(w, r, logger, "CreateKey error", err)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "API key created",
+			"key_id", key.ID,
+		)
+
+		resp := toKeyJSON(key)
+		resp.Key = secret
+		writeJSON(w, resp, http.StatusCreated)
+	}
+}
+
+func ListKeysHandler(auth server.AuthService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := auth.ListKeys(r.Context())
+		if err != nil {
+			writeServiceErr(w, r, logger, "ListKeys error", err)
+			return
+		}
+
+		resp := make([]keyJSON, 0, len(keys))
+		for _, key := range keys {
+			resp = append(resp, toKeyJSON(key))
+		}
+
+		writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+func RevokeKeyHandler(auth server.AuthService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			writeErr(w, errors.New("empty key id"), http.StatusBadRequest)
+			return
+		}
+
+		if err := auth.RevokeKey(r.Context(), id); err != nil {
+			writeServiceErr(w, r, logger, "RevokeKey error", err)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "API key revoked",
+			"key_id", id,
+		)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func toKeyJSON(key domain.APIKey) keyJSON {
+	grants := make([]grantJSON, 0, len(key.Grants))
+	for _, g := range key.Grants {
+		grants = append(grants, grantJSON{Bucket: g.Bucket, Scopes: g.Scopes})
+	}
+
+	return keyJSON{
+		ID:        key.ID,
+		Grants:    grants,
+		CreatedAt: key.CreatedAt,
+	}
+}
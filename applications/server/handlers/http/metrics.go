@@ -0,0 +1,73 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/donmikel/karma8/applications/server/metrics"
+)
+
+// statusRecorder remembers the status code a handler responded with, and how many bytes of body it wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+
+	return n, err
+}
+
+// routeTemplate is the path template of the route r matched, so that paths with file names don't make
+// a series or a span name each.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return "unknown"
+}
+
+// MetricsMiddleware counts requests and times them by the template of the route they matched.
+func MetricsMiddleware(m *metrics.Metrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+			started := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			completed := false
+			// The request is recorded in a deferred func, so that responses aborted with a panic are counted too.
+			defer func() {
+				if !completed {
+					m.ObserveAbortedRequest(route, r.Method, time.Since(started))
+					return
+				}
+				if recorder.code == 0 {
+					recorder.code = http.StatusOK
+				}
+				m.ObserveRequest(route, r.Method, recorder.code, time.Since(started))
+			}()
+
+			next.ServeHTTP(recorder, r)
+			completed = true
+		})
+	}
+}
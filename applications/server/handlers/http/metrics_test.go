@@ -0,0 +1,64 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/metrics"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name:    "served",
+			handler: func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("hello")) },
+			want:    `code="200"`,
+		},
+		{
+			name:    "failed",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			want:    `code="503"`,
+		},
+		{
+			name: "aborted",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("cut "))
+				panic(http.ErrAbortHandler)
+			},
+			want: `code="aborted"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metrics.New()
+			handler := MetricsMiddleware(m)(tt.handler)
+
+			func() {
+				defer func() {
+					// The abort is passed on for the server to break the connection.
+					if r := recover(); r != nil {
+						assert.Equal(t, http.ErrAbortHandler, r)
+					}
+				}()
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/file/a", nil))
+			}()
+
+			recorder := httptest.NewRecorder()
+			m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			body, err := io.ReadAll(recorder.Body)
+			require.NoError(t, err)
+
+			assert.Contains(t, string(body), `karma8_http_requests_total{`+tt.want+`,method="GET",route="unknown"} 1`)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/log"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+type storageRefJSON struct {
+	URL  string `json:"url"`
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+type plannedPartJSON struct {
+	ContentLength int64            `json:"content_length"`
+	Storages      []storageRefJSON `json:"storages"`
+}
+
+// PlanPlacementHandler shows where a file of the size given by the size query parameter would be stored.
+// The optional name parameter matters for policies hashing file names.
+func PlanPlacementHandler(svc server.FileService, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size < 0 {
+			writeErr(w, fmt.Errorf("size must be a non-negative number of bytes"), http.StatusBadRequest)
+			return
+		}
+
+		parts, err := svc.PlanPlacement(r.Context(), r.URL.Query().Get("name"), size)
+		if err != nil {
+			writeServiceErr(w, r, logger, "PlanPlacement error", err)
+			return
+		}
+
+		resp := make([]plannedPartJSON, 0, len(parts))
+		for _, part := range parts {
+			resp = append(resp, plannedPartJSON{
+				ContentLength: part.ContentLength,
+				Storages:      toStorageRefsJSON(part.Storages),
+			})
+		}
+
+		writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+func toStorageRefsJSON(refs []domain.StorageRef) []storageRefJSON {
+	result := make([]storageRefJSON, 0, len(refs))
+	for _, ref := range refs {
+		result = append(result, toStorageRefJSON(ref))
+	}
+
+	return result
+}
+
+func toStorageRefJSON(ref domain.StorageRef) storageRefJSON {
+	return storageRefJSON{
+		URL:  ref.URL,
+		Zone: ref.Labels.Zone,
+		Rack: ref.Labels.Rack,
+		Host: ref.Labels.Host,
+	}
+}
@@ -0,0 +1,203 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/mux"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// Query parameters of a presigned URL.
+const (
+	presignExpiresParam   = "expires"
+	presignMaxLengthParam = "max_length"
+	presignSignatureParam = "signature"
+)
+
+type presignedContextKey struct{}
+
+type presignRequest struct {
+	Method    string `json:"method"`
+	Bucket    string `json:"bucket"`
+	Filename  string `json:"filename"`
+	ExpiresIn string `json:"expires_in"`
+	MaxLength int64  `json:"max_length"`
+}
+
+type presignResponse struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Expires time.Time `json:"expires"`
+}
+
+// PresignMiddleware lets requests carrying a valid presigned URL signature through without an API key.
+// Requests without a signature are passed on untouched.
+func PresignMiddleware(signer server.URLSigner, logger log.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			signature := query.Get(presignSignatureParam)
+			if signature == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			maxLength, err := verifyPresigned(signer, r, query, signature)
+			if err != nil {
+				level.Info(logging.With(r.Context(), logger)).Log("msg", "presigned URL rejected",
+					"path", r.URL.Path,
+					"err", err,
+				)
+				writeErr(w, errors.New("invalid presigned URL"), http.StatusForbidden)
+				return
+			}
+
+			if maxLength > 0 {
+				if r.ContentLength < 0 || r.ContentLength > maxLength {
+					writeErr(w, fmt.Errorf("content length exceeds %d bytes", maxLength), http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				r.Body = http.MaxBytesReader(w, r.Body, maxLength)
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), presignedContextKey{}, true)))
+		})
+	}
+}
+
+func verifyPresigned(signer server.URLSigner, r *http.Request, query url.Values, signature string) (int64, error) {
+	filename := mux.Vars(r)["filename"]
+	if filename == "" {
+		return 0, errors.New("presigned URL must name a file")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(presignExpiresParam), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse expiry: %w", err)
+	}
+
+	var maxLength int64
+	if v := query.Get(presignMaxLengthParam); v != "" {
+		if maxLength, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("can't parse content length limit: %w", err)
+		}
+	}
+
+	id := fileID(requestBucket(r), filename)
+	if err = signer.Verify(r.Method, id, time.Unix(expires, 0), maxLength, signature); err != nil {
+		return 0, err
+	}
+
+	return maxLength, nil
+}
+
+// isPresigned reports whether the request was let through by PresignMiddleware.
+func isPresigned(ctx context.Context) bool {
+	presigned, _ := ctx.Value(presignedContextKey{}).(bool)
+	return presigned
+}
+
+// PresignHandler mints presigned URLs. When authentication is on, the caller needs the scope
+// the URL grants on its bucket.
+func PresignHandler(signer server.URLSigner, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req presignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, fmt.Errorf("can't decode request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		if req.Bucket == "" {
+			req.Bucket = domain.DefaultBucket
+		}
+
+		var scope domain.Scope
+		switch req.Method {
+		case http.MethodGet:
+			scope = domain.ScopeRead
+		case http.MethodPut:
+			scope = domain.ScopeWrite
+		default:
+			writeErr(w, fmt.Errorf("method %q can't be presigned", req.Method), http.StatusBadRequest)
+			return
+		}
+
+		if req.Filename == "" {
+			writeErr(w, errors.New("empty filename"), http.StatusBadRequest)
+			return
+		}
+
+		if key, ok := apiKeyFromContext(r.Context()); ok && !key.Allows(req.Bucket, scope) {
+			writeErr(w, errors.New("forbidden"), http.StatusForbidden)
+			return
+		}
+
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			writeErr(w, fmt.Errorf("can't parse expires_in: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		expires, signature, err := signer.Sign(req.Method, fileID(req.Bucket, req.Filename), expiresIn, req.MaxLength)
+		if err != nil {
+			writeServiceErr(w, r, logger, "Sign error", err)
+			return
+		}
+
+		query := url.Values{}
+		query.Set(presignExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+		if req.MaxLength > 0 {
+			query.Set(presignMaxLengthParam, strconv.FormatInt(req.MaxLength, 10))
+		}
+		query.Set(presignSignatureParam, signature)
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "presigned URL issued",
+			"method", req.Method,
+			"bucket", req.Bucket,
+			"filename", req.Filename,
+			"expires", expires,
+		)
+
+		writeJSON(w, presignResponse{
+			URL:     baseURL(r) + filePath(req.Bucket, req.Filename) + "?" + query.Encode(),
+			Method:  req.Method,
+			Expires: expires.UTC(),
+		}, http.StatusOK)
+	}
+}
+
+// filePath returns an API path of a file.
+func filePath(bucket, filename string) string {
+	if bucket == domain.DefaultBucket {
+		return "/file/" + url.PathEscape(filename)
+	}
+
+	return "/buckets/" + url.PathEscape(bucket) + "/file/" + url.PathEscape(filename)
+}
+
+// baseURL returns scheme and host the client reached the API at.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
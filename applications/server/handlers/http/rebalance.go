@@ -0,0 +1,166 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+type partMoveJSON struct {
+	Path      string `json:"path"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Committed bool   `json:"committed"`
+}
+
+type rebalanceStatusJSON struct {
+	Running     bool          `json:"running"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	FinishedAt  *time.Time    `json:"finished_at,omitempty"`
+	MovedParts  int           `json:"moved_parts"`
+	MovedBytes  int64         `json:"moved_bytes"`
+	FailedMoves int           `json:"failed_moves"`
+	Current     *partMoveJSON `json:"current,omitempty"`
+	LastError   string        `json:"last_error,omitempty"`
+}
+
+// StartRebalanceHandler launches a rebalancing run and responds with its status.
+func StartRebalanceHandler(rebalancer server.Rebalancer, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := rebalancer.Start(r.Context())
+		if err != nil {
+			writeServiceErr(w, r, logger, "Start rebalance error", err)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "rebalancing started")
+
+		writeRebalanceStatus(w, r, rebalancer, logger, http.StatusAccepted)
+	}
+}
+
+func RebalanceStatusHandler(rebalancer server.Rebalancer, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeRebalanceStatus(w, r, rebalancer, logger, http.StatusOK)
+	}
+}
+
+// StopRebalanceHandler interrupts a running rebalancing run. A later run picks up where it stopped.
+func StopRebalanceHandler(rebalancer server.Rebalancer, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rebalancer.Stop(r.Context()); err != nil {
+			writeServiceErr(w, r, logger, "Stop rebalance error", err)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "rebalancing stopped")
+
+		writeRebalanceStatus(w, r, rebalancer, logger, http.StatusOK)
+	}
+}
+
+func writeRebalanceStatus(w http.ResponseWriter, r *http.Request, rebalancer server.Rebalancer, logger log.Logger, code int) {
+	status, err := rebalancer.Status(r.Context())
+	if err != nil {
+		writeServiceErr(w, r, logger, "rebalance Status error", err)
+		return
+	}
+
+	writeJSON(w, toRebalanceStatusJSON(status), code)
+}
+
+func toRebalanceStatusJSON(status domain.RebalanceStatus) rebalanceStatusJSON {
+	resp := rebalanceStatusJSON{
+		Running:     status.Running,
+		MovedParts:  status.MovedParts,
+		MovedBytes:  status.MovedBytes,
+		FailedMoves: status.FailedMoves,
+		LastError:   status.LastError,
+	}
+
+	if !status.StartedAt.IsZero() {
+		resp.StartedAt = &status.StartedAt
+	}
+
+	if !status.FinishedAt.IsZero() {
+		resp.FinishedAt = &status.FinishedAt
+	}
+
+	if status.Current != nil {
+		resp.Current = &partMoveJSON{
+			Path:      status.Current.Path,
+			From:      status.Current.From,
+			To:        status.Current.To,
+			Committed: status.Current.Committed,
+		}
+	}
+
+	return resp
+}
+
+type drainStatusJSON struct {
+	Storage        string `json:"storage"`
+	Draining       bool   `json:"draining"`
+	Removed        bool   `json:"removed"`
+	RemainingParts int    `json:"remaining_parts"`
+	RemainingBytes int64  `json:"remaining_bytes"`
+}
+
+// DrainHandler takes the storage named by the storage query parameter out of service and responds with drain progress.
+func DrainHandler(rebalancer server.Rebalancer, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storageURL := r.URL.Query().Get("storage")
+		if storageURL == "" {
+			writeErr(w, errors.New("empty storage"), http.StatusBadRequest)
+			return
+		}
+
+		if err := rebalancer.Drain(r.Context(), storageURL); err != nil {
+			writeServiceErr(w, r, logger, "Drain error", err, "storage", storageURL)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "storage drain started",
+			"storage", storageURL,
+		)
+
+		writeDrainStatus(w, r, rebalancer, storageURL, logger, http.StatusAccepted)
+	}
+}
+
+// DrainStatusHandler shows how much is left to move off the storage named by the storage query parameter.
+func DrainStatusHandler(rebalancer server.Rebalancer, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storageURL := r.URL.Query().Get("storage")
+		if storageURL == "" {
+			writeErr(w, errors.New("empty storage"), http.StatusBadRequest)
+			return
+		}
+
+		writeDrainStatus(w, r, rebalancer, storageURL, logger, http.StatusOK)
+	}
+}
+
+func writeDrainStatus(w http.ResponseWriter, r *http.Request, rebalancer server.Rebalancer, storageURL string,
+	logger log.Logger, code int) {
+	status, err := rebalancer.DrainStatus(r.Context(), storageURL)
+	if err != nil {
+		writeServiceErr(w, r, logger, "DrainStatus error", err, "storage", storageURL)
+		return
+	}
+
+	writeJSON(w, drainStatusJSON{
+		Storage:        status.URL,
+		Draining:       status.Draining,
+		Removed:        status.Removed,
+		RemainingParts: status.RemainingParts,
+		RemainingBytes: status.RemainingBytes,
+	}, code)
+}
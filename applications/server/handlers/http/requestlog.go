@@ -0,0 +1,95 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// requestIDHeader carries the ID of a request, sent by the caller or assigned by the server.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds IDs taken from callers, as they end up in every record logged for the request.
+const maxRequestIDLength = 128
+
+// RequestLogMiddleware assigns every request an ID, unless the caller sent one in X-Request-ID, and returns it
+// in the response. The ID is added to records logged while the request is served, and one access log record
+// is written per request.
+func RequestLogMiddleware(logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, id)
+			ctx := logging.WithRequestID(r.Context(), id)
+
+			started := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			completed := false
+			// Logging is deferred, so that responses aborted with a panic are logged too.
+			defer func() {
+				if recorder.code == 0 {
+					recorder.code = http.StatusOK
+				}
+				level.Info(logging.With(ctx, logger)).Log("msg", "request served",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"status", recorder.code,
+					"bytes", recorder.bytes,
+					"duration", time.Since(started),
+					"client", clientAddr(r),
+					"aborted", !completed,
+				)
+			}()
+
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			completed = true
+		})
+	}
+}
+
+// validRequestID lets through IDs that are safe to log and to send on to storage nodes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// clientAddr is the IP address of the peer the request came from.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
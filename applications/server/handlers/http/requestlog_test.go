@@ -0,0 +1,56 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+func TestRequestLogMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.NewLogfmtLogger(&out)
+
+	var handlerID string
+	handler := RequestLogMiddleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID = logging.RequestID(r.Context())
+		level.Warn(logging.With(r.Context(), logger)).Log("msg", "handling")
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/file/a?signature=secret", nil)
+	req.Header.Set(requestIDHeader, "caller-id-1")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "caller-id-1", resp.Header().Get(requestIDHeader))
+	assert.Equal(t, "caller-id-1", handlerID)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "request_id=caller-id-1")
+	for _, field := range []string{"request_id=caller-id-1", "method=GET", "path=/file/a", "status=200", "bytes=5",
+		"duration=", "client=192.0.2.1"} {
+		assert.Contains(t, lines[1], field)
+	}
+	assert.NotContains(t, lines[1], "secret")
+
+	// A missing or unsafe ID is replaced with a new one.
+	for _, id := range []string{"", "has space", strings.Repeat("a", maxRequestIDLength+1)} {
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestIDHeader, id)
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		assert.Len(t, resp.Header().Get(requestIDHeader), 32)
+		assert.Equal(t, resp.Header().Get(requestIDHeader), handlerID)
+	}
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+type scrubFindingJSON struct {
+	File        string    `json:"file"`
+	Path        string    `json:"path"`
+	Storage     string    `json:"storage"`
+	Problem     string    `json:"problem"`
+	Repaired    bool      `json:"repaired"`
+	RepairError string    `json:"repair_error,omitempty"`
+	FoundAt     time.Time `json:"found_at"`
+}
+
+type scrubReportJSON struct {
+	Running      bool               `json:"running"`
+	StartedAt    *time.Time         `json:"started_at,omitempty"`
+	FinishedAt   *time.Time         `json:"finished_at,omitempty"`
+	CheckedParts int                `json:"checked_parts"`
+	CheckedBytes int64              `json:"checked_bytes"`
+	SkippedParts int                `json:"skipped_parts"`
+	Damaged      int                `json:"damaged"`
+	Repaired     int                `json:"repaired"`
+	Findings     []scrubFindingJSON `json:"findings"`
+	LastError    string             `json:"last_error,omitempty"`
+}
+
+// StartScrubHandler launches a scrub and responds with its report.
+func StartScrubHandler(scrubber server.Scrubber, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := scrubber.Start(r.Context())
+		if err != nil {
+			writeServiceErr(w, r, logger, "Start scrub error", err)
+			return
+		}
+
+		level.Info(logging.With(r.Context(), logger)).Log("msg", "scrub started")
+
+		writeScrubReport(w, r, scrubber, logger, http.StatusAccepted)
+	}
+}
+
+func ScrubReportHandler(scrubber server.Scrubber, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeScrubReport(w, r, scrubber, logger, http.StatusOK)
+	}
+}
+
+func writeScrubReport(w http.ResponseWriter, r *http.Request, scrubber server.Scrubber, logger log.Logger, code int) {
+	report, err := scrubber.Report(r.Context())
+	if err != nil {
+		writeServiceErr(w, r, logger, "scrub Report error", err)
+		return
+	}
+
+	writeJSON(w, toScrubReportJSON(report), code)
+}
+
+func toScrubReportJSON(report domain.ScrubReport) scrubReportJSON {
+	resp := scrubReportJSON{
+		Running:      report.Running,
+		CheckedParts: report.CheckedParts,
+		CheckedBytes: report.CheckedBytes,
+		SkippedParts: report.SkippedParts,
+		Damaged:      report.Damaged,
+		Repaired:     report.Repaired,
+		Findings:     make([]scrubFindingJSON, 0, len(report.Findings)),
+		LastError:    report.LastError,
+	}
+
+	if !report.StartedAt.IsZero() {
+		resp.StartedAt = &report.StartedAt
+	}
+
+	if !report.FinishedAt.IsZero() {
+		resp.FinishedAt = &report.FinishedAt
+	}
+
+	for _, finding := range report.Findings {
+		resp.Findings = append(resp.Findings, scrubFindingJSON{
+			File:        finding.File,
+			Path:        finding.Path,
+			Storage:     finding.StorageURL,
+			Problem:     finding.Problem,
+			Repaired:    finding.Repaired,
+			RepairError: finding.RepairError,
+			FoundAt:     finding.FoundAt,
+		})
+	}
+
+	return resp
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+type readinessJSON struct {
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+type storageStateJSON struct {
+	storageStatusJSON
+	FreeSpace      int64  `json:"free_space"`
+	FreeSpaceError string `json:"free_space_error,omitempty"`
+	Parts          int    `json:"parts"`
+}
+
+type serverStatusJSON struct {
+	readinessJSON
+	Version           string             `json:"version,omitempty"`
+	StartedAt         time.Time          `json:"started_at"`
+	Uptime            string             `json:"uptime"`
+	AvailableStorages int                `json:"available_storages"`
+	MinStorages       int                `json:"min_storages"`
+	Storages          []storageStateJSON `json:"storages"`
+}
+
+// LivenessHandler answers while the server is able to serve requests at all.
+func LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"}, http.StatusOK)
+	}
+}
+
+// ReadinessHandler answers 503 Service Unavailable while the server should be out of rotation.
+func ReadinessHandler(status server.StatusReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := status.Ready(r.Context())
+
+		code := http.StatusOK
+		if !readiness.Ready {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, toReadinessJSON(readiness), code)
+	}
+}
+
+// DebugStatusHandler shows readiness of the server and the state of every storage.
+func DebugStatusHandler(status server.StatusReporter, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverStatus, err := status.Status(r.Context())
+		if err != nil {
+			writeServiceErr(w, r, logger, "Status error", err)
+			return
+		}
+
+		resp := serverStatusJSON{
+			readinessJSON:     toReadinessJSON(serverStatus.Readiness),
+			Version:           serverStatus.Version,
+			StartedAt:         serverStatus.StartedAt,
+			Uptime:            time.Since(serverStatus.StartedAt).Round(time.Second).String(),
+			AvailableStorages: serverStatus.AvailableStorages,
+			MinStorages:       serverStatus.MinStorages,
+			Storages:          make([]storageStateJSON, 0, len(serverStatus.Storages)),
+		}
+
+		for _, state := range serverStatus.Storages {
+			state := state
+			item := storageStateJSON{
+				storageStatusJSON: storageStatusJSON{
+					storageRefJSON: toStorageRefJSON(domain.StorageRef{URL: state.URL, Labels: state.Labels}),
+					Health:         string(state.Health),
+					Draining:       state.Draining,
+					LastError:      state.LastError,
+				},
+				FreeSpace:      state.FreeSpace,
+				FreeSpaceError: state.FreeSpaceError,
+				Parts:          state.Parts,
+			}
+
+			if !state.CheckedAt.IsZero() {
+				item.CheckedAt = &state.CheckedAt
+			}
+
+			resp.Storages = append(resp.Storages, item)
+		}
+
+		writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+func toReadinessJSON(readiness domain.Readiness) readinessJSON {
+	return readinessJSON{
+		Ready:   readiness.Ready,
+		Reasons: readiness.Reasons,
+	}
+}
@@ -0,0 +1,187 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// nodeKeyHeader carries the shared key storage nodes register themselves with.
+const nodeKeyHeader = "X-Registration-Key"
+
+type storageStatusJSON struct {
+	storageRefJSON
+	Type          string     `json:"type,omitempty"`
+	Self          bool       `json:"self,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	Health        string     `json:"health"`
+	Draining      bool       `json:"draining"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+type registerStorageRequest struct {
+	URL      string `json:"url"`
+	Type     string `json:"type"`
+	Capacity int64  `json:"capacity"`
+	Zone     string `json:"zone"`
+	Rack     string `json:"rack"`
+	Host     string `json:"host"`
+}
+
+type registrationJSON struct {
+	storageRefJSON
+	Type          string     `json:"type"`
+	Self          bool       `json:"self,omitempty"`
+	RegisteredAt  time.Time  `json:"registered_at"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+type heartbeatRequest struct {
+	URL string `json:"url"`
+}
+
+// ListStoragesHandler shows every registered storage with its health. When registry is nil,
+// storages are listed without their type.
+func ListStoragesHandler(health server.HealthChecker, registry server.StorageRegistry, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := health.Statuses(r.Context())
+		if err != nil {
+			writeServiceErr(w, r, logger, "Statuses error", err)
+			return
+		}
+
+		registrations := map[string]domain.StorageRegistration{}
+		if registry != nil {
+			regs, err := registry.List(r.Context())
+			if err != nil {
+				writeServiceErr(w, r, logger, "List storages error", err)
+				return
+			}
+
+			for _, reg := range regs {
+				registrations[reg.URL] = reg
+			}
+		}
+
+		resp := make([]storageStatusJSON, 0, len(statuses))
+		for _, status := range statuses {
+			status := status
+			reg := registrations[status.URL]
+			item := storageStatusJSON{
+				storageRefJSON: toStorageRefJSON(domain.StorageRef{URL: status.URL, Labels: status.Labels}),
+				Type:           reg.Type,
+				Self:           reg.Self,
+				Health:         string(status.Health),
+				Draining:       status.Draining,
+				LastError:      status.LastError,
+			}
+
+			if !reg.LastHeartbeat.IsZero() {
+				item.LastHeartbeat = &reg.LastHeartbeat
+			}
+
+			if !status.CheckedAt.IsZero() {
+				item.CheckedAt = &status.CheckedAt
+			}
+
+			resp = append(resp, item)
+		}
+
+		writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+// AddStorageHandler registers a storage on behalf of an operator.
+func AddStorageHandler(registry server.StorageRegistry, logger log.Logger) http.HandlerFunc {
+	return registerStorageHandler(registry, false, logger)
+}
+
+// RegisterNodeHandler registers a storage node on its own request. HTTP is the default storage type.
+func RegisterNodeHandler(registry server.StorageRegistry, logger log.Logger) http.HandlerFunc {
+	return registerStorageHandler(registry, true, logger)
+}
+
+func registerStorageHandler(registry server.StorageRegistry, self bool, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req registerStorageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, fmt.Errorf("can't decode request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		if req.Type == "" && self {
+			req.Type = domain.StorageTypeHTTP
+		}
+
+		reg, err := registry.Register(r.Context(), domain.StorageRegistration{
+			URL:      req.URL,
+			Type:     req.Type,
+			Capacity: req.Capacity,
+			Labels:   domain.StorageLabels{Zone: req.Zone, Rack: req.Rack, Host: req.Host},
+			Self:     self,
+		})
+		if err != nil {
+			writeServiceErr(w, r, logger, "Register error", err, "storage", req.URL)
+			return
+		}
+
+		resp := registrationJSON{
+			storageRefJSON: toStorageRefJSON(domain.StorageRef{URL: reg.URL, Labels: reg.Labels}),
+			Type:           reg.Type,
+			Self:           reg.Self,
+			RegisteredAt:   reg.RegisteredAt,
+		}
+		if !reg.LastHeartbeat.IsZero() {
+			resp.LastHeartbeat = &reg.LastHeartbeat
+		}
+
+		writeJSON(w, resp, http.StatusCreated)
+	}
+}
+
+// HeartbeatHandler records that a self-registered storage node is alive. Unknown nodes get 404 and should register again.
+func HeartbeatHandler(registry server.StorageRegistry, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req heartbeatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, fmt.Errorf("can't decode request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		err := registry.Heartbeat(r.Context(), req.URL)
+		if err != nil {
+			writeServiceErr(w, r, logger, "Heartbeat error", err, "storage", req.URL)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// NodeKeyMiddleware lets through only requests carrying the storage node registration key.
+func NodeKeyMiddleware(registry server.StorageRegistry, logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := registry.VerifyNodeKey(r.Header.Get(nodeKeyHeader)); err != nil {
+				level.Warn(logging.With(r.Context(), logger)).Log("msg", "storage node rejected",
+					"remote_addr", r.RemoteAddr,
+					"err", err,
+				)
+				writeErr(w, errors.New("forbidden"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// requestIDKey tags spans with the ID requests are logged with.
+const requestIDKey = attribute.Key("karma8.request_id")
+
+// TracingMiddleware starts a span per request, named after the template of the route it matched. A trace context
+// sent by the caller is continued.
+func TracingMiddleware(provider trace.TracerProvider) mux.MiddlewareFunc {
+	tracer := provider.Tracer("github.com/donmikel/karma8/applications/server/handlers/http")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPMethodKey.String(r.Method),
+					semconv.HTTPRouteKey.String(route),
+					semconv.HTTPTargetKey.String(r.URL.Path),
+					requestIDKey.String(logging.RequestID(r.Context())),
+				),
+			)
+			defer span.End()
+
+			recorder := &statusRecorder{ResponseWriter: w}
+			completed := false
+			// The status is recorded in a deferred func, so that responses aborted with a panic end with one too.
+			defer func() {
+				if recorder.code == 0 {
+					recorder.code = http.StatusOK
+				}
+				span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.code))
+				switch {
+				case !completed:
+					span.SetStatus(codes.Error, "response aborted")
+				case recorder.code >= http.StatusInternalServerError:
+					span.SetStatus(codes.Error, http.StatusText(recorder.code))
+				}
+			}()
+
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			completed = true
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		code    int
+		status  codes.Code
+	}{
+		{
+			name:    "served",
+			handler: func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("hello")) },
+			code:    http.StatusOK,
+		},
+		{
+			name:    "failed",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			code:    http.StatusServiceUnavailable,
+			status:  codes.Error,
+		},
+		{
+			name: "aborted",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("cut "))
+				panic(http.ErrAbortHandler)
+			},
+			code:   http.StatusOK,
+			status: codes.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			handler := TracingMiddleware(provider)(tt.handler)
+
+			func() {
+				defer func() {
+					// The abort is passed on for the server to break the connection.
+					if r := recover(); r != nil {
+						assert.Equal(t, http.ErrAbortHandler, r)
+					}
+				}()
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/file/a", nil))
+			}()
+
+			spans := recorder.Ended()
+			require.Len(t, spans, 1)
+			assert.Contains(t, spans[0].Attributes(), semconv.HTTPStatusCodeKey.Int(tt.code))
+			assert.Equal(t, tt.status, spans[0].Status().Code)
+		})
+	}
+}
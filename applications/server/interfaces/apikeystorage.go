@@ -0,0 +1,14 @@
+package interfaces
+
+import (
+	"context"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+type APIKeyStorage interface {
+	PutKey(ctx context.Context, key domain.APIKey) error
+	GetKeyByHash(ctx context.Context, hash string) (domain.APIKey, error)
+	DeleteKey(ctx context.Context, id string) error
+	ListKeys(ctx context.Context) ([]domain.APIKey, error)
+}
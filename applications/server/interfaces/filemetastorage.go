@@ -8,6 +8,32 @@ import (
 
 type FileMetaStorage interface {
 	StartProcessingFileMeta(ctx context.Context, meta domain.FileMeta) error
-	CompleteFileMeta(ctx context.Context, id string) error
+	CompleteFileMeta(ctx context.Context, meta domain.FileMeta) error
 	GetFileMeta(ctx context.Context, id string) (domain.FileMeta, error)
+	// DeleteFileMeta removes file metadata and returns what was removed.
+	DeleteFileMeta(ctx context.Context, id string) (domain.FileMeta, error)
+
+	// AcquirePart takes a reference to a known deduplicated part with the given hash and returns
+	// its stored location. It returns false and takes no reference if the part is unknown.
+	AcquirePart(ctx context.Context, hash string) (domain.FilePart, bool, error)
+	// PutPart records a just stored deduplicated part with a single reference. If the part got
+	// recorded concurrently, a reference to that one is taken instead and its location is returned.
+	PutPart(ctx context.Context, hash string, part domain.FilePart) (domain.FilePart, error)
+	// ReleasePart drops a reference to a deduplicated part and returns how many references remain.
+	// The part is forgotten once none remain.
+	ReleasePart(ctx context.Context, hash string) (int, error)
+
+	// ListFiles returns metadata of every complete file, ordered by name.
+	ListFiles(ctx context.Context) ([]domain.FileMeta, error)
+	// ListParts returns parts of every file, complete or not, and every deduplicated part.
+	// A part referenced by several files is listed once.
+	ListParts(ctx context.Context) ([]domain.FilePart, error)
+	// MovePart replaces location from with to in the part stored at path, in every complete file and
+	// deduplicated part referencing it. Checksum is a hex SHA-256 of the copy at to. It changes nothing and
+	// returns false if no such part is left, if a file still being uploaded references it, or if the part
+	// referenced has a checksum other than checksum, as it was replaced after it was copied.
+	MovePart(ctx context.Context, path, checksum, from, to string) (bool, error)
+
+	// Ping fails if the metadata can't be read or written at the moment.
+	Ping(ctx context.Context) error
 }
@@ -0,0 +1,7 @@
+package interfaces
+
+// KeyWrapper encrypts per-file data keys with a master key it never reveals.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
@@ -0,0 +1,10 @@
+package interfaces
+
+import "context"
+
+// PlacementPolicy decides which storages new parts go to.
+type PlacementPolicy interface {
+	// Rank orders candidates from the most to the least preferred. Key identifies what is placed,
+	// so that policies may place the same key the same way. Storages unfit for new parts may be left out.
+	Rank(ctx context.Context, key string, candidates []Storage) ([]Storage, error)
+}
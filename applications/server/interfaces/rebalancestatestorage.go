@@ -0,0 +1,14 @@
+package interfaces
+
+import (
+	"context"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// RebalanceStateStorage keeps rebalancing progress.
+type RebalanceStateStorage interface {
+	// GetRebalanceStatus returns the last saved status, or a zero one if nothing was saved yet.
+	GetRebalanceStatus(ctx context.Context) (domain.RebalanceStatus, error)
+	PutRebalanceStatus(ctx context.Context, status domain.RebalanceStatus) error
+}
@@ -3,6 +3,8 @@ package interfaces
 import (
 	"context"
 	"io"
+
+	"github.com/donmikel/karma8/applications/server/domain"
 )
 
 type Storage interface {
@@ -11,10 +13,25 @@ type Storage interface {
 	DeleteFilePart(ctx context.Context, path string) error
 	GetFreeSpace() (int, error)
 	GetStorageURL() string
+	// Ping checks that the storage is reachable and serving.
+	Ping(ctx context.Context) error
 }
 
 type StorageManager interface {
-	GetStorages(ctx context.Context, count int) ([]Storage, error)
+	// GetStorages picks storages for new parts of whatever key identifies: replicas storages
+	// in distinct zones for each of parts. Draining and unhealthy storages are never picked.
+	GetStorages(ctx context.Context, key string, parts, replicas int) ([][]Storage, error)
 	GetStorage(ctx context.Context, storageURL string) (Storage, error)
-	AddStorage(ctx context.Context, storageURL string, storage Storage) error
+	// ListStorages returns every storage in the order they were added.
+	ListStorages(ctx context.Context) ([]Storage, error)
+	GetStorageLabels(ctx context.Context, storageURL string) (domain.StorageLabels, error)
+	AddStorage(ctx context.Context, storageURL string, storage Storage, labels domain.StorageLabels) error
+	// DrainStorage stops new parts from being placed on the storage, so it can be emptied and removed.
+	DrainStorage(ctx context.Context, storageURL string) error
+	IsDraining(ctx context.Context, storageURL string) (bool, error)
+	// SetStorageHealth records the health of the storage. Storages are healthy when added.
+	SetStorageHealth(ctx context.Context, storageURL string, health domain.StorageHealth) error
+	GetStorageHealth(ctx context.Context, storageURL string) (domain.StorageHealth, error)
+	// RemoveStorage unregisters the storage. Parts still kept there become unreachable.
+	RemoveStorage(ctx context.Context, storageURL string) error
 }
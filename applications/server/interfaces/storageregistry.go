@@ -0,0 +1,21 @@
+package interfaces
+
+import (
+	"context"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// StorageConnector opens clients of registered storages.
+type StorageConnector interface {
+	Connect(ctx context.Context, registration domain.StorageRegistration) (Storage, error)
+}
+
+// RegistryStorage keeps registrations of storages, so they are known again after a restart.
+type RegistryStorage interface {
+	PutRegistration(ctx context.Context, registration domain.StorageRegistration) error
+	// GetRegistration returns false if no storage is registered under the URL.
+	GetRegistration(ctx context.Context, storageURL string) (domain.StorageRegistration, bool, error)
+	DeleteRegistration(ctx context.Context, storageURL string) error
+	ListRegistrations(ctx context.Context) ([]domain.StorageRegistration, error)
+}
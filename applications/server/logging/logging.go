@@ -0,0 +1,31 @@
+// Package logging carries request-scoped logging context, such as the request ID, from handlers down to storages.
+package logging
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the ID of the request it serves.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request ctx serves, or an empty string outside of requests.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// With returns logger adding the request ID of ctx to every record, or logger itself outside of requests.
+func With(ctx context.Context, logger log.Logger) log.Logger {
+	if id := RequestID(ctx); id != "" {
+		return log.With(logger, "request_id", id)
+	}
+
+	return logger
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/cache"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+// collectTimeout bounds how long a scrape waits for storages and metadata.
+const collectTimeout = 5 * time.Second
+
+var (
+	freeSpaceDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "storage", "free_bytes"),
+		"Free space of a storage.", []string{"storage"}, nil)
+	partsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "storage", "parts"),
+		"Part copies kept on a storage.", []string{"storage"}, nil)
+)
+
+// storageCollector reads free space and part counts of storages when metrics are scraped.
+type storageCollector struct {
+	storageManager  interfaces.StorageManager
+	fileMetaStorage interfaces.FileMetaStorage
+}
+
+// WatchStorages exports free space and part counts of every storage registered in storageManager.
+func (m *Metrics) WatchStorages(storageManager interfaces.StorageManager, fileMetaStorage interfaces.FileMetaStorage) {
+	m.registry.MustRegister(&storageCollector{
+		storageManager:  storageManager,
+		fileMetaStorage: fileMetaStorage,
+	})
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- freeSpaceDesc
+	ch <- partsDesc
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	storages, err := c.storageManager.ListStorages(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(freeSpaceDesc, err)
+		return
+	}
+
+	parts, err := c.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(partsDesc, err)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, part := range parts {
+		for _, url := range part.Locations() {
+			counts[url]++
+		}
+	}
+
+	for _, storage := range storages {
+		url := storage.GetStorageURL()
+		ch <- prometheus.MustNewConstMetric(partsDesc, prometheus.GaugeValue, float64(counts[url]), url)
+
+		// A storage failing to answer is left out rather than failing the whole scrape.
+		if free, err := storage.GetFreeSpace(); err == nil {
+			ch <- prometheus.MustNewConstMetric(freeSpaceDesc, prometheus.GaugeValue, float64(free), url)
+		}
+	}
+}
+
+var (
+	cacheRequestsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "requests_total"),
+		"Reads of parts looked up in the cache, by result: memory_hit, disk_hit or miss.", []string{"result"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "evictions_total"),
+		"Parts evicted from a tier of the cache to make room for others.", []string{"tier"}, nil)
+	cacheBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "bytes"),
+		"Bytes of parts kept in a tier of the cache.", []string{"tier"}, nil)
+)
+
+// cacheCollector reads counters of the part cache when metrics are scraped.
+type cacheCollector struct {
+	cache *cache.Cache
+}
+
+// WatchCache exports hits, misses, evictions and size of the part cache.
+func (m *Metrics) WatchCache(c *cache.Cache) {
+	m.registry.MustRegister(&cacheCollector{cache: c})
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheRequestsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheBytesDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(stats.MemoryHits), "memory_hit")
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(stats.DiskHits), "disk_hit")
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(stats.Misses), "miss")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.MemoryEvictions), "memory")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.DiskEvictions), "disk")
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.MemoryBytes), "memory")
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.DiskBytes), "disk")
+}
+
+var (
+	admissionUploadsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "admission", "uploads"),
+		"Uploads admitted and in progress.", nil, nil)
+	admissionBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "admission", "bytes"),
+		"Declared sizes of uploads admitted and in progress.", nil, nil)
+	admissionQueuedDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "admission", "queued"),
+		"Uploads waiting to be admitted.", nil, nil)
+	admissionRequestsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "admission", "requests_total"),
+		"Uploads that asked to be admitted, by result: admitted, queue_full or timed_out.", []string{"result"}, nil)
+)
+
+// admissionCollector reads the state of upload admission when metrics are scraped.
+type admissionCollector struct {
+	admission server.UploadAdmission
+}
+
+// WatchAdmission exports uploads in progress and waiting, and how many were admitted and turned away.
+func (m *Metrics) WatchAdmission(admission server.UploadAdmission) {
+	m.registry.MustRegister(&admissionCollector{admission: admission})
+}
+
+func (c *admissionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- admissionUploadsDesc
+	ch <- admissionBytesDesc
+	ch <- admissionQueuedDesc
+	ch <- admissionRequestsDesc
+}
+
+func (c *admissionCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.admission.Stats()
+
+	ch <- prometheus.MustNewConstMetric(admissionUploadsDesc, prometheus.GaugeValue, float64(stats.Uploads))
+	ch <- prometheus.MustNewConstMetric(admissionBytesDesc, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(admissionQueuedDesc, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(admissionRequestsDesc, prometheus.CounterValue, float64(stats.Admitted), "admitted")
+	ch <- prometheus.MustNewConstMetric(admissionRequestsDesc, prometheus.CounterValue, float64(stats.QueueFull), "queue_full")
+	ch <- prometheus.MustNewConstMetric(admissionRequestsDesc, prometheus.CounterValue, float64(stats.TimedOut), "timed_out")
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type fileMetaStorage struct {
+	next    interfaces.FileMetaStorage
+	metrics *Metrics
+}
+
+// NewFileMetaStorage returns next counting and timing its operations.
+func NewFileMetaStorage(next interfaces.FileMetaStorage, metrics *Metrics) interfaces.FileMetaStorage {
+	return &fileMetaStorage{
+		next:    next,
+		metrics: metrics,
+	}
+}
+
+func (s *fileMetaStorage) StartProcessingFileMeta(ctx context.Context, meta domain.FileMeta) (err error) {
+	defer s.observe("start_processing", time.Now(), &err)
+
+	return s.next.StartProcessingFileMeta(ctx, meta)
+}
+
+func (s *fileMetaStorage) CompleteFileMeta(ctx context.Context, meta domain.FileMeta) (err error) {
+	defer s.observe("complete", time.Now(), &err)
+
+	return s.next.CompleteFileMeta(ctx, meta)
+}
+
+func (s *fileMetaStorage) GetFileMeta(ctx context.Context, id string) (_ domain.FileMeta, err error) {
+	defer s.observe("get", time.Now(), &err)
+
+	return s.next.GetFileMeta(ctx, id)
+}
+
+func (s *fileMetaStorage) DeleteFileMeta(ctx context.Context, id string) (_ domain.FileMeta, err error) {
+	defer s.observe("delete", time.Now(), &err)
+
+	return s.next.DeleteFileMeta(ctx, id)
+}
+
+func (s *fileMetaStorage) AcquirePart(ctx context.Context, hash string) (_ domain.FilePart, _ bool, err error) {
+	defer s.observe("acquire_part", time.Now(), &err)
+
+	return s.next.AcquirePart(ctx, hash)
+}
+
+func (s *fileMetaStorage) PutPart(ctx context.Context, hash string, part domain.FilePart) (_ domain.FilePart, err error) {
+	defer s.observe("put_part", time.Now(), &err)
+
+	return s.next.PutPart(ctx, hash, part)
+}
+
+func (s *fileMetaStorage) ReleasePart(ctx context.Context, hash string) (_ int, err error) {
+	defer s.observe("release_part", time.Now(), &err)
+
+	return s.next.ReleasePart(ctx, hash)
+}
+
+func (s *fileMetaStorage) ListFiles(ctx context.Context) (_ []domain.FileMeta, err error) {
+	defer s.observe("list_files", time.Now(), &err)
+
+	return s.next.ListFiles(ctx)
+}
+
+func (s *fileMetaStorage) ListParts(ctx context.Context) (_ []domain.FilePart, err error) {
+	defer s.observe("list_parts", time.Now(), &err)
+
+	return s.next.ListParts(ctx)
+}
+
+func (s *fileMetaStorage) MovePart(ctx context.Context, path, checksum, from, to string) (_ bool, err error) {
+	defer s.observe("move_part", time.Now(), &err)
+
+	return s.next.MovePart(ctx, path, checksum, from, to)
+}
+
+func (s *fileMetaStorage) Ping(ctx context.Context) (err error) {
+	defer s.observe("ping", time.Now(), &err)
+
+	return s.next.Ping(ctx)
+}
+
+func (s *fileMetaStorage) observe(op string, started time.Time, err *error) {
+	s.metrics.metadataOps.WithLabelValues(op, result(*err)).Inc()
+	s.metrics.metadataDuration.WithLabelValues(op).Observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+type fileService struct {
+	next    server.FileService
+	metrics *Metrics
+}
+
+// NewFileService returns next counting bytes transferred, uploads in progress and failures.
+func NewFileService(next server.FileService, metrics *Metrics) server.FileService {
+	return &fileService{
+		next:    next,
+		metrics: metrics,
+	}
+}
+
+func (s *fileService) PutFile(ctx context.Context, file domain.File) error {
+	s.metrics.uploadsInProgress.Inc()
+	defer s.metrics.uploadsInProgress.Dec()
+
+	if file.Body != nil {
+		file.Body = &countingReadCloser{ReadCloser: file.Body, counter: s.metrics.uploadedBytes}
+	}
+
+	err := s.next.PutFile(ctx, file)
+	s.countError("put", err)
+
+	return err
+}
+
+func (s *fileService) GetFile(ctx context.Context, id string, acceptEncodings ...string) (domain.File, error) {
+	file, err := s.next.GetFile(ctx, id, acceptEncodings...)
+	s.countError("get", err)
+	if err != nil {
+		return file, err
+	}
+
+	file.Body = &countingReadCloser{ReadCloser: file.Body, counter: s.metrics.downloadedBytes}
+
+	return file, nil
+}
+
+func (s *fileService) GetFileRange(ctx context.Context, id string, rng domain.ByteRange) (domain.File, error) {
+	file, err := s.next.GetFileRange(ctx, id, rng)
+	s.countError("get", err)
+	if err != nil {
+		return file, err
+	}
+
+	file.Body = &countingReadCloser{ReadCloser: file.Body, counter: s.metrics.downloadedBytes}
+
+	return file, nil
+}
+
+func (s *fileService) DeleteFile(ctx context.Context, id string) error {
+	err := s.next.DeleteFile(ctx, id)
+	s.countError("delete", err)
+
+	return err
+}
+
+func (s *fileService) PlanPlacement(ctx context.Context, name string, size int64) ([]domain.PlannedPart, error) {
+	return s.next.PlanPlacement(ctx, name, size)
+}
+
+func (s *fileService) countError(op string, err error) {
+	if err != nil {
+		s.metrics.fileErrors.WithLabelValues(op, errorCause(err)).Inc()
+	}
+}
+
+// countingReadCloser adds bytes read through it to counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+
+	return n, err
+}
@@ -0,0 +1,175 @@
+// Package metrics exposes Prometheus metrics of the server, collected by decorators around its components.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+const namespace = "karma8"
+
+// Results of operations as they are labeled.
+const (
+	resultOK    = "ok"
+	resultError = "error"
+)
+
+// Metrics holds collectors shared by the decorators, and the registry they are exposed from.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	uploadedBytes     prometheus.Counter
+	downloadedBytes   prometheus.Counter
+	fileErrors        *prometheus.CounterVec
+	uploadsInProgress prometheus.Gauge
+	selections        *prometheus.CounterVec
+	storageOps        *prometheus.CounterVec
+	storageDuration   *prometheus.HistogramVec
+	metadataOps       *prometheus.CounterVec
+	metadataDuration  *prometheus.HistogramVec
+}
+
+// New returns metrics registered in a registry of their own, along with Go runtime and process metrics.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to serve HTTP requests by route and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"route", "method"}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "Bytes of file contents received.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes of file contents sent.",
+		}),
+		fileErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "file_errors_total",
+			Help:      "Failed file operations by operation and cause.",
+		}, []string{"op", "cause"}),
+		uploadsInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "uploads_in_progress",
+			Help:      "Files being uploaded.",
+		}),
+		selections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_selections_total",
+			Help:      "Times a storage was picked for a new part, placement dry runs included.",
+		}, []string{"storage"}),
+		storageOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_operations_total",
+			Help:      "Operations on storages by storage, operation and result.",
+		}, []string{"storage", "op", "result"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Time operations on storages take; reads are timed until the first byte.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"storage", "op"}),
+		metadataOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "metadata_operations_total",
+			Help:      "Operations on file metadata by operation and result.",
+		}, []string{"op", "result"}),
+		metadataDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "metadata_operation_duration_seconds",
+			Help:      "Time operations on file metadata take.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"op"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.uploadedBytes,
+		m.downloadedBytes,
+		m.fileErrors,
+		m.uploadsInProgress,
+		m.selections,
+		m.storageOps,
+		m.storageDuration,
+		m.metadataOps,
+		m.metadataDuration,
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served HTTP request. Route is a route template, so that paths with
+// file names don't make a series each.
+func (m *Metrics) ObserveRequest(route, method string, code int, elapsed time.Duration) {
+	m.requests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+// ObserveAbortedRequest records an HTTP request whose response was cut off. The status code it was sent with
+// doesn't tell how it ended, so it's counted under the "aborted" code instead.
+func (m *Metrics) ObserveAbortedRequest(route, method string, elapsed time.Duration) {
+	m.requests.WithLabelValues(route, method, "aborted").Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+
+	return resultOK
+}
+
+// errorCause tells failures apart coarsely enough to keep the number of series small.
+func errorCause(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, domain.ErrStorageNotFound):
+		return "storage_not_found"
+	case errors.Is(err, domain.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, domain.ErrNoSpace):
+		return "no_space"
+	case errors.Is(err, domain.ErrConflict):
+		return "conflict"
+	case errors.Is(err, domain.ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, domain.ErrInvalid):
+		return "invalid"
+	default:
+		return "internal"
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/placement"
+	"github.com/donmikel/karma8/applications/server/services"
+)
+
+func TestDecorators(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+
+	storageManager := NewStorageManager(inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree()), m)
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		require.NoError(t, storageManager.AddStorage(ctx, url, inmemory.NewStorage(url, log.NewNopLogger()), domain.StorageLabels{}))
+	}
+	fileMetaStorage := NewFileMetaStorage(inmemory.NewFileMetaStorage(), m)
+	m.WatchStorages(storageManager, fileMetaStorage)
+
+	svc := NewFileService(services.NewService(fileMetaStorage, storageManager), m)
+
+	data := bytes.Repeat([]byte("karma8"), 10000)
+	require.NoError(t, svc.PutFile(ctx, domain.File{
+		Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+		Body: io.NopCloser(bytes.NewReader(data)),
+	}))
+
+	file, err := svc.GetFile(ctx, "file")
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, file.Body)
+	require.NoError(t, err)
+	require.NoError(t, file.Body.Close())
+
+	_, err = svc.GetFile(ctx, "missing")
+	require.Error(t, err)
+
+	assert.Equal(t, float64(len(data)), testutil.ToFloat64(m.uploadedBytes))
+	assert.Equal(t, float64(len(data)), testutil.ToFloat64(m.downloadedBytes))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.uploadsInProgress))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.fileErrors.WithLabelValues("get", "not_found")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.metadataOps.WithLabelValues("complete", resultOK)))
+
+	meta, err := fileMetaStorage.GetFileMeta(ctx, "file")
+	require.NoError(t, err)
+
+	var selected, uploads float64
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		selected += testutil.ToFloat64(m.selections.WithLabelValues(url))
+		uploads += testutil.ToFloat64(m.storageOps.WithLabelValues(url, "upload", resultOK))
+	}
+	assert.Equal(t, float64(len(meta.Parts)), selected)
+	assert.Equal(t, float64(len(meta.Parts)), uploads)
+
+	// Free space and part counts are exported for every storage.
+	assert.Equal(t, 6, testutil.CollectAndCount(&storageCollector{
+		storageManager:  storageManager,
+		fileMetaStorage: fileMetaStorage,
+	}))
+
+	require.NoError(t, storageManager.RemoveStorage(ctx, "storage_0"))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.selections))
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type storage struct {
+	next    interfaces.Storage
+	metrics *Metrics
+}
+
+// NewStorage returns next counting and timing its operations.
+func NewStorage(next interfaces.Storage, metrics *Metrics) interfaces.Storage {
+	return &storage{
+		next:    next,
+		metrics: metrics,
+	}
+}
+
+func (s *storage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	started := time.Now()
+	err := s.next.UploadFilePart(ctx, path, body)
+	s.observe("upload", started, err)
+
+	return err
+}
+
+func (s *storage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	started := time.Now()
+	body, err := s.next.ReadFilePart(ctx, path)
+	s.observe("read", started, err)
+
+	return body, err
+}
+
+func (s *storage) DeleteFilePart(ctx context.Context, path string) error {
+	started := time.Now()
+	err := s.next.DeleteFilePart(ctx, path)
+	s.observe("delete", started, err)
+
+	return err
+}
+
+func (s *storage) GetFreeSpace() (int, error) {
+	started := time.Now()
+	free, err := s.next.GetFreeSpace()
+	s.observe("free_space", started, err)
+
+	return free, err
+}
+
+func (s *storage) GetStorageURL() string {
+	return s.next.GetStorageURL()
+}
+
+func (s *storage) Ping(ctx context.Context) error {
+	started := time.Now()
+	err := s.next.Ping(ctx)
+	s.observe("ping", started, err)
+
+	return err
+}
+
+func (s *storage) observe(op string, started time.Time, err error) {
+	url := s.next.GetStorageURL()
+	s.metrics.storageOps.WithLabelValues(url, op, result(err)).Inc()
+	s.metrics.storageDuration.WithLabelValues(url, op).Observe(time.Since(started).Seconds())
+}
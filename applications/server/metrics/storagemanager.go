@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type storageManager struct {
+	interfaces.StorageManager
+	metrics *Metrics
+}
+
+// NewStorageManager returns next counting how often each storage is picked for new parts.
+// Storages added through it are instrumented with NewStorage.
+func NewStorageManager(next interfaces.StorageManager, metrics *Metrics) interfaces.StorageManager {
+	return &storageManager{
+		StorageManager: next,
+		metrics:        metrics,
+	}
+}
+
+func (m *storageManager) GetStorages(ctx context.Context, key string, parts, replicas int) ([][]interfaces.Storage, error) {
+	storages, err := m.StorageManager.GetStorages(ctx, key, parts, replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range storages {
+		for _, storage := range part {
+			m.metrics.selections.WithLabelValues(storage.GetStorageURL()).Inc()
+		}
+	}
+
+	return storages, nil
+}
+
+func (m *storageManager) AddStorage(ctx context.Context, storageURL string, storage interfaces.Storage,
+	labels domain.StorageLabels) error {
+	return m.StorageManager.AddStorage(ctx, storageURL, NewStorage(storage, m.metrics), labels)
+}
+
+func (m *storageManager) RemoveStorage(ctx context.Context, storageURL string) error {
+	if err := m.StorageManager.RemoveStorage(ctx, storageURL); err != nil {
+		return err
+	}
+
+	// Series of a removed storage would otherwise be exported forever.
+	m.metrics.selections.DeleteLabelValues(storageURL)
+	m.metrics.storageOps.DeletePartialMatch(map[string]string{"storage": storageURL})
+	m.metrics.storageDuration.DeletePartialMatch(map[string]string{"storage": storageURL})
+
+	return nil
+}
@@ -0,0 +1,195 @@
+// Package placement contains built-in policies deciding which storages new parts go to.
+package placement
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+// Names of built-in policies as they are set in config.
+const (
+	MostFree       = "most_free"
+	WeightedRandom = "weighted_random"
+	Rendezvous     = "rendezvous"
+	RoundRobin     = "round_robin"
+)
+
+// New returns a built-in policy by its name.
+func New(name string) (interfaces.PlacementPolicy, error) {
+	switch name {
+	case MostFree, "":
+		return NewMostFree(), nil
+	case WeightedRandom:
+		return NewWeightedRandom(time.Now().UnixNano()), nil
+	case Rendezvous:
+		return NewRendezvous(), nil
+	case RoundRobin:
+		return NewRoundRobin(), nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q", name)
+	}
+}
+
+type storageSpace struct {
+	storage   interfaces.Storage
+	freeSpace int
+}
+
+// freeSpaces asks every candidate for its free space once. Storages that fail to answer are left out.
+func freeSpaces(candidates []interfaces.Storage) []storageSpace {
+	result := make([]storageSpace, 0, len(candidates))
+	for _, storage := range candidates {
+		free, err := storage.GetFreeSpace()
+		if err != nil {
+			continue
+		}
+
+		result = append(result, storageSpace{storage: storage, freeSpace: free})
+	}
+
+	return result
+}
+
+type mostFree struct{}
+
+// NewMostFree returns a policy picking storages with the most free space.
+func NewMostFree() interfaces.PlacementPolicy {
+	return mostFree{}
+}
+
+func (mostFree) Rank(_ context.Context, _ string, candidates []interfaces.Storage) ([]interfaces.Storage, error) {
+	spaces := freeSpaces(candidates)
+	sort.SliceStable(spaces, func(i, j int) bool {
+		return spaces[i].freeSpace > spaces[j].freeSpace
+	})
+
+	result := make([]interfaces.Storage, 0, len(spaces))
+	for _, s := range spaces {
+		result = append(result, s.storage)
+	}
+
+	return result, nil
+}
+
+type weightedRandom struct {
+	rnd *rand.Rand
+	m   sync.Mutex
+}
+
+// NewWeightedRandom returns a policy picking storages at random with odds proportional to their free space.
+// That spreads load over all storages while still filling emptier ones faster.
+func NewWeightedRandom(seed int64) interfaces.PlacementPolicy {
+	return &weightedRandom{
+		rnd: rand.New(rand.NewSource(seed)), // nolint:gosec // placement needs no cryptographic randomness
+	}
+}
+
+func (w *weightedRandom) Rank(_ context.Context, _ string, candidates []interfaces.Storage) ([]interfaces.Storage, error) {
+	spaces := freeSpaces(candidates)
+
+	var total int64
+	for _, s := range spaces {
+		total += int64(s.freeSpace)
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	result := make([]interfaces.Storage, 0, len(spaces))
+	for len(spaces) > 0 {
+		i := 0
+		if total > 0 {
+			pick := w.rnd.Int63n(total)
+			for ; i < len(spaces)-1; i++ {
+				pick -= int64(spaces[i].freeSpace)
+				if pick < 0 {
+					break
+				}
+			}
+		}
+
+		result = append(result, spaces[i].storage)
+		total -= int64(spaces[i].freeSpace)
+		spaces = append(spaces[:i], spaces[i+1:]...)
+	}
+
+	return result, nil
+}
+
+type rendezvous struct{}
+
+// NewRendezvous returns a policy using rendezvous (highest random weight) hashing of the key and the storage URL.
+// The same key lands on the same storages, and adding a storage only moves keys onto the new one.
+func NewRendezvous() interfaces.PlacementPolicy {
+	return rendezvous{}
+}
+
+func (rendezvous) Rank(_ context.Context, key string, candidates []interfaces.Storage) ([]interfaces.Storage, error) {
+	type scored struct {
+		storage interfaces.Storage
+		score   uint64
+	}
+
+	scores := make([]scored, 0, len(candidates))
+	for _, storage := range candidates {
+		scores = append(scores, scored{storage: storage, score: rendezvousScore(key, storage.GetStorageURL())})
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+
+	result := make([]interfaces.Storage, 0, len(scores))
+	for _, s := range scores {
+		result = append(result, s.storage)
+	}
+
+	return result, nil
+}
+
+func rendezvousScore(key, url string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(url))
+
+	// FNV alone leaves similar inputs with similar high bits; a finalizer spreads them.
+	z := h.Sum64()
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+	return z ^ (z >> 31)
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+// NewRoundRobin returns a policy cycling through storages in the order they were added:
+// each call ranks the storage after the previous call's first one first.
+func NewRoundRobin() interfaces.PlacementPolicy {
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Rank(_ context.Context, _ string, candidates []interfaces.Storage) ([]interfaces.Storage, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	start := atomic.AddUint64(&r.next, 1) - 1
+
+	result := make([]interfaces.Storage, 0, len(candidates))
+	for i := 0; i < len(candidates); i++ {
+		result = append(result, candidates[(start+uint64(i))%uint64(len(candidates))])
+	}
+
+	return result, nil
+}
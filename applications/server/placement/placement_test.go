@@ -0,0 +1,165 @@
+package placement
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type fakeStorage struct {
+	url       string
+	freeSpace int
+}
+
+func (f *fakeStorage) UploadFilePart(context.Context, string, io.Reader) error { return nil }
+
+func (f *fakeStorage) ReadFilePart(context.Context, string) (io.ReadCloser, error) { return nil, nil }
+
+func (f *fakeStorage) DeleteFilePart(context.Context, string) error { return nil }
+
+func (f *fakeStorage) GetFreeSpace() (int, error) { return f.freeSpace, nil }
+
+func (f *fakeStorage) GetStorageURL() string { return f.url }
+
+func (f *fakeStorage) Ping(context.Context) error { return nil }
+
+func newStorages(freeSpaces ...int) []interfaces.Storage {
+	result := make([]interfaces.Storage, 0, len(freeSpaces))
+	for i, free := range freeSpaces {
+		result = append(result, &fakeStorage{url: fmt.Sprintf("storage_%d", i), freeSpace: free})
+	}
+
+	return result
+}
+
+// distribution takes the count top ranked storages for n keys and returns how often each storage was picked.
+func distribution(t *testing.T, policy interfaces.PlacementPolicy, storages []interfaces.Storage, n, count int) map[string]int {
+	t.Helper()
+
+	result := map[string]int{}
+	for i := 0; i < n; i++ {
+		ranked, err := policy.Rank(context.Background(), fmt.Sprintf("file_%d", i), storages)
+		require.NoError(t, err)
+		require.Len(t, ranked, len(storages))
+
+		seen := map[string]bool{}
+		for _, s := range ranked[:count] {
+			require.False(t, seen[s.GetStorageURL()], "storage selected twice")
+			seen[s.GetStorageURL()] = true
+			result[s.GetStorageURL()]++
+		}
+	}
+
+	return result
+}
+
+func TestMostFree(t *testing.T) {
+	storages := newStorages(10, 50, 30, 40)
+
+	ranked, err := NewMostFree().Rank(context.Background(), "a", storages)
+	require.NoError(t, err)
+	assert.Equal(t, []interfaces.Storage{storages[1], storages[3], storages[2], storages[0]}, ranked)
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	storages := newStorages(100, 200, 300, 400)
+	got := distribution(t, NewWeightedRandom(1), storages, 20000, 1)
+
+	for i, want := range []float64{0.1, 0.2, 0.3, 0.4} {
+		assert.InDelta(t, want, float64(got[storages[i].GetStorageURL()])/20000, 0.02, "storage %d", i)
+	}
+}
+
+func TestRendezvousDistribution(t *testing.T) {
+	storages := newStorages(0, 0, 0, 0, 0, 0, 0, 0)
+	policy := NewRendezvous()
+
+	got := distribution(t, policy, storages, 20000, 3)
+	for _, s := range storages {
+		assert.InDelta(t, 3.0/8, float64(got[s.GetStorageURL()])/20000, 0.02, s.GetStorageURL())
+	}
+
+	// Placement is stable, and a new storage only takes keys over from others.
+	grown := append(newStorages(0, 0, 0, 0, 0, 0, 0, 0), &fakeStorage{url: "storage_new"})
+	var moved int
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		before, err := policy.Rank(context.Background(), key, storages)
+		require.NoError(t, err)
+		again, err := policy.Rank(context.Background(), key, storages)
+		require.NoError(t, err)
+		require.Equal(t, before[0].GetStorageURL(), again[0].GetStorageURL())
+
+		after, err := policy.Rank(context.Background(), key, grown)
+		require.NoError(t, err)
+		if after[0].GetStorageURL() != before[0].GetStorageURL() {
+			require.Equal(t, "storage_new", after[0].GetStorageURL())
+			moved++
+		}
+	}
+
+	assert.InDelta(t, 1.0/9, float64(moved)/20000, 0.02)
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	storages := newStorages(0, 0, 0, 0, 0)
+	got := distribution(t, NewRoundRobin(), storages, 1000, 2)
+
+	for _, s := range storages {
+		assert.Equal(t, 400, got[s.GetStorageURL()], s.GetStorageURL())
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"", MostFree, WeightedRandom, Rendezvous, RoundRobin} {
+		_, err := New(name)
+		assert.NoError(t, err, name)
+	}
+
+	_, err := New("emptiest")
+	assert.Error(t, err)
+}
+
+func TestSpread(t *testing.T) {
+	storages := newStorages(0, 0, 0, 0, 0, 0)
+	zones := map[string]string{
+		"storage_0": "a", "storage_1": "a", "storage_2": "b",
+		"storage_3": "b", "storage_4": "c", "storage_5": "c",
+	}
+	labels := func(url string) domain.StorageLabels { return domain.StorageLabels{Zone: zones[url]} }
+
+	result, err := Spread(storages, labels, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, result, 5)
+
+	used := map[string]int{}
+	for _, replicas := range result {
+		seen := map[string]bool{}
+		for _, s := range replicas {
+			zone := zones[s.GetStorageURL()]
+			assert.False(t, seen[zone], "replicas share zone %s", zone)
+			seen[zone] = true
+			used[s.GetStorageURL()]++
+		}
+	}
+
+	// 15 copies over 6 storages: nobody takes more than its share plus one.
+	for url, n := range used {
+		assert.LessOrEqual(t, n, 3, url)
+	}
+
+	_, err = Spread(storages, labels, 1, 4)
+	assert.Error(t, err)
+
+	// Without zone labels every storage is a zone of its own.
+	result, err = Spread(storages, func(string) domain.StorageLabels { return domain.StorageLabels{} }, 1, 6)
+	require.NoError(t, err)
+	assert.Len(t, result[0], 6)
+}
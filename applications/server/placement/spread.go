@@ -0,0 +1,72 @@
+package placement
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+// Spread assigns replicas storages to each of parts out of ranked storages, most preferred first.
+// Replicas of one part never share a zone; a storage without a zone label counts as a zone of its own.
+// Storages holding fewer parts of the file are preferred, so a single failure hits as few parts as possible.
+func Spread(ranked []interfaces.Storage, labels func(url string) domain.StorageLabels, parts, replicas int) ([][]interfaces.Storage, error) {
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	zones := make(map[string]string, len(ranked))
+	for _, s := range ranked {
+		url := s.GetStorageURL()
+		zones[url] = Zone(url, labels(url))
+	}
+
+	uses := make(map[string]int, len(ranked))
+	order := make([]interfaces.Storage, len(ranked))
+	result := make([][]interfaces.Storage, 0, parts)
+	for p := 0; p < parts; p++ {
+		copy(order, ranked)
+		sort.SliceStable(order, func(i, j int) bool {
+			return uses[order[i].GetStorageURL()] < uses[order[j].GetStorageURL()]
+		})
+
+		chosen := make([]interfaces.Storage, 0, replicas)
+		chosenZones := make(map[string]bool, replicas)
+		for _, s := range order {
+			if len(chosen) == replicas {
+				break
+			}
+
+			url := s.GetStorageURL()
+			if chosenZones[zones[url]] {
+				continue
+			}
+
+			chosen = append(chosen, s)
+			chosenZones[zones[url]] = true
+		}
+
+		if len(chosen) < replicas {
+			return nil, fmt.Errorf("%w: need %d zones for replicas, only %d available", domain.ErrUnavailable, replicas,
+				len(chosenZones))
+		}
+
+		for _, s := range chosen {
+			uses[s.GetStorageURL()]++
+		}
+
+		result = append(result, chosen)
+	}
+
+	return result, nil
+}
+
+// Zone returns the failure zone of the storage at url. A storage without a zone label is a zone of its own.
+func Zone(url string, labels domain.StorageLabels) string {
+	if labels.Zone != "" {
+		return labels.Zone
+	}
+
+	return "storage:" + url
+}
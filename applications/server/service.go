@@ -2,11 +2,111 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/donmikel/karma8/applications/server/domain"
 )
 
 type FileService interface {
 	PutFile(ctx context.Context, file domain.File) error
-	GetFile(ctx context.Context, id string) (domain.File, error)
+	GetFile(ctx context.Context, id string, acceptEncodings ...string) (domain.File, error)
+	// GetFileRange returns a file with a body holding only rng of its content, decompressed. It fails with
+	// a *domain.RangeError when rng starts past the end of the file.
+	GetFileRange(ctx context.Context, id string, rng domain.ByteRange) (domain.File, error)
+	DeleteFile(ctx context.Context, id string) error
+	// PlanPlacement shows where a file of the given size would be stored, without storing anything.
+	PlanPlacement(ctx context.Context, name string, size int64) ([]domain.PlannedPart, error)
+}
+
+type AuthService interface {
+	// CreateKey issues a new API key with the given grants. The returned secret is shown only once.
+	CreateKey(ctx context.Context, grants []domain.Grant) (domain.APIKey, string, error)
+	RevokeKey(ctx context.Context, id string) error
+	ListKeys(ctx context.Context) ([]domain.APIKey, error)
+	Authenticate(ctx context.Context, secret string) (domain.APIKey, error)
+}
+
+// URLSigner mints and checks presigned URLs granting one method on one file until the expiry.
+type URLSigner interface {
+	// Sign returns an expiry and a signature for a URL. A zero maxContentLength means no limit.
+	Sign(method, id string, expiresIn time.Duration, maxContentLength int64) (time.Time, string, error)
+	Verify(method, id string, expires time.Time, maxContentLength int64, signature string) error
+}
+
+// Rebalancer moves stored parts off draining storages, and from full storages to empty ones, in the background.
+type Rebalancer interface {
+	// Start launches a run. It fails with domain.ErrRebalanceRunning if a run is in progress.
+	Start(ctx context.Context) error
+	// Resume launches a run if the last one was interrupted by a restart, keeping its progress.
+	Resume(ctx context.Context) error
+	// Stop interrupts a run in progress and waits for it to return. A stopped run is not resumed.
+	Stop(ctx context.Context) error
+	Status(ctx context.Context) (domain.RebalanceStatus, error)
+	// Drain stops new placements on the storage and moves its parts elsewhere. The storage is
+	// unregistered once no part is left there.
+	Drain(ctx context.Context, storageURL string) error
+	DrainStatus(ctx context.Context, storageURL string) (domain.DrainStatus, error)
+	// SetThreshold changes the free space difference rebalancing stops at; a run in progress uses it for its next move.
+	SetThreshold(threshold int64)
+	// SetRateLimit changes how many bytes per second are copied, starting with the next part. Zero means no limit.
+	SetRateLimit(bytesPerSecond int64)
+}
+
+// HealthChecker probes storages and keeps their health up to date, so unhealthy ones take no new parts.
+type HealthChecker interface {
+	// Run probes storages periodically until ctx is done.
+	Run(ctx context.Context) error
+	// CheckAll probes every storage once.
+	CheckAll(ctx context.Context) error
+	Statuses(ctx context.Context) ([]domain.StorageStatus, error)
+}
+
+// Scrubber reads stored parts back to find damaged copies before users do, and repairs them from replicas.
+type Scrubber interface {
+	// Start launches a scrub. It fails with domain.ErrScrubRunning if a scrub is in progress.
+	Start(ctx context.Context) error
+	// Run scrubs periodically until ctx is done.
+	Run(ctx context.Context) error
+	// Report returns the progress and findings of the last scrub.
+	Report(ctx context.Context) (domain.ScrubReport, error)
+	// SetRateLimit changes how many bytes per second are read, starting with the next part. Zero means no limit.
+	SetRateLimit(bytesPerSecond int64)
+}
+
+// StorageRegistry adds storages at runtime, by operators or by storage nodes themselves, and remembers them across restarts.
+type StorageRegistry interface {
+	// Register adds a storage. Registering a storage again with the same type only refreshes its heartbeat.
+	Register(ctx context.Context, registration domain.StorageRegistration) (domain.StorageRegistration, error)
+	// Heartbeat tells that a self-registered node is alive. It fails with domain.ErrStorageNotFound for unknown nodes.
+	Heartbeat(ctx context.Context, storageURL string) error
+	// CheckHeartbeat fails if a self-registered node has been silent for too long.
+	CheckHeartbeat(ctx context.Context, storageURL string) error
+	List(ctx context.Context) ([]domain.StorageRegistration, error)
+	// VerifyNodeKey checks a key storage nodes register themselves with.
+	VerifyNodeKey(key string) error
+	// Restore adds storages registered before a restart.
+	Restore(ctx context.Context) error
+	// Run forgets storages removed from service until ctx is done.
+	Run(ctx context.Context) error
+}
+
+// UploadAdmission bounds uploads served at once, overall and per client, so a burst of them can't exhaust memory.
+type UploadAdmission interface {
+	// Admit waits for room for an upload of size bytes from client, and returns a func to call once it's done.
+	// It fails with a *domain.OverloadError when too many uploads wait already, or when no room is made in time.
+	Admit(ctx context.Context, client string, size int64) (release func(), err error)
+	Stats() domain.AdmissionStats
+	// SetLimits changes the limits uploads are admitted within. Uploads in progress are kept; waiting ones are
+	// admitted if the new limits make room for them.
+	SetLimits(limits domain.AdmissionLimits)
+}
+
+// StatusReporter tells orchestrators whether the server may take traffic, and operators what state it's in.
+type StatusReporter interface {
+	// Ready checks the metadata store and storages. The server is never ready once its shutdown began.
+	Ready(ctx context.Context) domain.Readiness
+	// Status returns readiness along with the state of every storage.
+	Status(ctx context.Context) (domain.ServerStatus, error)
+	// BeginShutdown makes the server report not ready, so it's taken out of rotation before it stops serving.
+	BeginShutdown()
 }
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+const (
+	defaultAdmissionQueueTimeout = 30 * time.Second
+	defaultAdmissionRetryAfter   = 5 * time.Second
+)
+
+type uploadAdmission struct {
+	// Zero limits mean no limit.
+	maxUploads       int
+	maxBytes         int64
+	clientMaxUploads int
+	clientMaxBytes   int64
+	queueSize        int
+	queueTimeout     time.Duration
+	retryAfter       time.Duration
+
+	m       sync.Mutex
+	uploads int
+	bytes   int64
+	clients map[string]*clientUploads
+	// queue holds *admissionTicket of uploads waiting for room, in the order they came.
+	queue *list.List
+	stats domain.AdmissionStats
+}
+
+// clientUploads are uploads of one client in progress.
+type clientUploads struct {
+	uploads int
+	bytes   int64
+}
+
+// admissionTicket is an upload admitted or waiting to be.
+type admissionTicket struct {
+	client string
+	size   int64
+	// weight and clientWeight are what the upload counts against the byte limits it was admitted within.
+	weight, clientWeight int64
+	// admitted is closed once the upload is admitted.
+	admitted chan struct{}
+}
+
+// AdmissionOption configures optional behaviour of upload admission.
+type AdmissionOption func(a *uploadAdmission)
+
+// WithUploadLimits caps uploads in progress, and their declared sizes in bytes. Zero means no limit.
+func WithUploadLimits(maxUploads int, maxBytes int64) AdmissionOption {
+	return func(a *uploadAdmission) {
+		a.maxUploads = maxUploads
+		a.maxBytes = maxBytes
+	}
+}
+
+// WithClientUploadLimits caps uploads in progress of a single client, and their declared sizes in bytes.
+// Zero means no limit.
+func WithClientUploadLimits(maxUploads int, maxBytes int64) AdmissionOption {
+	return func(a *uploadAdmission) {
+		a.clientMaxUploads = maxUploads
+		a.clientMaxBytes = maxBytes
+	}
+}
+
+// WithAdmissionQueue lets up to size uploads over the limits wait for room, for as long as timeout.
+// Uploads over the limits are turned away at once when size is zero.
+func WithAdmissionQueue(size int, timeout time.Duration) AdmissionOption {
+	return func(a *uploadAdmission) {
+		a.queueSize = size
+		if timeout > 0 {
+			a.queueTimeout = timeout
+		}
+	}
+}
+
+// WithRetryAfter sets how long uploads turned away are told to wait before trying again.
+func WithRetryAfter(retryAfter time.Duration) AdmissionOption {
+	return func(a *uploadAdmission) {
+		if retryAfter > 0 {
+			a.retryAfter = retryAfter
+		}
+	}
+}
+
+// NewUploadAdmission returns admission of uploads within the limits set by opts; uploads aren't limited without them.
+// An upload declaring more bytes than a limit allows is admitted once nothing else counts against that limit.
+func NewUploadAdmission(opts ...AdmissionOption) server.UploadAdmission {
+	a := &uploadAdmission{
+		queueTimeout: defaultAdmissionQueueTimeout,
+		retryAfter:   defaultAdmissionRetryAfter,
+		clients:      map[string]*clientUploads{},
+		queue:        list.New(),
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+func (a *uploadAdmission) Admit(ctx context.Context, client string, size int64) (func(), error) {
+	if size < 0 {
+		size = 0
+	}
+	t := &admissionTicket{client: client, size: size, admitted: make(chan struct{})}
+
+	a.m.Lock()
+	el := a.queue.PushBack(t)
+	a.dispatchLocked()
+	if a.isAdmitted(t) {
+		a.m.Unlock()
+		return a.releaseFunc(t), nil
+	}
+
+	// The upload itself is in the queue too.
+	if a.queue.Len() > a.queueSize {
+		a.queue.Remove(el)
+		a.stats.QueueFull++
+		a.m.Unlock()
+
+		return nil, &domain.OverloadError{Reason: "too many uploads in progress", RetryAfter: a.retryAfter}
+	}
+	queueTimeout, retryAfter := a.queueTimeout, a.retryAfter
+	a.m.Unlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-t.admitted:
+		return a.releaseFunc(t), nil
+	case <-timer.C:
+		err = &domain.OverloadError{Reason: "timed out waiting for uploads in progress", RetryAfter: retryAfter}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.isAdmitted(t) {
+		// Admitted while giving up, so the room is handed on to others.
+		a.releaseLocked(t)
+	} else {
+		a.queue.Remove(el)
+		// Uploads behind this one may fit now.
+		a.dispatchLocked()
+	}
+
+	if ctx.Err() == nil {
+		a.stats.TimedOut++
+	}
+
+	return nil, err
+}
+
+func (a *uploadAdmission) Stats() domain.AdmissionStats {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	stats := a.stats
+	stats.Uploads = a.uploads
+	stats.Bytes = a.bytes
+	stats.Queued = a.queue.Len()
+
+	return stats
+}
+
+func (a *uploadAdmission) SetLimits(limits domain.AdmissionLimits) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	WithUploadLimits(limits.MaxUploads, limits.MaxBytes)(a)
+	WithClientUploadLimits(limits.ClientMaxUploads, limits.ClientMaxBytes)(a)
+	WithAdmissionQueue(limits.QueueSize, limits.QueueTimeout)(a)
+	WithRetryAfter(limits.RetryAfter)(a)
+
+	a.dispatchLocked()
+}
+
+// dispatchLocked admits waiting uploads in order. An upload held back by the limits of its client only is passed
+// over, so a busy client doesn't hold up others. One held back by the overall limits holds up uploads behind it,
+// so small uploads don't starve big ones.
+func (a *uploadAdmission) dispatchLocked() {
+	for el := a.queue.Front(); el != nil; {
+		next := el.Next()
+		t := el.Value.(*admissionTicket)
+
+		if !a.clientFits(t) {
+			el = next
+			continue
+		}
+		if !a.fits(t) {
+			return
+		}
+
+		a.queue.Remove(el)
+		a.take(t)
+		close(t.admitted)
+
+		el = next
+	}
+}
+
+func (a *uploadAdmission) fits(t *admissionTicket) bool {
+	return (a.maxUploads == 0 || a.uploads < a.maxUploads) &&
+		(a.maxBytes == 0 || a.bytes+admissionWeight(t.size, a.maxBytes) <= a.maxBytes)
+}
+
+func (a *uploadAdmission) clientFits(t *admissionTicket) bool {
+	c, ok := a.clients[t.client]
+	if !ok {
+		return true
+	}
+
+	return (a.clientMaxUploads == 0 || c.uploads < a.clientMaxUploads) &&
+		(a.clientMaxBytes == 0 || c.bytes+admissionWeight(t.size, a.clientMaxBytes) <= a.clientMaxBytes)
+}
+
+func (a *uploadAdmission) take(t *admissionTicket) {
+	c, ok := a.clients[t.client]
+	if !ok {
+		c = &clientUploads{}
+		a.clients[t.client] = c
+	}
+
+	t.weight = admissionWeight(t.size, a.maxBytes)
+	t.clientWeight = admissionWeight(t.size, a.clientMaxBytes)
+	a.uploads++
+	a.bytes += t.weight
+	c.uploads++
+	c.bytes += t.clientWeight
+	a.stats.Admitted++
+}
+
+func (a *uploadAdmission) releaseFunc(t *admissionTicket) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.m.Lock()
+			defer a.m.Unlock()
+
+			a.releaseLocked(t)
+		})
+	}
+}
+
+func (a *uploadAdmission) releaseLocked(t *admissionTicket) {
+	c := a.clients[t.client]
+	a.uploads--
+	a.bytes -= t.weight
+	c.uploads--
+	c.bytes -= t.clientWeight
+	if c.uploads == 0 {
+		delete(a.clients, t.client)
+	}
+
+	a.dispatchLocked()
+}
+
+func (a *uploadAdmission) isAdmitted(t *admissionTicket) bool {
+	select {
+	case <-t.admitted:
+		return true
+	default:
+		return false
+	}
+}
+
+// admissionWeight is what an upload of size bytes counts against a limit of bytes. Uploads bigger than the limit
+// count as much as it, so they are admitted alone rather than never.
+func admissionWeight(size, limit int64) int64 {
+	if limit > 0 && size > limit {
+		return limit
+	}
+
+	return size
+}
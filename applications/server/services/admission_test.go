@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// admitAsync admits an upload in the background. Its release func is sent once it's admitted, or the error it
+// fails with.
+func admitAsync(ctx context.Context, admission server.UploadAdmission, client string,
+	size int64) (<-chan func(), <-chan error) {
+	admitted := make(chan func(), 1)
+	failed := make(chan error, 1)
+	go func() {
+		release, err := admission.Admit(ctx, client, size)
+		if err != nil {
+			failed <- err
+			return
+		}
+		admitted <- release
+	}()
+
+	return admitted, failed
+}
+
+func waitQueued(t *testing.T, admission server.UploadAdmission, queued int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool { return admission.Stats().Queued == queued }, time.Second, time.Millisecond)
+}
+
+func TestUploadAdmission(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("queued in order", func(t *testing.T) {
+		admission := NewUploadAdmission(WithUploadLimits(2, 100), WithAdmissionQueue(2, time.Second))
+
+		first, err := admission.Admit(ctx, "a", 60)
+		require.NoError(t, err)
+		second, err := admission.Admit(ctx, "b", 30)
+		require.NoError(t, err)
+
+		// Over the byte limit, so it waits, and so does the small one behind it rather than jumping the queue.
+		big, _ := admitAsync(ctx, admission, "c", 50)
+		waitQueued(t, admission, 1)
+		small, _ := admitAsync(ctx, admission, "d", 1)
+		waitQueued(t, admission, 2)
+
+		// The queue is full.
+		_, err = admission.Admit(ctx, "e", 1)
+		var overload *domain.OverloadError
+		require.ErrorAs(t, err, &overload)
+		assert.ErrorIs(t, err, domain.ErrUnavailable)
+		assert.Equal(t, defaultAdmissionRetryAfter, overload.RetryAfter)
+
+		first()
+		release := <-big
+		release()
+		(<-small)()
+		second()
+		// Releasing twice changes nothing.
+		second()
+
+		assert.Equal(t, domain.AdmissionStats{Admitted: 4, QueueFull: 1}, admission.Stats())
+	})
+
+	t.Run("client limits", func(t *testing.T) {
+		admission := NewUploadAdmission(WithClientUploadLimits(1, 0), WithAdmissionQueue(10, time.Second))
+
+		release, err := admission.Admit(ctx, "busy", 10)
+		require.NoError(t, err)
+		busy, _ := admitAsync(ctx, admission, "busy", 10)
+		waitQueued(t, admission, 1)
+
+		// A client at its limit doesn't hold up others.
+		other, err := admission.Admit(ctx, "other", 10)
+		require.NoError(t, err)
+		other()
+
+		release()
+		(<-busy)()
+	})
+
+	t.Run("bigger than the limit", func(t *testing.T) {
+		admission := NewUploadAdmission(WithUploadLimits(0, 100), WithAdmissionQueue(1, time.Second))
+
+		small, err := admission.Admit(ctx, "a", 1)
+		require.NoError(t, err)
+		big, _ := admitAsync(ctx, admission, "b", 1000)
+		waitQueued(t, admission, 1)
+
+		small()
+		release := <-big
+		assert.Equal(t, int64(100), admission.Stats().Bytes)
+		release()
+	})
+
+	t.Run("gave up waiting", func(t *testing.T) {
+		admission := NewUploadAdmission(WithUploadLimits(1, 0), WithAdmissionQueue(2, 20*time.Millisecond))
+
+		release, err := admission.Admit(ctx, "a", 0)
+		require.NoError(t, err)
+		defer release()
+
+		_, err = admission.Admit(ctx, "b", 0)
+		assert.ErrorIs(t, err, domain.ErrOverloaded)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		_, failed := admitAsync(cancelled, admission, "c", 0)
+		waitQueued(t, admission, 1)
+		cancel()
+		assert.ErrorIs(t, <-failed, context.Canceled)
+
+		assert.Equal(t, domain.AdmissionStats{Uploads: 1, Admitted: 1, TimedOut: 1}, admission.Stats())
+	})
+	t.Run("limits changed", func(t *testing.T) {
+		admission := NewUploadAdmission(WithUploadLimits(1, 100), WithAdmissionQueue(2, time.Second))
+
+		first, err := admission.Admit(ctx, "a", 150)
+		require.NoError(t, err)
+		waiting, _ := admitAsync(ctx, admission, "b", 50)
+		waitQueued(t, admission, 1)
+
+		// Raised limits admit the waiting upload at once.
+		admission.SetLimits(domain.AdmissionLimits{MaxUploads: 2, MaxBytes: 200, QueueSize: 2, QueueTimeout: time.Second})
+		second := <-waiting
+		assert.Equal(t, int64(150), admission.Stats().Bytes)
+
+		// Uploads in progress are released as much as they counted when admitted.
+		admission.SetLimits(domain.AdmissionLimits{MaxBytes: 50})
+		first()
+		second()
+		assert.Equal(t, domain.AdmissionStats{Admitted: 2}, admission.Stats())
+
+		_, err = admission.Admit(ctx, "c", 10)
+		require.NoError(t, err)
+		_, err = admission.Admit(ctx, "d", 60)
+		assert.ErrorIs(t, err, domain.ErrOverloaded)
+	})
+}
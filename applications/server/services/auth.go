@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+const (
+	keyIDSizeInBytes     = 8
+	keySecretSizeInBytes = 32
+)
+
+type authService struct {
+	keyStorage interfaces.APIKeyStorage
+}
+
+func NewAuthService(keyStorage interfaces.APIKeyStorage) server.AuthService {
+	return &authService{
+		keyStorage: keyStorage,
+	}
+}
+
+// HashAPIKey returns the form an API key secret is kept in by APIKeyStorage.
+// Secrets are long random strings, so a plain SHA-256 is enough and keeps lookups cheap.
+func HashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *authService) CreateKey(ctx context.Context, grants []domain.Grant) (domain.APIKey, string, error) {
+	if len(grants) == 0 {
+		return domain.APIKey{}, "", fmt.Errorf("%w: at least one grant is required", domain.ErrInvalid)
+	}
+
+	for _, g := range grants {
+		if g.Bucket == "" {
+			return domain.APIKey{}, "", fmt.Errorf("%w: grant bucket is empty", domain.ErrInvalid)
+		}
+
+		for _, scope := range g.Scopes {
+			if !scope.Valid() {
+				return domain.APIKey{}, "", fmt.Errorf("%w: unknown scope %q", domain.ErrInvalid, scope)
+			}
+		}
+	}
+
+	id, err := randomBytes(keyIDSizeInBytes)
+	if err != nil {
+		return domain.APIKey{}, "", fmt.Errorf("can't generate key id: %w", err)
+	}
+
+	secretBytes, err := randomBytes(keySecretSizeInBytes)
+	if err != nil {
+		return domain.APIKey{}, "", fmt.Errorf("can't generate key secret: %w", err)
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	key := domain.APIKey{
+		ID:        hex.EncodeToString(id),
+		Hash:      HashAPIKey(secret),
+		Grants:    grants,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err = s.keyStorage.PutKey(ctx, key); err != nil {
+		return domain.APIKey{}, "", fmt.Errorf("can't put key: %w", err)
+	}
+
+	return key, secret, nil
+}
+
+func (s *authService) RevokeKey(ctx context.Context, id string) error {
+	if err := s.keyStorage.DeleteKey(ctx, id); err != nil {
+		return fmt.Errorf("can't delete key: %w", err)
+	}
+
+	return nil
+}
+
+func (s *authService) ListKeys(ctx context.Context) ([]domain.APIKey, error) {
+	keys, err := s.keyStorage.ListKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't list keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (s *authService) Authenticate(ctx context.Context, secret string) (domain.APIKey, error) {
+	if secret == "" {
+		return domain.APIKey{}, fmt.Errorf("empty API key")
+	}
+
+	key, err := s.keyStorage.GetKeyByHash(ctx, HashAPIKey(secret))
+	if err != nil {
+		return domain.APIKey{}, fmt.Errorf("invalid API key: %w", err)
+	}
+
+	return key, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
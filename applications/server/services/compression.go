@@ -0,0 +1,150 @@
+package services
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// defaultIncompressibleTypes lists content types that are compressed already and don't shrink further.
+// Entries ending with "/*" match a whole top-level type.
+func defaultIncompressibleTypes() []string {
+	return []string{
+		"image/*",
+		"video/*",
+		"audio/*",
+		"application/gzip",
+		"application/x-gzip",
+		"application/zstd",
+		"application/zip",
+		"application/x-7z-compressed",
+		"application/x-bzip2",
+		"application/x-xz",
+		"application/x-rar-compressed",
+		"application/vnd.rar",
+		"font/woff2",
+	}
+}
+
+// compressionPolicy decides which codec a file is compressed with.
+type compressionPolicy struct {
+	codec     string
+	skipTypes []string
+}
+
+// codecFor returns a codec for a file of the given content type.
+func (p compressionPolicy) codecFor(contentType string) string {
+	if p.codec == domain.CodecNone {
+		return domain.CodecNone
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	for _, skip := range p.skipTypes {
+		skip = strings.ToLower(skip)
+		if mediaType == skip || strings.HasSuffix(skip, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(skip, "*")) {
+			return domain.CodecNone
+		}
+	}
+
+	return p.codec
+}
+
+func validCodec(codec string) bool {
+	switch codec {
+	case domain.CodecNone, domain.CodecGzip, domain.CodecZstd:
+		return true
+	}
+
+	return false
+}
+
+func newCompressor(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case domain.CodecGzip:
+		return gzip.NewWriter(w), nil
+	case domain.CodecZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// newCompressingReader returns a reader of src compressed with codec. Compression runs in a goroutine
+// that stops once the source is drained or the returned reader is closed.
+func newCompressingReader(src io.Reader, codec string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		compressor, err := newCompressor(pw, codec)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err = io.Copy(compressor, src); err != nil {
+			compressor.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(compressor.Close())
+	}()
+
+	return pr
+}
+
+type decompressingReader struct {
+	io.Reader
+	closeDecoder func()
+	src          io.Closer
+}
+
+// newDecompressingReader returns a reader of src decompressed with codec.
+func newDecompressingReader(src io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case domain.CodecGzip:
+		r, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("can't create gzip reader: %w", err)
+		}
+
+		return &decompressingReader{Reader: r, closeDecoder: func() { r.Close() }, src: src}, nil
+	case domain.CodecZstd:
+		r, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("can't create zstd reader: %w", err)
+		}
+
+		return &decompressingReader{Reader: r, closeDecoder: r.Close, src: src}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+func (d *decompressingReader) Close() error {
+	d.closeDecoder()
+	return d.src.Close()
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
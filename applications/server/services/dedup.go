@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+// Ways to split files into deduplicated parts.
+const (
+	// ChunkingFixed splits files into parts of the same size, so identical content is split the same way
+	// whatever size is announced for it.
+	ChunkingFixed = "fixed"
+	// ChunkingCDC splits files at content-defined boundaries, so an insertion only changes nearby parts.
+	ChunkingCDC = "cdc"
+)
+
+const (
+	defaultDedupChunkSize = 1024 * 1024 // 1 MB
+	minCDCAvgChunkSize    = 4 * 1024    // 4 kB
+	// dedupPathPrefix is prepended to the content hash to get a path of a deduplicated part.
+	dedupPathPrefix = "sha256/"
+)
+
+type dedupPolicy struct {
+	enabled  bool
+	chunking string
+	// chunkSize is the size of parts with fixed chunking, and their average size with content-defined chunking.
+	chunkSize int
+}
+
+// hashLocks are mutexes of deduplicated parts, created while anyone holds or waits for them.
+type hashLocks struct {
+	m     sync.Mutex
+	locks map[string]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	users int
+}
+
+func newHashLocks() *hashLocks {
+	return &hashLocks{locks: map[string]*hashLock{}}
+}
+
+// lock locks the part with hash and returns a func unlocking it.
+func (l *hashLocks) lock(hash string) func() {
+	l.m.Lock()
+	lock, ok := l.locks[hash]
+	if !ok {
+		lock = &hashLock{}
+		l.locks[hash] = lock
+	}
+	lock.users++
+	l.m.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.m.Lock()
+		defer l.m.Unlock()
+
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, hash)
+		}
+	}
+}
+
+// chunker splits a stream into parts. It returns io.EOF once the stream is drained.
+type chunker interface {
+	next() ([]byte, error)
+}
+
+// fixedChunker cuts parts of size bytes, and a shorter last one.
+type fixedChunker struct {
+	r    io.Reader
+	size int
+	done bool
+}
+
+func (c *fixedChunker) next() ([]byte, error) {
+	if c.done {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, c.size)
+	n, err := io.ReadFull(c.r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.done = true
+		if n == 0 {
+			return nil, io.EOF
+		}
+
+		return buf[:n], nil
+	}
+
+	return buf, err
+}
+
+// cdcChunker cuts parts where a gear rolling hash of the last 64 bytes has its top bits zeroed,
+// keeping part sizes between a quarter and four times the average.
+type cdcChunker struct {
+	r        *bufio.Reader
+	min, max int
+	mask     uint64
+	gear     [256]uint64
+}
+
+func newCDCChunker(r io.Reader, avgChunkSize int) *cdcChunker {
+	c := &cdcChunker{
+		r:   bufio.NewReaderSize(r, 64*1024),
+		min: avgChunkSize / 4,
+		max: avgChunkSize * 4,
+	}
+
+	// Boundaries are expected every 2^maskBits bytes past the minimum size.
+	maskBits := bits.Len(uint(avgChunkSize-c.min)) - 1
+	c.mask = (uint64(1)<<maskBits - 1) << (64 - maskBits)
+
+	// The gear table must be the same in every process, or identical content would be cut differently.
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range c.gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		c.gear[i] = z ^ (z >> 31)
+	}
+
+	return c
+}
+
+func (c *cdcChunker) next() ([]byte, error) {
+	buf := make([]byte, 0, c.min*2)
+
+	var hash uint64
+	for {
+		b, err := c.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, b)
+		hash = hash<<1 + c.gear[b]
+
+		if len(buf) >= c.min && hash&c.mask == 0 || len(buf) >= c.max {
+			return buf, nil
+		}
+	}
+}
+
+func (s *service) newChunker(file domain.File) chunker {
+	if s.dedup.chunking == ChunkingCDC {
+		return newCDCChunker(file.Body, s.dedup.chunkSize)
+	}
+
+	return &fixedChunker{r: file.Body, size: s.dedup.chunkSize}
+}
+
+// putFileDeduplicated stores each part under its content hash, uploading only parts no file has yet.
+func (s *service) putFileDeduplicated(ctx context.Context, file domain.File) error {
+	if s.keyWrapper != nil {
+		return fmt.Errorf("deduplication can't be combined with encryption")
+	}
+
+	previous, hadPrevious := s.previousFileMeta(ctx, file.Meta.Name)
+	codec := s.compression.codecFor(file.Meta.ContentType)
+	if !validCodec(codec) {
+		return fmt.Errorf("unknown compression codec %q", codec)
+	}
+
+	chunks := s.newChunker(file)
+
+	var (
+		parts []domain.FilePart
+		total int64
+	)
+	for {
+		data, err := chunks.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			s.releaseParts(ctx, parts, nil)
+			return fmt.Errorf("can't read file part: %w", err)
+		}
+
+		part, err := s.putDeduplicatedPart(ctx, data, codec)
+		if err != nil {
+			s.releaseParts(ctx, parts, nil)
+			return err
+		}
+
+		parts = append(parts, part)
+		total += int64(len(data))
+	}
+
+	file.Meta.Parts = parts
+	file.Meta.ContentLength = total
+
+	// The previous version stays readable until every part of this one is stored, as the parts are referenced
+	// meanwhile and can't go anywhere.
+	if err := s.fileMetaStorage.StartProcessingFileMeta(ctx, file.Meta); err != nil {
+		s.releaseParts(ctx, parts, nil)
+		return fmt.Errorf("can't put starting file meta: %w", err)
+	}
+
+	if err := s.fileMetaStorage.CompleteFileMeta(ctx, file.Meta); err != nil {
+		s.releaseParts(ctx, parts, nil)
+		// The previous version was replaced already, so nothing refers to its parts anymore.
+		if hadPrevious {
+			s.releaseParts(ctx, previous.Parts, nil)
+		}
+
+		return fmt.Errorf("can't complete file meta: %w", err)
+	}
+
+	if hadPrevious {
+		if err := s.releaseParts(ctx, previous.Parts, parts); err != nil {
+			return fmt.Errorf("can't release replaced file parts: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// putDeduplicatedPart references a stored part with the same content, or stores data as a new part.
+func (s *service) putDeduplicatedPart(ctx context.Context, data []byte, codec string) (domain.FilePart, error) {
+	stored := data
+	if codec != domain.CodecNone {
+		var buf bytes.Buffer
+		compressor, err := newCompressor(&buf, codec)
+		if err != nil {
+			return domain.FilePart{}, err
+		}
+
+		if _, err = compressor.Write(data); err != nil {
+			return domain.FilePart{}, fmt.Errorf("can't compress part: %w", err)
+		}
+
+		if err = compressor.Close(); err != nil {
+			return domain.FilePart{}, fmt.Errorf("can't compress part: %w", err)
+		}
+
+		stored = buf.Bytes()
+	}
+
+	sum := sha256.Sum256(stored)
+	hash := hex.EncodeToString(sum[:])
+
+	unlock := s.partLocks.lock(hash)
+	defer unlock()
+
+	existing, found, err := s.fileMetaStorage.AcquirePart(ctx, hash)
+	if err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't acquire part: %w", err)
+	}
+
+	if found {
+		return existing, nil
+	}
+
+	storages, err := s.storageManager.GetStorages(ctx, hash, 1, s.replicas)
+	if err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't get storages error: %w", err)
+	}
+
+	part := s.getFileParts(storages, domain.FileMeta{}, "", []int64{int64(len(data))}, codec)[0]
+	part.Path = dedupPathPrefix + hash
+	part.CompressedLength = int64(len(stored))
+	part.Hash = hash
+	part.Checksum = hash
+
+	uploaded, err := s.uploadWithFailover(ctx, hash, storages[0], part.Path, memoryBody{bytes.NewReader(stored)})
+	if err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't upload file part: %w", err)
+	}
+	setLocations(&part, uploaded)
+
+	recorded, err := s.fileMetaStorage.PutPart(ctx, hash, part)
+	if err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't put part: %w", err)
+	}
+
+	// Another upload stored the same part meanwhile; copies of ours it doesn't share are spare.
+	if err = s.deleteReplicated(ctx, part, []domain.FilePart{recorded}); err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't delete duplicate part: %w", err)
+	}
+
+	return recorded, nil
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+func usedSpace(t *testing.T, storageManager interfaces.StorageManager) int {
+	t.Helper()
+
+	storages, err := storageManager.ListStorages(context.Background())
+	require.NoError(t, err)
+
+	var used int
+	for _, storage := range storages {
+		free, err := storage.GetFreeSpace()
+		require.NoError(t, err)
+		used += 100*1024*1024 - free
+	}
+
+	return used
+}
+
+func TestServiceDeduplication(t *testing.T) {
+	data := make([]byte, 200*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	for _, chunking := range []string{ChunkingFixed, ChunkingCDC} {
+		t.Run(chunking, func(t *testing.T) {
+			storageManager := newTestStorageManager(t, 5)
+			svc := NewService(inmemory.NewFileMetaStorage(), storageManager, WithDeduplication(chunking, 16*1024))
+
+			assert.Equal(t, data, putAndGet(t, svc, "a", data))
+			used := usedSpace(t, storageManager)
+			assert.Equal(t, len(data), used)
+
+			assert.Equal(t, data, putAndGet(t, svc, "b", data))
+			assert.Equal(t, used, usedSpace(t, storageManager))
+
+			require.NoError(t, svc.DeleteFile(context.Background(), "a"))
+			assert.Equal(t, used, usedSpace(t, storageManager))
+
+			file, err := svc.GetFile(context.Background(), "b")
+			require.NoError(t, err)
+			got, err := io.ReadAll(file.Body)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			require.NoError(t, svc.DeleteFile(context.Background(), "b"))
+			assert.Equal(t, 0, usedSpace(t, storageManager))
+		})
+	}
+}
+
+func TestServiceDeduplicationAnnouncedLength(t *testing.T) {
+	data := make([]byte, 200*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	storageManager := newTestStorageManager(t, 5)
+	svc := NewService(inmemory.NewFileMetaStorage(), storageManager, WithDeduplication(ChunkingFixed, 16*1024))
+
+	// Uploads announce an upper bound of their size, like that of a form the file is sent in, which differs
+	// with the name of the file.
+	put := func(name string, announced int) {
+		require.NoError(t, svc.PutFile(context.Background(), domain.File{
+			Meta: domain.FileMeta{Name: name, ContentLength: int64(announced)},
+			Body: io.NopCloser(bytes.NewReader(data)),
+		}))
+	}
+
+	put("a", len(data)+180)
+	used := usedSpace(t, storageManager)
+	assert.Equal(t, len(data), used)
+
+	put("a-much-longer-name", len(data)+197)
+	assert.Equal(t, used, usedSpace(t, storageManager))
+}
+
+func TestServiceDeduplicationFailedOverwrite(t *testing.T) {
+	ctx := context.Background()
+	storageManager := newTestStorageManager(t, 3)
+	svc := NewService(inmemory.NewFileMetaStorage(), storageManager, WithDeduplication(ChunkingFixed, 0))
+
+	old := make([]byte, 100*1024)
+	_, err := rand.Read(old)
+	require.NoError(t, err)
+	assert.Equal(t, old, putAndGet(t, svc, "file", old))
+	used := usedSpace(t, storageManager)
+
+	// The new version breaks off after some of its parts are stored.
+	err = svc.PutFile(ctx, domain.File{
+		Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(old))},
+		Body: io.NopCloser(io.MultiReader(io.LimitReader(rand.Reader, 50*1024),
+			&failingReader{err: errors.New("connection reset")})),
+	})
+	require.Error(t, err)
+
+	// The old version is still there, and nothing of the new one is left behind.
+	file, err := svc.GetFile(ctx, "file")
+	require.NoError(t, err)
+	got, err := io.ReadAll(file.Body)
+	require.NoError(t, file.Body.Close())
+	require.NoError(t, err)
+	assert.Equal(t, old, got)
+	assert.Equal(t, used, usedSpace(t, storageManager))
+
+	require.NoError(t, svc.DeleteFile(ctx, "file"))
+	assert.Equal(t, 0, usedSpace(t, storageManager))
+}
+
+// slowDeleteStorage takes a while to delete parts, so uploads have time to race deletes. It tells on deleting
+// that a delete began, unless it was told already.
+type slowDeleteStorage struct {
+	interfaces.Storage
+	deleting chan struct{}
+}
+
+func (s *slowDeleteStorage) DeleteFilePart(ctx context.Context, path string) error {
+	select {
+	case s.deleting <- struct{}{}:
+	default:
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	return s.Storage.DeleteFilePart(ctx, path)
+}
+
+func TestServiceDeduplicationConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+	deleting := make(chan struct{}, 1)
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	// With a single storage, parts stored again land where their old copies are being deleted.
+	storage := &slowDeleteStorage{Storage: inmemory.NewStorage("storage_0", log.NewNopLogger()), deleting: deleting}
+	require.NoError(t, storageManager.AddStorage(ctx, "storage_0", storage, domain.StorageLabels{}))
+	svc := NewService(inmemory.NewFileMetaStorage(), storageManager, WithDeduplication(ChunkingFixed, 0))
+
+	data := make([]byte, 50*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	put := func(name string) error {
+		return svc.PutFile(ctx, domain.File{
+			Meta: domain.FileMeta{Name: name, ContentLength: int64(len(data))},
+			Body: io.NopCloser(bytes.NewReader(data)),
+		})
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, put("a"))
+		select {
+		case <-deleting:
+		default:
+		}
+
+		// The parts of a are being deleted as nothing refers to them anymore, while b stores the same parts.
+		errs := make(chan error, 2)
+		go func() { errs <- svc.DeleteFile(ctx, "a") }()
+		go func() {
+			<-deleting
+			errs <- put("b")
+		}()
+		require.NoError(t, <-errs)
+		require.NoError(t, <-errs)
+
+		file, err := svc.GetFile(ctx, "b")
+		require.NoError(t, err)
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, file.Body.Close())
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+
+		require.NoError(t, svc.DeleteFile(ctx, "b"))
+	}
+
+	assert.Equal(t, 0, usedSpace(t, storageManager))
+}
+
+func TestCDCChunkerResynchronizes(t *testing.T) {
+	data := make([]byte, 512*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	chunks := func(b []byte) map[string]bool {
+		result := map[string]bool{}
+		c := newCDCChunker(bytes.NewReader(b), 16*1024)
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				return result
+			}
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(chunk), 64*1024)
+			result[string(chunk)] = true
+		}
+	}
+
+	original := chunks(data)
+	shifted := chunks(append([]byte("inserted prefix"), data...))
+
+	var shared int
+	for chunk := range shifted {
+		if original[chunk] {
+			shared++
+		}
+	}
+
+	assert.Greater(t, len(original), 8)
+	assert.GreaterOrEqual(t, shared, len(original)-2)
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// readLocations resolves storages keeping the part to read it from, storages not known to be down first.
+// Locations no longer registered are skipped; a part none of whose locations are left can't be read.
+func (s *service) readLocations(ctx context.Context, part domain.FilePart) ([]interfaces.Storage, error) {
+	var up, down []interfaces.Storage
+	for _, url := range part.Locations() {
+		storage, err := s.storageManager.GetStorage(ctx, url)
+		if err != nil {
+			continue
+		}
+
+		if health, err := s.storageManager.GetStorageHealth(ctx, url); err == nil && health == domain.HealthDown {
+			down = append(down, storage)
+			continue
+		}
+
+		up = append(up, storage)
+	}
+
+	if len(up)+len(down) == 0 {
+		// Metadata pointing at storages no longer there is a fault of the server, not a file that's missing.
+		return nil, fmt.Errorf("%w: no storage keeping part %s is registered", domain.ErrUnavailable, part.Path)
+	}
+
+	return append(up, down...), nil
+}
+
+// partSource reads stored bytes of a part, moving on to the next copy when the storage it reads from fails.
+// Copies are identical, so a read interrupted midway resumes at the same offset of another copy.
+type partSource struct {
+	ctx      context.Context
+	path     string
+	storages []interfaces.Storage
+	// size is how many bytes a copy holds; a copy ending before that is truncated.
+	size   int64
+	logger log.Logger
+
+	next    int
+	body    io.ReadCloser
+	offset  int64
+	lastErr error
+}
+
+// open starts reading the next copy that can be read, from the current offset.
+func (p *partSource) open() error {
+	for p.next < len(p.storages) {
+		storage := p.storages[p.next]
+		p.next++
+
+		body, err := storage.ReadFilePart(p.ctx, p.path)
+		if err == nil && p.offset > 0 {
+			if _, err = io.CopyN(io.Discard, body, p.offset); err != nil {
+				body.Close()
+			}
+		}
+
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return p.ctx.Err()
+			}
+
+			p.fail(storage.GetStorageURL(), err)
+			continue
+		}
+
+		p.body = body
+		return nil
+	}
+
+	return fmt.Errorf("%w: no copy of part %s could be read, last error: %v", domain.ErrUnavailable, p.path, p.lastErr)
+}
+
+// fail records a failure of the storage at url.
+func (p *partSource) fail(url string, err error) {
+	p.lastErr = &storageError{url: url, err: err}
+	level.Warn(logging.With(p.ctx, p.logger)).Log("msg", "can't read part copy",
+		"path", p.path,
+		"storage", url,
+		"offset", p.offset,
+		"err", err,
+	)
+}
+
+func (p *partSource) Read(b []byte) (int, error) {
+	for {
+		if p.body == nil {
+			if err := p.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := p.body.Read(b)
+		p.offset += int64(n)
+		if errors.Is(err, io.EOF) && p.offset < p.size {
+			err = fmt.Errorf("copy ended after %d of %d bytes: %w", p.offset, p.size, io.ErrUnexpectedEOF)
+		}
+
+		if err == nil || errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		p.body.Close()
+		p.body = nil
+		if p.ctx.Err() != nil {
+			return n, p.ctx.Err()
+		}
+
+		p.fail(p.storages[p.next-1].GetStorageURL(), err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (p *partSource) Close() error {
+	if p.body == nil {
+		return nil
+	}
+
+	err := p.body.Close()
+	p.body = nil
+
+	return err
+}
+
+// downloadPolicy describes reading parts of a file ahead of the one being streamed. The zero value doesn't.
+type downloadPolicy struct {
+	prefetch int
+	// buffers holds what's left of the memory budget of prefetched parts.
+	buffers *semaphore.Weighted
+}
+
+// prefetchedPart is stored bytes of a part read ahead of the download reaching it.
+type prefetchedPart struct {
+	done    chan struct{}
+	data    []byte
+	err     error
+	release func()
+}
+
+// bufferedPart is a prefetched part being streamed. Closing it gives its memory back.
+type bufferedPart struct {
+	*bytes.Reader
+	release func()
+}
+
+func (b *bufferedPart) Close() error {
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+
+	return nil
+}
+
+// filePartsReader streams parts of a file one after another, decrypted and decompressed as needed.
+// With prefetching, the next parts are read into memory in the background while the current one streams.
+type filePartsReader struct {
+	ctx context.Context
+	// cancel stops prefetching when the reader is closed.
+	cancel    context.CancelFunc
+	meta      domain.FileMeta
+	locations [][]interfaces.Storage
+	aead      cipher.AEAD
+	// decompress is false when parts are served in their stored compression.
+	decompress bool
+	download   downloadPolicy
+	logger     log.Logger
+
+	currentPart     int
+	currentPartBody io.ReadCloser
+	// skip is how many bytes of content the next part opened starts with that aren't read.
+	skip int64
+	// currentSource is stored bytes of the current part, under decryption and decompression.
+	currentSource io.Reader
+	// prefetched holds parts read ahead by index; parts below scheduled were considered for prefetching.
+	prefetched map[int]*prefetchedPart
+	scheduled  int
+}
+
+// source returns a reader of stored bytes of the i-th part from offset, prefetched if it was.
+func (f *filePartsReader) source(i int, offset int64) (io.ReadCloser, error) {
+	part := f.meta.Parts[i]
+	size := sealedLength(storedLength(part), f.meta.Encryption)
+
+	if prefetched, ok := f.prefetched[i]; ok && offset == 0 {
+		delete(f.prefetched, i)
+
+		select {
+		case <-prefetched.done:
+		case <-f.ctx.Done():
+			// The prefetch stops on its own, as it shares the context.
+			go func() {
+				<-prefetched.done
+				prefetched.release()
+			}()
+
+			return nil, f.ctx.Err()
+		}
+
+		if prefetched.err == nil {
+			return &bufferedPart{Reader: bytes.NewReader(prefetched.data), release: prefetched.release}, nil
+		}
+
+		// The part is read again as usual; a failure that persists is reported from there.
+		prefetched.release()
+	}
+
+	source := &partSource{
+		ctx:      f.ctx,
+		path:     part.Path,
+		storages: f.locations[i],
+		size:     size,
+		logger:   f.logger,
+		offset:   offset,
+	}
+
+	// The first copy is opened at once, so that a part no copy of which can be read fails here.
+	if err := source.open(); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+// prefetchAhead starts reading parts following the current one, up to the configured number of them.
+// Parts the memory budget has no room for right now are left to be read when the download reaches them.
+func (f *filePartsReader) prefetchAhead() {
+	if f.scheduled < f.currentPart+1 {
+		f.scheduled = f.currentPart + 1
+	}
+
+	for ; f.scheduled < len(f.meta.Parts) && f.scheduled <= f.currentPart+f.download.prefetch; f.scheduled++ {
+		i := f.scheduled
+		size := sealedLength(storedLength(f.meta.Parts[i]), f.meta.Encryption)
+		if !f.download.buffers.TryAcquire(size) {
+			continue
+		}
+
+		prefetched := &prefetchedPart{
+			done:    make(chan struct{}),
+			release: func() { f.download.buffers.Release(size) },
+		}
+		if f.prefetched == nil {
+			f.prefetched = map[int]*prefetchedPart{}
+		}
+		f.prefetched[i] = prefetched
+
+		source := &partSource{
+			ctx:      f.ctx,
+			path:     f.meta.Parts[i].Path,
+			storages: f.locations[i],
+			size:     size,
+			logger:   f.logger,
+		}
+		go func() {
+			defer close(prefetched.done)
+			defer source.Close()
+
+			prefetched.data = make([]byte, size)
+			if _, prefetched.err = io.ReadFull(source, prefetched.data); prefetched.err == nil {
+				_, prefetched.err = io.Copy(io.Discard, source)
+			}
+		}()
+	}
+}
+
+// openPart starts reading the next part. It returns io.EOF after the last one.
+func (f *filePartsReader) openPart() error {
+	if f.currentPart >= len(f.meta.Parts) {
+		return io.EOF
+	}
+
+	part := f.meta.Parts[f.currentPart]
+	skip := f.skip
+	f.skip = 0
+
+	// Plain parts are read from the offset right away, and encrypted ones from the chunk holding it, as chunks
+	// are sealed independently. Compressed parts are decompressed from the start.
+	var offset int64
+	var firstChunk uint64
+	if part.Codec == domain.CodecNone {
+		if f.aead == nil {
+			offset, skip = skip, 0
+		} else {
+			chunkSize := int64(f.meta.Encryption.ChunkSize)
+			firstChunk = uint64(skip / chunkSize)
+			offset = int64(firstChunk) * (chunkSize + int64(f.aead.Overhead()))
+			skip %= chunkSize
+		}
+	}
+
+	body, err := f.source(f.currentPart, offset)
+	if err != nil {
+		return err
+	}
+	f.currentSource = body
+
+	if f.aead != nil {
+		decrypting := newDecryptingReader(body, f.aead, f.currentPart, f.meta.Encryption.ChunkSize)
+		decrypting.chunk = firstChunk
+		body = decrypting
+	}
+
+	if f.decompress && part.Codec != domain.CodecNone {
+		decompressed, err := newDecompressingReader(body, part.Codec)
+		if err != nil {
+			body.Close()
+			return fmt.Errorf("can't decompress part %s: %w", part.Path, err)
+		}
+
+		body = decompressed
+	}
+
+	if skip > 0 {
+		if _, err = io.CopyN(io.Discard, body, skip); err != nil {
+			body.Close()
+			return fmt.Errorf("can't skip to offset %d of part %s: %w", skip, part.Path, err)
+		}
+	}
+
+	f.currentPartBody = body
+	if f.download.prefetch > 0 {
+		f.prefetchAhead()
+	}
+	f.currentPart++
+
+	return nil
+}
+
+func (f *filePartsReader) Read(p []byte) (int, error) {
+	for {
+		if f.currentPartBody == nil {
+			if err := f.openPart(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := f.currentPartBody.Read(p)
+		if errors.Is(err, io.EOF) {
+			// Decoders may stop short of the end of what's stored, so the rest is read for storages,
+			// and whatever caches them, to see the part read to the end.
+			if _, err = io.Copy(io.Discard, f.currentSource); err != nil {
+				return n, fmt.Errorf("can't read part to the end: %w", err)
+			}
+
+			if err = f.currentPartBody.Close(); err != nil {
+				return n, fmt.Errorf("can't close part: %w", err)
+			}
+			f.currentPartBody = nil
+
+			if n == 0 {
+				continue
+			}
+
+			return n, nil
+		}
+
+		return n, err
+	}
+}
+
+func (f *filePartsReader) Close() error {
+	if f.cancel != nil {
+		f.cancel()
+	}
+
+	// Prefetches see the context canceled, and their memory is given back once they stop.
+	for i, prefetched := range f.prefetched {
+		<-prefetched.done
+		prefetched.release()
+		delete(f.prefetched, i)
+	}
+
+	if f.currentPartBody == nil {
+		return nil
+	}
+
+	err := f.currentPartBody.Close()
+	f.currentPartBody = nil
+
+	return err
+}
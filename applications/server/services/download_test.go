@@ -0,0 +1,328 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+// cuttingStorage breaks reads of the parts it's told to after a number of bytes, like a connection reset midway.
+type cuttingStorage struct {
+	interfaces.Storage
+	m    sync.Mutex
+	cuts map[string]int64
+}
+
+func (c *cuttingStorage) cut(path string, after int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.cuts[path] = after
+}
+
+func (c *cuttingStorage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	body, err := c.Storage.ReadFilePart(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	after, ok := c.cuts[path]
+	c.m.Unlock()
+	if !ok {
+		return body, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(io.LimitReader(body, after), &failingReader{err: errors.New("connection reset")}),
+		Closer: body,
+	}, nil
+}
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read([]byte) (int, error) {
+	return 0, f.err
+}
+
+func TestServiceDownloadFailover(t *testing.T) {
+	ctx := context.Background()
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	storages := map[string]*cuttingStorage{}
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		storages[url] = &cuttingStorage{Storage: inmemory.NewStorage(url, log.NewNopLogger()), cuts: map[string]int64{}}
+		require.NoError(t, storageManager.AddStorage(ctx, url, storages[url], domain.StorageLabels{}))
+	}
+
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	data := make([]byte, 200*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	for _, replicas := range []int{2, 1} {
+		name := fmt.Sprintf("file_%d", replicas)
+		svc := NewService(fileMetaStorage, storageManager, WithReplication(replicas), WithCompression(domain.CodecGzip, nil))
+		require.NoError(t, svc.PutFile(ctx, domain.File{
+			Meta: domain.FileMeta{Name: name, ContentLength: int64(len(data))},
+			Body: io.NopCloser(bytes.NewReader(data)),
+		}))
+
+		meta, err := fileMetaStorage.GetFileMeta(ctx, name)
+		require.NoError(t, err)
+		for _, part := range meta.Parts {
+			storages[part.StorageURL].cut(part.Path, 100)
+		}
+
+		file, err := svc.GetFile(ctx, name)
+		require.NoError(t, err)
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, file.Body.Close())
+
+		if replicas == 1 {
+			// With nowhere else to read from, the download fails rather than ends early.
+			assert.ErrorIs(t, err, domain.ErrUnavailable)
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	// A part none of whose copies can be read fails the download before any of it is returned.
+	meta, err := fileMetaStorage.GetFileMeta(ctx, "file_2")
+	require.NoError(t, err)
+	for _, url := range meta.Parts[0].Locations() {
+		require.NoError(t, storages[url].DeleteFilePart(ctx, meta.Parts[0].Path))
+	}
+	_, err = NewService(fileMetaStorage, storageManager).GetFile(ctx, "file_2")
+	assert.ErrorIs(t, err, domain.ErrUnavailable)
+
+	svc := NewService(fileMetaStorage, storageManager)
+	assert.Empty(t, putAndGet(t, svc, "empty", nil))
+}
+
+// laggingStorage takes a while to start answering every read, like a storage across a slow link.
+// It counts how many reads wait on all lagging storages at once.
+type laggingStorage struct {
+	interfaces.Storage
+	delay         time.Duration
+	waiting, peak *int32
+}
+
+func (l *laggingStorage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	waiting := atomic.AddInt32(l.waiting, 1)
+	for {
+		peak := atomic.LoadInt32(l.peak)
+		if waiting <= peak || atomic.CompareAndSwapInt32(l.peak, peak, waiting) {
+			break
+		}
+	}
+
+	select {
+	case <-time.After(l.delay):
+	case <-ctx.Done():
+	}
+	atomic.AddInt32(l.waiting, -1)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return l.Storage.ReadFilePart(ctx, path)
+}
+
+type laggingStorages struct {
+	storageManager interfaces.StorageManager
+	waiting, peak  int32
+}
+
+func newLaggingStorages(tb testing.TB, count int, delay time.Duration) *laggingStorages {
+	tb.Helper()
+
+	result := &laggingStorages{storageManager: inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())}
+	for i := 0; i < count; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		storage := &laggingStorage{
+			Storage: inmemory.NewStorage(url, log.NewNopLogger(), inmemory.WithCapacity(1<<30)),
+			delay:   delay,
+			waiting: &result.waiting,
+			peak:    &result.peak,
+		}
+		require.NoError(tb, result.storageManager.AddStorage(context.Background(), url, storage, domain.StorageLabels{}))
+	}
+
+	return result
+}
+
+func TestServicePrefetch(t *testing.T) {
+	ctx := context.Background()
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	data := make([]byte, 500*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		budget   int64
+		opts     []ServiceOption
+		wantPeak int32
+	}{
+		{name: "prefetched", budget: 1 << 20, wantPeak: 2},
+		{name: "compressed and encrypted", budget: 1 << 20, wantPeak: 2,
+			opts: []ServiceOption{WithCompression(domain.CodecZstd, nil), WithEncryption(keyWrapper)}},
+		// Parts of 100 kB don't fit, so they are read as they are reached.
+		{name: "over budget", budget: 50 * 1024, wantPeak: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storages := newLaggingStorages(t, 5, 20*time.Millisecond)
+			opts := append([]ServiceOption{WithPrefetch(2, tt.budget)}, tt.opts...)
+			svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager, opts...)
+
+			assert.Equal(t, data, putAndGet(t, svc, "file", data))
+			assert.Equal(t, tt.wantPeak, atomic.LoadInt32(&storages.peak))
+			// Every buffer is given back.
+			assert.True(t, svc.(*service).download.buffers.TryAcquire(tt.budget))
+		})
+	}
+
+	t.Run("closed early", func(t *testing.T) {
+		storages := newLaggingStorages(t, 5, 20*time.Millisecond)
+		svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager, WithPrefetch(4, 1<<20))
+		require.NoError(t, svc.PutFile(ctx, domain.File{
+			Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+			Body: io.NopCloser(bytes.NewReader(data)),
+		}))
+
+		file, err := svc.GetFile(ctx, "file")
+		require.NoError(t, err)
+		_, err = io.ReadFull(file.Body, make([]byte, 1024))
+		require.NoError(t, err)
+
+		// Closing cancels reads still waiting on storages rather than waiting them out.
+		started := time.Now()
+		require.NoError(t, file.Body.Close())
+		assert.Less(t, time.Since(started), 20*time.Millisecond)
+		assert.True(t, svc.(*service).download.buffers.TryAcquire(1<<20))
+	})
+}
+
+func TestServiceGetFileRange(t *testing.T) {
+	ctx := context.Background()
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	// Five parts of 12000 bytes, sealed in chunks of 1000 bytes when encrypted.
+	data := make([]byte, 60000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opts []ServiceOption
+	}{
+		{name: "plain"},
+		{name: "encrypted", opts: []ServiceOption{WithEncryption(keyWrapper)}},
+		{name: "compressed and encrypted",
+			opts: []ServiceOption{WithCompression(domain.CodecGzip, nil), WithEncryption(keyWrapper)}},
+	}
+
+	ranges := []struct {
+		rng         domain.ByteRange
+		start, size int64
+	}{
+		{rng: domain.ByteRange{Start: 0, Length: 1}, start: 0, size: 1},
+		// Within a chunk, across chunks, and across parts.
+		{rng: domain.ByteRange{Start: 1500, Length: 200}, start: 1500, size: 200},
+		{rng: domain.ByteRange{Start: 2999, Length: 2}, start: 2999, size: 2},
+		{rng: domain.ByteRange{Start: 11990, Length: 12020}, start: 11990, size: 12020},
+		{rng: domain.ByteRange{Start: 36000, Length: -1}, start: 36000, size: 24000},
+		{rng: domain.ByteRange{Start: -1, Length: -1}, start: 59999, size: 1},
+		{rng: domain.ByteRange{Start: -100000, Length: -1}, start: 0, size: 60000},
+		{rng: domain.ByteRange{Start: 55000, Length: 100000}, start: 55000, size: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewService(inmemory.NewFileMetaStorage(), newTestStorageManager(t, 5), tt.opts...)
+			svc.(*service).encryptionChunkSize = 1000
+			assert.Equal(t, data, putAndGet(t, svc, "file", data))
+
+			for _, r := range ranges {
+				file, err := svc.GetFileRange(ctx, "file", r.rng)
+				require.NoError(t, err, "range %+v", r.rng)
+				assert.Equal(t, domain.ByteRange{Start: r.start, Length: r.size}, *file.Range)
+				assert.Empty(t, file.ContentEncoding)
+
+				got, err := io.ReadAll(file.Body)
+				require.NoError(t, err, "range %+v", r.rng)
+				require.NoError(t, file.Body.Close())
+				assert.Equal(t, data[r.start:r.start+r.size], got, "range %+v", r.rng)
+			}
+
+			meta, err := svc.(*service).fileMetaStorage.GetFileMeta(ctx, "file")
+			require.NoError(t, err)
+			require.Len(t, meta.Parts, 5)
+
+			_, err = svc.GetFileRange(ctx, "file", domain.ByteRange{Start: 60000, Length: -1})
+			var rangeErr *domain.RangeError
+			require.ErrorAs(t, err, &rangeErr)
+			assert.Equal(t, int64(60000), rangeErr.Size)
+			assert.ErrorIs(t, err, domain.ErrInvalid)
+		})
+	}
+}
+
+// BenchmarkGetFile downloads a 5 MB file split into 5 parts from storages taking 10 ms to start answering a read.
+func BenchmarkGetFile(b *testing.B) {
+	data := make([]byte, 5*1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(b, err)
+
+	for _, prefetch := range []int{0, 2, 4} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			storages := newLaggingStorages(b, 5, 10*time.Millisecond)
+			svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager, WithPrefetch(prefetch, 64*1024*1024))
+			require.NoError(b, svc.PutFile(context.Background(), domain.File{
+				Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+				Body: io.NopCloser(bytes.NewReader(data)),
+			}))
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file, err := svc.GetFile(context.Background(), "file")
+				require.NoError(b, err)
+				_, err = io.Copy(io.Discard, file.Body)
+				require.NoError(b, err)
+				require.NoError(b, file.Body.Close())
+			}
+		})
+	}
+}
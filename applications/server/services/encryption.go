@@ -0,0 +1,248 @@
+package services
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+const (
+	// algorithmAES256GCMChunked is the only encryption scheme so far.
+	algorithmAES256GCMChunked = "AES-256-GCM-CHUNKED"
+	dataKeySizeInBytes        = 32
+	defaultEncryptionChunk    = 64 * 1024 // 64 kB
+	// gcmTagSize is what AES-GCM adds to every sealed chunk.
+	gcmTagSize = 16
+)
+
+// errChunkNotAuthentic is returned for sealed chunks failing to open: damaged, truncated or moved.
+var errChunkNotAuthentic = errors.New("chunk is not authentic")
+
+// sealedLength returns a size of length bytes once sealed chunk by chunk as enc describes.
+// A chunk is sealed even for an empty part.
+func sealedLength(length int64, enc domain.Encryption) int64 {
+	if enc.Algorithm == "" || enc.ChunkSize <= 0 {
+		return length
+	}
+
+	chunks := (length + int64(enc.ChunkSize) - 1) / int64(enc.ChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	return length + chunks*gcmTagSize
+}
+
+// newFileEncryption generates a data key for a new file and returns it wrapped along with a cipher using it.
+func newFileEncryption(keyWrapper interfaces.KeyWrapper, chunkSize int) (domain.Encryption, cipher.AEAD, error) {
+	dataKey, err := randomBytes(dataKeySizeInBytes)
+	if err != nil {
+		return domain.Encryption{}, nil, fmt.Errorf("can't generate data key: %w", err)
+	}
+
+	wrapped, err := keyWrapper.WrapKey(dataKey)
+	if err != nil {
+		return domain.Encryption{}, nil, fmt.Errorf("can't wrap data key: %w", err)
+	}
+
+	aead, err := newDataKeyAEAD(dataKey)
+	if err != nil {
+		return domain.Encryption{}, nil, err
+	}
+
+	return domain.Encryption{
+		Algorithm:  algorithmAES256GCMChunked,
+		WrappedKey: wrapped,
+		ChunkSize:  chunkSize,
+	}, aead, nil
+}
+
+// fileDecryption returns a cipher for a file stored with enc, or nil if the file is plaintext.
+func fileDecryption(keyWrapper interfaces.KeyWrapper, enc domain.Encryption) (cipher.AEAD, error) {
+	switch enc.Algorithm {
+	case "":
+		return nil, nil
+	case algorithmAES256GCMChunked:
+	default:
+		return nil, fmt.Errorf("unknown encryption algorithm %q", enc.Algorithm)
+	}
+
+	if keyWrapper == nil {
+		return nil, fmt.Errorf("file is encrypted, but encryption is not configured")
+	}
+
+	dataKey, err := keyWrapper.UnwrapKey(enc.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap data key: %w", err)
+	}
+
+	return newDataKeyAEAD(dataKey)
+}
+
+func newDataKeyAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Every chunk is sealed with the file's data key under a nonce made of the part index and the
+// chunk index, so nonces never repeat within a file and chunks can't be reordered across parts.
+func chunkNonce(aead cipher.AEAD, part int, chunk uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce, uint32(part))
+	binary.BigEndian.PutUint64(nonce[4:], chunk)
+
+	return nonce
+}
+
+// chunkAAD marks the final chunk of a part, which makes a part truncated on a chunk boundary
+// fail to decrypt instead of looking complete.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// encryptingReader seals a part's plaintext chunk by chunk as it's read.
+type encryptingReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	part  int
+	chunk uint64
+	plain []byte
+	out   []byte
+	pos   int
+	done  bool
+}
+
+func newEncryptingReader(src io.Reader, aead cipher.AEAD, part, chunkSize int) *encryptingReader {
+	return &encryptingReader{
+		src:   bufio.NewReader(src),
+		aead:  aead,
+		part:  part,
+		plain: make([]byte, chunkSize),
+	}
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for e.pos == len(e.out) {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		if err := e.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.out[e.pos:])
+	e.pos += n
+
+	return n, nil
+}
+
+func (e *encryptingReader) sealNext() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	final := n < len(e.plain)
+	if !final {
+		if _, err = e.src.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.aead, e.part, e.chunk), e.plain[:n], chunkAAD(final))
+	e.pos = 0
+	e.chunk++
+	e.done = final
+
+	return nil
+}
+
+// decryptingReader opens a part sealed by encryptingReader.
+type decryptingReader struct {
+	src    io.ReadCloser
+	buf    *bufio.Reader
+	aead   cipher.AEAD
+	part   int
+	chunk  uint64
+	sealed []byte
+	out    []byte
+	pos    int
+	done   bool
+}
+
+func newDecryptingReader(src io.ReadCloser, aead cipher.AEAD, part, chunkSize int) *decryptingReader {
+	return &decryptingReader{
+		src:    src,
+		buf:    bufio.NewReader(src),
+		aead:   aead,
+		part:   part,
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for d.pos == len(d.out) {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.openNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.out[d.pos:])
+	d.pos += n
+
+	return n, nil
+}
+
+func (d *decryptingReader) openNext() error {
+	n, err := io.ReadFull(d.buf, d.sealed)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	final := n < len(d.sealed)
+	if !final {
+		if _, err = d.buf.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	d.out, err = d.aead.Open(d.out[:0], chunkNonce(d.aead, d.part, d.chunk), d.sealed[:n], chunkAAD(final))
+	if err != nil {
+		return fmt.Errorf("can't decrypt chunk %d of part %d: %w: %v", d.chunk, d.part, errChunkNotAuthentic, err)
+	}
+
+	d.pos = 0
+	d.chunk++
+	d.done = final
+
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.src.Close()
+}
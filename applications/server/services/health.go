@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+const (
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 2 * time.Second
+	defaultSlowPing        = 500 * time.Millisecond
+	defaultDownAfterProbes = 3
+)
+
+// probeResult is what the checker remembers about a storage between probes.
+type probeResult struct {
+	failures  int
+	checkedAt time.Time
+	lastError string
+}
+
+type healthChecker struct {
+	storageManager interfaces.StorageManager
+	interval       time.Duration
+	timeout        time.Duration
+	slowPing       time.Duration
+	downAfter      int
+	liveness       func(ctx context.Context, storageURL string) error
+	logger         log.Logger
+
+	m       sync.Mutex
+	results map[string]probeResult
+}
+
+// HealthCheckerOption configures optional behaviour of the health checker.
+type HealthCheckerOption func(h *healthChecker)
+
+// WithHealthInterval sets how often storages are probed.
+func WithHealthInterval(interval time.Duration) HealthCheckerOption {
+	return func(h *healthChecker) {
+		if interval > 0 {
+			h.interval = interval
+		}
+	}
+}
+
+// WithHealthTimeout sets how long a probe may take before it counts as failed.
+func WithHealthTimeout(timeout time.Duration) HealthCheckerOption {
+	return func(h *healthChecker) {
+		if timeout > 0 {
+			h.timeout = timeout
+		}
+	}
+}
+
+// WithSlowPing marks storages answering slower than slowPing as degraded.
+func WithSlowPing(slowPing time.Duration) HealthCheckerOption {
+	return func(h *healthChecker) {
+		if slowPing > 0 {
+			h.slowPing = slowPing
+		}
+	}
+}
+
+// WithDownAfter marks storages down after failures probes in a row failed. Fewer failures leave them degraded.
+func WithDownAfter(failures int) HealthCheckerOption {
+	return func(h *healthChecker) {
+		if failures > 0 {
+			h.downAfter = failures
+		}
+	}
+}
+
+// WithLivenessCheck adds check to every probe, e.g. whether a storage node keeps sending heartbeats.
+func WithLivenessCheck(check func(ctx context.Context, storageURL string) error) HealthCheckerOption {
+	return func(h *healthChecker) {
+		h.liveness = check
+	}
+}
+
+// NewHealthChecker returns a checker probing every storage and recording its health in storageManager.
+func NewHealthChecker(storageManager interfaces.StorageManager, logger log.Logger, opts ...HealthCheckerOption) server.HealthChecker {
+	h := &healthChecker{
+		storageManager: storageManager,
+		interval:       defaultHealthInterval,
+		timeout:        defaultHealthTimeout,
+		slowPing:       defaultSlowPing,
+		downAfter:      defaultDownAfterProbes,
+		logger:         logger,
+		results:        map[string]probeResult{},
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+func (h *healthChecker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.CheckAll(ctx); err != nil {
+			level.Error(h.logger).Log("msg", "can't check storages",
+				"err", err,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) CheckAll(ctx context.Context) error {
+	storages, err := h.storageManager.ListStorages(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list storages: %w", err)
+	}
+
+	// A hanging storage must not hold up probes of the others.
+	var wg sync.WaitGroup
+	for _, storage := range storages {
+		storage := storage
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.check(ctx, storage)
+		}()
+	}
+	wg.Wait()
+
+	h.forgetRemoved(storages)
+
+	return nil
+}
+
+func (h *healthChecker) check(ctx context.Context, storage interfaces.Storage) {
+	url := storage.GetStorageURL()
+
+	pingCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	started := time.Now()
+	err := storage.Ping(pingCtx)
+	elapsed := time.Since(started)
+	if err == nil && h.liveness != nil {
+		err = h.liveness(ctx, url)
+	}
+
+	h.m.Lock()
+	result := h.results[url]
+	result.checkedAt = time.Now().UTC()
+	result.lastError = ""
+	if err != nil {
+		result.failures++
+		result.lastError = err.Error()
+	} else {
+		result.failures = 0
+	}
+	h.results[url] = result
+	h.m.Unlock()
+
+	health := domain.HealthHealthy
+	switch {
+	case result.failures >= h.downAfter:
+		health = domain.HealthDown
+	case result.failures > 0 || elapsed > h.slowPing:
+		health = domain.HealthDegraded
+	}
+
+	// Uploads mark failing storages too, so the manager rather than the last probe knows the current health.
+	previous, getErr := h.storageManager.GetStorageHealth(ctx, url)
+	if errors.Is(getErr, domain.ErrStorageNotFound) {
+		return
+	}
+	if getErr != nil {
+		level.Error(h.logger).Log("msg", "can't get storage health",
+			"storage", url,
+			"err", getErr,
+		)
+		return
+	}
+
+	if previous == health {
+		return
+	}
+
+	if setErr := h.storageManager.SetStorageHealth(ctx, url, health); setErr != nil {
+		if !errors.Is(setErr, domain.ErrStorageNotFound) {
+			level.Error(h.logger).Log("msg", "can't set storage health",
+				"storage", url,
+				"err", setErr,
+			)
+		}
+		return
+	}
+
+	level.Warn(h.logger).Log("msg", "storage health changed",
+		"storage", url,
+		"from", previous,
+		"to", health,
+		"ping", elapsed,
+		"err", err,
+	)
+}
+
+// forgetRemoved drops probe results of storages no longer registered.
+func (h *healthChecker) forgetRemoved(storages []interfaces.Storage) {
+	registered := make(map[string]bool, len(storages))
+	for _, storage := range storages {
+		registered[storage.GetStorageURL()] = true
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for url := range h.results {
+		if !registered[url] {
+			delete(h.results, url)
+		}
+	}
+}
+
+func (h *healthChecker) Statuses(ctx context.Context) ([]domain.StorageStatus, error) {
+	storages, err := h.storageManager.ListStorages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't list storages: %w", err)
+	}
+
+	result := make([]domain.StorageStatus, 0, len(storages))
+	for _, storage := range storages {
+		url := storage.GetStorageURL()
+		status := domain.StorageStatus{URL: url}
+
+		if status.Labels, err = h.storageManager.GetStorageLabels(ctx, url); err != nil {
+			return nil, fmt.Errorf("can't get storage labels: %w", err)
+		}
+
+		if status.Health, err = h.storageManager.GetStorageHealth(ctx, url); err != nil {
+			return nil, fmt.Errorf("can't get storage health: %w", err)
+		}
+
+		if status.Draining, err = h.storageManager.IsDraining(ctx, url); err != nil {
+			return nil, fmt.Errorf("can't get storage: %w", err)
+		}
+
+		h.m.Lock()
+		status.CheckedAt = h.results[url].checkedAt
+		status.LastError = h.results[url].lastError
+		h.m.Unlock()
+
+		result = append(result, status)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+// flakyStorage fails pings and uploads while broken is set. A failing upload keeps some of the body first,
+// as a storage cut off midway may.
+type flakyStorage struct {
+	interfaces.Storage
+	broken int32
+}
+
+func (f *flakyStorage) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&f.broken) != 0 {
+		return errors.New("connection refused")
+	}
+
+	return f.Storage.Ping(ctx)
+}
+
+func (f *flakyStorage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	if atomic.LoadInt32(&f.broken) != 0 {
+		buf := make([]byte, 1024)
+		n, _ := io.ReadFull(body, buf)
+		if err := f.Storage.UploadFilePart(ctx, path, bytes.NewReader(buf[:n])); err != nil {
+			return err
+		}
+
+		return errors.New("connection reset")
+	}
+
+	return f.Storage.UploadFilePart(ctx, path, body)
+}
+
+func addFlakyStorage(t *testing.T, storageManager interfaces.StorageManager, url string) *flakyStorage {
+	t.Helper()
+
+	storage := &flakyStorage{Storage: inmemory.NewStorage(url, log.NewNopLogger())}
+	require.NoError(t, storageManager.AddStorage(context.Background(), url, storage, domain.StorageLabels{}))
+
+	return storage
+}
+
+func TestHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	storageManager := newTestStorageManager(t, 2)
+	flaky := addFlakyStorage(t, storageManager, "storage_flaky")
+	checker := NewHealthChecker(storageManager, log.NewNopLogger(), WithDownAfter(2))
+
+	healthOf := func() domain.StorageHealth {
+		health, err := storageManager.GetStorageHealth(ctx, "storage_flaky")
+		require.NoError(t, err)
+
+		return health
+	}
+
+	require.NoError(t, checker.CheckAll(ctx))
+	assert.Equal(t, domain.HealthHealthy, healthOf())
+
+	atomic.StoreInt32(&flaky.broken, 1)
+	require.NoError(t, checker.CheckAll(ctx))
+	assert.Equal(t, domain.HealthDegraded, healthOf())
+
+	require.NoError(t, checker.CheckAll(ctx))
+	assert.Equal(t, domain.HealthDown, healthOf())
+
+	storages, err := storageManager.GetStorages(ctx, "file", 3, 1)
+	require.NoError(t, err)
+	for _, part := range storages {
+		assert.NotEqual(t, "storage_flaky", part[0].GetStorageURL())
+	}
+
+	statuses, err := checker.Statuses(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	assert.Equal(t, domain.HealthDown, statuses[2].Health)
+	assert.Equal(t, "connection refused", statuses[2].LastError)
+	assert.False(t, statuses[2].CheckedAt.IsZero())
+
+	atomic.StoreInt32(&flaky.broken, 0)
+	require.NoError(t, checker.CheckAll(ctx))
+	assert.Equal(t, domain.HealthHealthy, healthOf())
+}
+
+func TestServiceUploadFailover(t *testing.T) {
+	ctx := context.Background()
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		replicas int
+		opts     []ServiceOption
+	}{
+		{name: "replicas=1", replicas: 1},
+		{name: "replicas=2", replicas: 2},
+		// Parts read into memory to be uploaded in parallel are encoded anew from there for a retry.
+		{name: "parallel", replicas: 2,
+			opts: []ServiceOption{WithParallelUploads(4, 1<<20), WithEncryption(keyWrapper)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageManager := newTestStorageManager(t, 0)
+			flaky := addFlakyStorage(t, storageManager, "storage_flaky")
+			atomic.StoreInt32(&flaky.broken, 1)
+			for i := 0; i < 4; i++ {
+				url := fmt.Sprintf("storage_%d", i)
+				require.NoError(t, storageManager.AddStorage(ctx, url, inmemory.NewStorage(url, log.NewNopLogger()), domain.StorageLabels{}))
+			}
+
+			fileMetaStorage := inmemory.NewFileMetaStorage()
+			opts := append([]ServiceOption{WithReplication(tt.replicas), WithCompression(domain.CodecGzip, nil)}, tt.opts...)
+			svc := NewService(fileMetaStorage, storageManager, opts...)
+
+			data := make([]byte, 200*1024)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+			assert.Equal(t, data, putAndGet(t, svc, "file", data))
+
+			health, err := storageManager.GetStorageHealth(ctx, "storage_flaky")
+			require.NoError(t, err)
+			assert.Equal(t, domain.HealthDegraded, health)
+
+			meta, err := fileMetaStorage.GetFileMeta(ctx, "file")
+			require.NoError(t, err)
+			for _, part := range meta.Parts {
+				assert.NotContains(t, part.Locations(), "storage_flaky")
+				assert.Len(t, part.Locations(), tt.replicas)
+
+				// The checksum is of what the last attempt stored.
+				sum := sha256.Sum256(readStoredParts(t, storageManager, domain.FileMeta{Parts: []domain.FilePart{part}}))
+				assert.Equal(t, hex.EncodeToString(sum[:]), part.Checksum)
+			}
+
+			// Nothing is left behind by the failed attempts.
+			require.NoError(t, svc.DeleteFile(ctx, "file"))
+			assert.Zero(t, usedSpace(t, storageManager))
+		})
+	}
+}
+
+func TestServiceFailedFailoverKeepsPreviousVersion(t *testing.T) {
+	ctx := context.Background()
+	storageManager := newTestStorageManager(t, 2)
+	flaky := addFlakyStorage(t, storageManager, "storage_flaky")
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	svc := NewService(fileMetaStorage, storageManager, WithReplication(3))
+
+	data := make([]byte, 100*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.Equal(t, data, putAndGet(t, svc, "file", data))
+	used := usedSpace(t, storageManager)
+
+	// The overwrite fails on one storage, and there are no others left to retry with.
+	atomic.StoreInt32(&flaky.broken, 1)
+	err = svc.PutFile(ctx, domain.File{
+		Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+		Body: io.NopCloser(bytes.NewReader(make([]byte, len(data)))),
+	})
+	require.Error(t, err)
+
+	// Only what the failed upload wrote is deleted; every copy of the previous version is still there.
+	meta, err := fileMetaStorage.GetFileMeta(ctx, "file")
+	require.NoError(t, err)
+	for _, part := range meta.Parts {
+		for _, url := range part.Locations() {
+			copyOf := part
+			copyOf.StorageURL = url
+			stored := readStoredParts(t, storageManager, domain.FileMeta{Parts: []domain.FilePart{copyOf}})
+			assert.Len(t, stored, int(part.ContentLength), "%s at %s", part.Path, url)
+		}
+	}
+	assert.Equal(t, used, usedSpace(t, storageManager))
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLSigner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := &urlSigner{key: []byte("secret"), maxExpiry: time.Hour, now: func() time.Time { return now }}
+
+	expires, signature, err := signer.Sign(http.MethodPut, "logs/a.txt", 10*time.Minute, 1024)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(10*time.Minute), expires)
+
+	assert.NoError(t, signer.Verify(http.MethodPut, "logs/a.txt", expires, 1024, signature))
+	assert.Error(t, signer.Verify(http.MethodGet, "logs/a.txt", expires, 1024, signature))
+	assert.Error(t, signer.Verify(http.MethodPut, "logs/b.txt", expires, 1024, signature))
+	assert.Error(t, signer.Verify(http.MethodPut, "logs/a.txt", expires.Add(time.Hour), 1024, signature))
+	assert.Error(t, signer.Verify(http.MethodPut, "logs/a.txt", expires, 0, signature))
+
+	now = expires
+	assert.Error(t, signer.Verify(http.MethodPut, "logs/a.txt", expires, 1024, signature))
+
+	_, _, err = signer.Sign(http.MethodGet, "a.txt", 2*time.Hour, 0)
+	assert.Error(t, err)
+}
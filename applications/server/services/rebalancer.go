@@ -0,0 +1,777 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/cache"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+const defaultRebalanceThreshold = 16 * 1024 * 1024 // 16 MB
+
+type rebalancer struct {
+	fileMetaStorage interfaces.FileMetaStorage
+	storageManager  interfaces.StorageManager
+	stateStorage    interfaces.RebalanceStateStorage
+	// threshold and rateLimit may be changed while a run is in progress.
+	threshold atomic.Int64
+	rateLimit atomic.Int64
+	logger    log.Logger
+
+	m      sync.Mutex
+	status domain.RebalanceStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+	// again is set when more work is requested while a run is in progress, so the run doesn't finish yet.
+	again bool
+	// removed lists storages unregistered after draining.
+	removed map[string]bool
+}
+
+// RebalancerOption configures optional behaviour of the rebalancer.
+type RebalancerOption func(r *rebalancer)
+
+// WithRebalanceThreshold stops rebalancing once free space of storages differs by at most threshold bytes.
+func WithRebalanceThreshold(threshold int64) RebalancerOption {
+	return func(r *rebalancer) {
+		if threshold > 0 {
+			r.threshold.Store(threshold)
+		}
+	}
+}
+
+// WithRebalanceRateLimit caps how many bytes per second are copied between storages. Zero means no limit.
+func WithRebalanceRateLimit(bytesPerSecond int64) RebalancerOption {
+	return func(r *rebalancer) {
+		r.rateLimit.Store(bytesPerSecond)
+	}
+}
+
+// NewRebalancer returns a rebalancer moving parts off draining storages, and from the fullest storages to the emptiest ones.
+// Each part is copied, verified, switched to in metadata, and only then deleted from its old storage.
+func NewRebalancer(fileMetaStorage interfaces.FileMetaStorage, storageManager interfaces.StorageManager,
+	stateStorage interfaces.RebalanceStateStorage, logger log.Logger, opts ...RebalancerOption) server.Rebalancer {
+	r := &rebalancer{
+		fileMetaStorage: fileMetaStorage,
+		storageManager:  storageManager,
+		stateStorage:    stateStorage,
+		logger:          logger,
+		removed:         map[string]bool{},
+	}
+	r.threshold.Store(defaultRebalanceThreshold)
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *rebalancer) SetThreshold(threshold int64) {
+	WithRebalanceThreshold(threshold)(r)
+}
+
+func (r *rebalancer) SetRateLimit(bytesPerSecond int64) {
+	WithRebalanceRateLimit(bytesPerSecond)(r)
+}
+
+func (r *rebalancer) Start(ctx context.Context) error {
+	return r.start(ctx, false)
+}
+
+func (r *rebalancer) Resume(ctx context.Context) error {
+	return r.start(ctx, true)
+}
+
+// start launches a run. When resuming, a run is launched only if the saved one was interrupted, and its progress is kept.
+func (r *rebalancer) start(ctx context.Context, resume bool) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.cancel != nil {
+		return domain.ErrRebalanceRunning
+	}
+
+	saved, err := r.stateStorage.GetRebalanceStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get rebalance status: %w", err)
+	}
+
+	if resume && !saved.Running {
+		r.status = saved
+		return nil
+	}
+
+	status := saved
+	if !resume {
+		// A move left in flight by an earlier run still has to be settled.
+		status = domain.RebalanceStatus{Current: saved.Current}
+	}
+	status.Running = true
+	if status.StartedAt.IsZero() {
+		status.StartedAt = time.Now().UTC()
+	}
+
+	if err = r.stateStorage.PutRebalanceStatus(ctx, status); err != nil {
+		return fmt.Errorf("can't put rebalance status: %w", err)
+	}
+
+	// The run outlives the request that started it.
+	runCtx, cancel := context.WithCancel(context.Background())
+	r.status = status
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go r.run(runCtx, r.done)
+
+	return nil
+}
+
+func (r *rebalancer) Drain(ctx context.Context, storageURL string) error {
+	if err := r.storageManager.DrainStorage(ctx, storageURL); err != nil {
+		return fmt.Errorf("can't drain storage: %w", err)
+	}
+
+	r.m.Lock()
+	if r.cancel != nil {
+		r.again = true
+		r.m.Unlock()
+
+		return nil
+	}
+	r.m.Unlock()
+
+	err := r.Start(ctx)
+	if errors.Is(err, domain.ErrRebalanceRunning) {
+		// A run started meanwhile picks the storage up.
+		return nil
+	}
+
+	return err
+}
+
+func (r *rebalancer) DrainStatus(ctx context.Context, storageURL string) (domain.DrainStatus, error) {
+	status := domain.DrainStatus{URL: storageURL}
+
+	draining, err := r.storageManager.IsDraining(ctx, storageURL)
+	if errors.Is(err, domain.ErrStorageNotFound) {
+		r.m.Lock()
+		status.Removed = r.removed[storageURL]
+		r.m.Unlock()
+
+		if status.Removed {
+			return status, nil
+		}
+	}
+	if err != nil {
+		return domain.DrainStatus{}, fmt.Errorf("can't get storage: %w", err)
+	}
+
+	status.Draining = draining
+
+	parts, err := r.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		return domain.DrainStatus{}, fmt.Errorf("can't list parts: %w", err)
+	}
+
+	for _, part := range parts {
+		if keptAt([]domain.FilePart{part}, storageURL, part.Path) {
+			status.RemainingParts++
+			status.RemainingBytes += storedLength(part)
+		}
+	}
+
+	return status, nil
+}
+
+// Stop interrupts a running run. A move in flight is settled by the next run.
+func (r *rebalancer) Stop(ctx context.Context) error {
+	r.m.Lock()
+	cancel, done := r.cancel, r.done
+	r.m.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.cancel = nil
+	r.again = false
+	r.status.Running = false
+	r.status.FinishedAt = time.Now().UTC()
+	if err := r.stateStorage.PutRebalanceStatus(ctx, r.status); err != nil {
+		return fmt.Errorf("can't put rebalance status: %w", err)
+	}
+
+	return nil
+}
+
+func (r *rebalancer) Status(ctx context.Context) (domain.RebalanceStatus, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.cancel == nil {
+		return r.stateStorage.GetRebalanceStatus(ctx)
+	}
+
+	status := r.status
+	if status.Current != nil {
+		current := *status.Current
+		status.Current = &current
+	}
+
+	return status, nil
+}
+
+func (r *rebalancer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	if current := r.snapshot().Current; current != nil {
+		if err := r.settle(ctx, *current); err != nil {
+			r.fail(ctx, fmt.Errorf("can't settle interrupted move of %s: %w", current.Path, err))
+			return
+		}
+
+		r.update(ctx, func(status *domain.RebalanceStatus) { status.Current = nil })
+	}
+
+	// Parts failed to move are not retried within the run, so a broken part doesn't stall it.
+	failed := map[string]bool{}
+	for {
+		done, err := r.moveAll(ctx, failed)
+		if err != nil {
+			r.fail(ctx, err)
+			return
+		}
+
+		if !done {
+			return
+		}
+
+		if err = r.removeDrained(ctx); err != nil {
+			r.fail(ctx, err)
+			return
+		}
+
+		if r.finish(ctx) {
+			return
+		}
+	}
+}
+
+// moveAll makes moves until none is left. It returns false if the run is stopped meanwhile.
+func (r *rebalancer) moveAll(ctx context.Context, failed map[string]bool) (bool, error) {
+	for ctx.Err() == nil {
+		move, part, found, err := r.nextMove(ctx, failed)
+		if err != nil {
+			return false, err
+		}
+
+		if !found {
+			return true, nil
+		}
+
+		r.update(ctx, func(status *domain.RebalanceStatus) { status.Current = &move })
+
+		moved, err := r.move(ctx, move, part)
+		if ctx.Err() != nil {
+			// Stopped mid-move: the move stays recorded as current and is settled by the next run.
+			return false, nil
+		}
+
+		r.update(ctx, func(status *domain.RebalanceStatus) {
+			status.Current = nil
+			switch {
+			case err != nil:
+				status.FailedMoves++
+				status.LastError = err.Error()
+			case moved:
+				status.MovedParts++
+				status.MovedBytes += storedLength(part)
+			}
+		})
+
+		if err != nil {
+			failed[moveKey(move)] = true
+			level.Warn(r.logger).Log("msg", "can't move part",
+				"path", move.Path,
+				"from", move.From,
+				"to", move.To,
+				"err", err,
+			)
+		}
+	}
+
+	return false, nil
+}
+
+// removeDrained unregisters draining storages no known part is kept at anymore.
+func (r *rebalancer) removeDrained(ctx context.Context) error {
+	storages, err := r.storageManager.ListStorages(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list storages: %w", err)
+	}
+
+	parts, err := r.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list parts: %w", err)
+	}
+
+	used := map[string]bool{}
+	for _, part := range parts {
+		for _, url := range part.Locations() {
+			used[url] = true
+		}
+	}
+
+	for _, storage := range storages {
+		url := storage.GetStorageURL()
+		draining, err := r.storageManager.IsDraining(ctx, url)
+		if err != nil {
+			return fmt.Errorf("can't get storage: %w", err)
+		}
+
+		if !draining || used[url] {
+			continue
+		}
+
+		if err = r.storageManager.RemoveStorage(ctx, url); err != nil {
+			return fmt.Errorf("can't remove storage: %w", err)
+		}
+
+		r.m.Lock()
+		r.removed[url] = true
+		r.m.Unlock()
+
+		level.Info(r.logger).Log("msg", "drained storage removed",
+			"storage", url,
+		)
+	}
+
+	return nil
+}
+
+// nextMove picks a part to move off a draining storage or, once there are none, the largest part that narrows
+// the free space gap between a full and an empty storage without overshooting it. Parts only go to healthy
+// storages, and a move never puts two copies of a part into one zone.
+func (r *rebalancer) nextMove(ctx context.Context, failed map[string]bool) (domain.PartMove, domain.FilePart, bool, error) {
+	storages, err := r.storageManager.ListStorages(ctx)
+	if err != nil {
+		return domain.PartMove{}, domain.FilePart{}, false, fmt.Errorf("can't list storages: %w", err)
+	}
+
+	type storageState struct {
+		url      string
+		free     int64
+		zone     string
+		draining bool
+		healthy  bool
+	}
+
+	states := make([]storageState, 0, len(storages))
+	zones := make(map[string]string, len(storages))
+	for _, storage := range storages {
+		url := storage.GetStorageURL()
+		labels, err := r.storageManager.GetStorageLabels(ctx, url)
+		if err != nil {
+			return domain.PartMove{}, domain.FilePart{}, false, fmt.Errorf("can't get storage labels: %w", err)
+		}
+		zones[url] = placement.Zone(url, labels)
+
+		draining, err := r.storageManager.IsDraining(ctx, url)
+		if err != nil {
+			return domain.PartMove{}, domain.FilePart{}, false, fmt.Errorf("can't get storage: %w", err)
+		}
+
+		health, err := r.storageManager.GetStorageHealth(ctx, url)
+		if err != nil {
+			return domain.PartMove{}, domain.FilePart{}, false, fmt.Errorf("can't get storage health: %w", err)
+		}
+
+		free, err := storage.GetFreeSpace()
+		if err != nil {
+			// A storage that can't tell its free space is neither drained nor filled.
+			continue
+		}
+
+		states = append(states, storageState{
+			url:      url,
+			free:     int64(free),
+			zone:     zones[url],
+			draining: draining,
+			healthy:  health == domain.HealthHealthy,
+		})
+	}
+
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].free < states[j].free
+	})
+
+	parts, err := r.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		return domain.PartMove{}, domain.FilePart{}, false, fmt.Errorf("can't list parts: %w", err)
+	}
+
+	draining := make(map[string]bool, len(states))
+	for _, state := range states {
+		draining[state.url] = state.draining
+	}
+
+	stored := make(map[string][]domain.FilePart, len(states))
+	occupied := make(map[string]bool, len(parts))
+	for _, part := range parts {
+		for _, url := range part.Locations() {
+			stored[url] = append(stored[url], part)
+			occupied[url+"\x00"+part.Path] = true
+		}
+	}
+
+	// Draining storages are emptied first, each part going to the emptiest storage that can take it.
+	for _, part := range parts {
+		for _, src := range part.Locations() {
+			if !draining[src] {
+				continue
+			}
+
+			for d := len(states) - 1; d >= 0; d-- {
+				dst := states[d]
+				move := domain.PartMove{Path: part.Path, From: src, To: dst.url}
+				if dst.draining || !dst.healthy || dst.free < storedLength(part) || failed[moveKey(move)] ||
+					occupied[dst.url+"\x00"+part.Path] || sharesZone(part, src, dst.zone, zones) {
+					continue
+				}
+
+				return move, part, true, nil
+			}
+		}
+	}
+
+	// Unhealthy storages are left alone until they recover: their parts may not be readable.
+	for _, src := range states {
+		if src.draining || !src.healthy {
+			continue
+		}
+
+		for d := len(states) - 1; d >= 0; d-- {
+			dst := states[d]
+			if dst.draining || !dst.healthy {
+				continue
+			}
+
+			gap := dst.free - src.free
+			if gap <= r.threshold.Load() {
+				break
+			}
+
+			var (
+				best     domain.FilePart
+				bestSize int64 = -1
+			)
+			for _, part := range stored[src.url] {
+				size := storedLength(part)
+				move := domain.PartMove{Path: part.Path, From: src.url, To: dst.url}
+				if size > gap/2 || size <= bestSize || failed[moveKey(move)] || occupied[dst.url+"\x00"+part.Path] {
+					continue
+				}
+
+				if sharesZone(part, src.url, dst.zone, zones) {
+					continue
+				}
+
+				best, bestSize = part, size
+			}
+
+			if bestSize >= 0 {
+				return domain.PartMove{Path: best.Path, From: src.url, To: dst.url}, best, true, nil
+			}
+		}
+	}
+
+	return domain.PartMove{}, domain.FilePart{}, false, nil
+}
+
+// move copies the part, verifies the copy and switches metadata to it. It returns false if the part
+// is gone meanwhile, in which case the copy is dropped.
+func (r *rebalancer) move(ctx context.Context, move domain.PartMove, part domain.FilePart) (bool, error) {
+	src, err := r.storageManager.GetStorage(ctx, move.From)
+	if err != nil {
+		return false, fmt.Errorf("can't get storage error: %w", err)
+	}
+
+	dst, err := r.storageManager.GetStorage(ctx, move.To)
+	if err != nil {
+		return false, fmt.Errorf("can't get storage error: %w", err)
+	}
+
+	sum, err := copyPart(ctx, src, dst, move.Path, r.rateLimit.Load())
+	if err == nil {
+		err = verifyCopy(ctx, dst, move.Path, sum, part.StoredChecksum())
+	}
+
+	// Only the part that was copied is moved; a part replaced at the same path meanwhile stays where it is.
+	var moved bool
+	if err == nil {
+		moved, err = r.fileMetaStorage.MovePart(ctx, move.Path, hex.EncodeToString(sum), move.From, move.To)
+		if err != nil {
+			err = fmt.Errorf("can't move part: %w", err)
+		}
+	}
+
+	if err != nil || !moved {
+		if deleteErr := dst.DeleteFilePart(ctx, move.Path); deleteErr != nil {
+			level.Warn(r.logger).Log("msg", "can't delete part copy",
+				"path", move.Path,
+				"storage", move.To,
+				"err", deleteErr,
+			)
+		}
+
+		return false, err
+	}
+
+	move.Committed = true
+	r.update(ctx, func(status *domain.RebalanceStatus) { status.Current = &move })
+
+	if err = src.DeleteFilePart(ctx, move.Path); err != nil {
+		return true, fmt.Errorf("can't delete moved part: %w", err)
+	}
+
+	return true, nil
+}
+
+// copyPart copies the part at path from src to dst, at most rateLimit bytes per second unless it's zero,
+// and returns a sha256 sum of the copied bytes.
+func copyPart(ctx context.Context, src, dst interfaces.Storage, path string, rateLimit int64) ([]byte, error) {
+	body, err := src.ReadFilePart(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read file part: %w", err)
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	var reader io.Reader = io.TeeReader(body, h)
+	if rateLimit > 0 {
+		reader = newThrottledReader(ctx, reader, rateLimit)
+	}
+
+	if err = dst.UploadFilePart(ctx, path, reader); err != nil {
+		return nil, fmt.Errorf("can't upload file part: %w", err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// verifyCopy reads the copy back and compares it with what was read from the source,
+// and with the checksum of the part if it's known.
+func verifyCopy(ctx context.Context, dst interfaces.Storage, path string, sum []byte, checksum string) error {
+	// The copy is checked as the storage keeps it, not as it may be cached.
+	body, err := dst.ReadFilePart(cache.Bypass(ctx), path)
+	if err != nil {
+		return fmt.Errorf("can't read part copy: %w", err)
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, body); err != nil {
+		return fmt.Errorf("can't read part copy: %w", err)
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("part copy at %s differs from the source", dst.GetStorageURL())
+	}
+
+	if checksum != "" && hex.EncodeToString(sum) != checksum {
+		return fmt.Errorf("part %s doesn't match its checksum", path)
+	}
+
+	return nil
+}
+
+// settle finishes a move interrupted after metadata was switched, or drops its copy otherwise.
+// A copy is kept wherever a known part still references it.
+func (r *rebalancer) settle(ctx context.Context, move domain.PartMove) error {
+	stale := move.To
+	if move.Committed {
+		stale = move.From
+	}
+
+	parts, err := r.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list parts: %w", err)
+	}
+
+	if keptAt(parts, stale, move.Path) {
+		return nil
+	}
+
+	storage, err := r.storageManager.GetStorage(ctx, stale)
+	if err != nil {
+		return fmt.Errorf("can't get storage error: %w", err)
+	}
+
+	// The copy may have never been written.
+	if err = storage.DeleteFilePart(ctx, move.Path); err != nil {
+		level.Info(r.logger).Log("msg", "can't delete stale part copy",
+			"path", move.Path,
+			"storage", stale,
+			"err", err,
+		)
+	}
+
+	return nil
+}
+
+func (r *rebalancer) snapshot() domain.RebalanceStatus {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.status
+}
+
+// update changes the status of a running run and saves it, so the run can be resumed from there.
+func (r *rebalancer) update(ctx context.Context, change func(status *domain.RebalanceStatus)) {
+	r.m.Lock()
+	change(&r.status)
+	status := r.status
+	r.m.Unlock()
+
+	if err := r.stateStorage.PutRebalanceStatus(ctx, status); err != nil {
+		level.Error(r.logger).Log("msg", "can't put rebalance status",
+			"err", err,
+		)
+	}
+}
+
+func (r *rebalancer) fail(ctx context.Context, err error) {
+	level.Error(r.logger).Log("msg", "rebalancing failed",
+		"err", err,
+	)
+
+	r.update(ctx, func(status *domain.RebalanceStatus) { status.LastError = err.Error() })
+
+	r.m.Lock()
+	r.again = false
+	r.m.Unlock()
+
+	r.finish(ctx)
+}
+
+// finish ends the run and returns true, unless more work was requested meanwhile.
+func (r *rebalancer) finish(ctx context.Context) bool {
+	r.m.Lock()
+	if r.again {
+		r.again = false
+		r.m.Unlock()
+
+		return false
+	}
+
+	r.status.Running = false
+	r.status.FinishedAt = time.Now().UTC()
+	status := r.status
+	cancel := r.cancel
+	r.cancel = nil
+	r.m.Unlock()
+
+	if err := r.stateStorage.PutRebalanceStatus(ctx, status); err != nil {
+		level.Error(r.logger).Log("msg", "can't put rebalance status",
+			"err", err,
+		)
+	}
+	cancel()
+
+	level.Info(r.logger).Log("msg", "rebalancing finished",
+		"moved_parts", status.MovedParts,
+		"moved_bytes", status.MovedBytes,
+		"failed_moves", status.FailedMoves,
+	)
+
+	return true
+}
+
+// sharesZone reports whether a copy of the part other than the one at from is in zone.
+func sharesZone(part domain.FilePart, from, zone string, zones map[string]string) bool {
+	for _, url := range part.Locations() {
+		if url != from && zones[url] == zone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storedLength returns how many bytes the part takes on a storage, short of encryption overhead.
+func storedLength(part domain.FilePart) int64 {
+	if part.CompressedLength > 0 {
+		return part.CompressedLength
+	}
+
+	return part.ContentLength
+}
+
+func moveKey(move domain.PartMove) string {
+	return strings.Join([]string{move.Path, move.From, move.To}, "\x00")
+}
+
+// throttledReader delays reads so that on average no more than rate bytes per second pass through.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{ctx: ctx, r: r, rate: rate, start: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the pace even rather than bursting a whole buffer at once.
+	if limit := t.rate/10 + 1; int64(len(p)) > limit {
+		p = p[:limit]
+	}
+
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	wait := time.Until(t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))))
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/jsonfile"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+func waitRebalanced(t *testing.T, rebalancer server.Rebalancer) domain.RebalanceStatus {
+	t.Helper()
+
+	var status domain.RebalanceStatus
+	require.Eventually(t, func() bool {
+		var err error
+		status, err = rebalancer.Status(context.Background())
+		require.NoError(t, err)
+
+		return !status.Running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return status
+}
+
+func TestRebalancerMovesParts(t *testing.T) {
+	ctx := context.Background()
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 2)
+	svc := NewService(fileMetaStorage, storageManager)
+
+	files := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 1024*1024)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		name := fmt.Sprintf("file_%d", i)
+		files[name] = data
+		require.Equal(t, data, putAndGet(t, svc, name, data))
+	}
+
+	for i := 2; i < 4; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		require.NoError(t, storageManager.AddStorage(ctx, url, inmemory.NewStorage(url, log.NewNopLogger()), domain.StorageLabels{}))
+	}
+
+	rebalancer := NewRebalancer(fileMetaStorage, storageManager, inmemory.NewRebalanceStateStorage(), log.NewNopLogger(),
+		WithRebalanceThreshold(256*1024))
+	require.NoError(t, rebalancer.Start(ctx))
+
+	status := waitRebalanced(t, rebalancer)
+	assert.Greater(t, status.MovedParts, 0)
+	assert.Zero(t, status.FailedMoves)
+	assert.Nil(t, status.Current)
+
+	storages, err := storageManager.ListStorages(ctx)
+	require.NoError(t, err)
+
+	minFree, maxFree := int(^uint(0)>>1), 0
+	for _, storage := range storages {
+		free, err := storage.GetFreeSpace()
+		require.NoError(t, err)
+
+		if free < minFree {
+			minFree = free
+		}
+		if free > maxFree {
+			maxFree = free
+		}
+	}
+
+	// Parts are 200 kB, so storages end up within a couple of parts of each other.
+	assert.Less(t, maxFree-minFree, 512*1024)
+
+	for name, data := range files {
+		file, err := svc.GetFile(ctx, name)
+		require.NoError(t, err)
+
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, name)
+	}
+
+	assert.Equal(t, 5*1024*1024, usedSpace(t, storageManager))
+}
+
+// replacingStorage runs replace with the path of the first part read from it.
+type replacingStorage struct {
+	interfaces.Storage
+	once    sync.Once
+	replace func(path string)
+}
+
+func (r *replacingStorage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	r.once.Do(func() { r.replace(path) })
+	return r.Storage.ReadFilePart(ctx, path)
+}
+
+func TestRebalancerSkipsPartReplacedWhileCopied(t *testing.T) {
+	ctx := context.Background()
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 1)
+	svc := NewService(fileMetaStorage, storageManager, WithSplit(1, 0))
+
+	files := map[string][]byte{}
+	for _, name := range []string{"a", "b"} {
+		files[name] = bytes.Repeat([]byte(name), 128*1024)
+		require.Equal(t, files[name], putAndGet(t, svc, name, files[name]))
+	}
+	source, err := storageManager.GetStorage(ctx, "storage_0")
+	require.NoError(t, err)
+
+	// Another version of the file takes the same path once its part is copied, while the copy is verified.
+	target := &replacingStorage{Storage: inmemory.NewStorage("storage_1", log.NewNopLogger())}
+	target.replace = func(path string) {
+		for name := range files {
+			meta, err := fileMetaStorage.GetFileMeta(ctx, name)
+			require.NoError(t, err)
+			if meta.Parts[0].Path != path {
+				continue
+			}
+
+			files[name] = bytes.Repeat([]byte("new"), 64*1024)
+			require.NoError(t, source.UploadFilePart(ctx, path, bytes.NewReader(files[name])))
+			sum := sha256.Sum256(files[name])
+			meta.Parts[0].Checksum = hex.EncodeToString(sum[:])
+			meta.Parts[0].ContentLength = int64(len(files[name]))
+			meta.Parts[0].CompressedLength = meta.Parts[0].ContentLength
+			meta.ContentLength = meta.Parts[0].ContentLength
+			require.NoError(t, fileMetaStorage.StartProcessingFileMeta(ctx, meta))
+			require.NoError(t, fileMetaStorage.CompleteFileMeta(ctx, meta))
+		}
+	}
+	require.NoError(t, storageManager.AddStorage(ctx, "storage_1", target, domain.StorageLabels{}))
+
+	rebalancer := NewRebalancer(fileMetaStorage, storageManager, inmemory.NewRebalanceStateStorage(), log.NewNopLogger(),
+		WithRebalanceThreshold(1))
+	require.NoError(t, rebalancer.Start(ctx))
+	waitRebalanced(t, rebalancer)
+
+	for name, data := range files {
+		file, err := svc.GetFile(ctx, name)
+		require.NoError(t, err)
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, file.Body.Close())
+		require.NoError(t, err)
+		assert.Equal(t, string(data), string(got), name)
+	}
+}
+
+func TestRebalancerResumeSettlesInterruptedMove(t *testing.T) {
+	ctx := context.Background()
+	storageManager := newTestStorageManager(t, 2)
+	stateStorage := inmemory.NewRebalanceStateStorage()
+
+	target, err := storageManager.GetStorage(ctx, "storage_1")
+	require.NoError(t, err)
+	require.NoError(t, target.UploadFilePart(ctx, "file.part0", bytes.NewReader([]byte("half-copied"))))
+
+	require.NoError(t, stateStorage.PutRebalanceStatus(ctx, domain.RebalanceStatus{
+		Running: true,
+		Current: &domain.PartMove{Path: "file.part0", From: "storage_0", To: "storage_1"},
+	}))
+
+	rebalancer := NewRebalancer(inmemory.NewFileMetaStorage(), storageManager, stateStorage, log.NewNopLogger())
+	require.NoError(t, rebalancer.Resume(ctx))
+
+	status := waitRebalanced(t, rebalancer)
+	assert.Nil(t, status.Current)
+
+	free, err := target.GetFreeSpace()
+	require.NoError(t, err)
+	assert.Equal(t, 100*1024*1024, free)
+
+	// Nothing was interrupted this time, so there is nothing to resume.
+	require.NoError(t, rebalancer.Resume(ctx))
+	status, err = rebalancer.Status(ctx)
+	require.NoError(t, err)
+	assert.False(t, status.Running)
+}
+
+func TestRebalancerResumesAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 1)
+	svc := NewService(fileMetaStorage, storageManager)
+
+	files := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 1024*1024)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		name := fmt.Sprintf("file_%d", i)
+		files[name] = data
+		require.Equal(t, data, putAndGet(t, svc, name, data))
+	}
+	require.NoError(t, storageManager.AddStorage(ctx, "storage_1", inmemory.NewStorage("storage_1", log.NewNopLogger()), domain.StorageLabels{}))
+
+	meta, err := fileMetaStorage.GetFileMeta(ctx, "file_0")
+	require.NoError(t, err)
+	target, err := storageManager.GetStorage(ctx, "storage_1")
+	require.NoError(t, err)
+	require.NoError(t, target.UploadFilePart(ctx, meta.Parts[0].Path, bytes.NewReader([]byte("half-copied"))))
+
+	// The server stopped in the middle of a run, while copying a part.
+	path := filepath.Join(t.TempDir(), "rebalance.json")
+	stateStorage, err := jsonfile.NewRebalanceStateStorage(path)
+	require.NoError(t, err)
+	startedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, stateStorage.PutRebalanceStatus(ctx, domain.RebalanceStatus{
+		Running:    true,
+		StartedAt:  startedAt,
+		MovedParts: 2,
+		Current:    &domain.PartMove{Path: meta.Parts[0].Path, From: "storage_0", To: "storage_1"},
+	}))
+
+	// It's started again over the same state file.
+	stateStorage, err = jsonfile.NewRebalanceStateStorage(path)
+	require.NoError(t, err)
+	rebalancer := NewRebalancer(fileMetaStorage, storageManager, stateStorage, log.NewNopLogger(),
+		WithRebalanceThreshold(256*1024))
+	require.NoError(t, rebalancer.Resume(ctx))
+
+	status := waitRebalanced(t, rebalancer)
+	assert.Equal(t, startedAt, status.StartedAt)
+	assert.Greater(t, status.MovedParts, 2)
+	assert.Zero(t, status.FailedMoves)
+	assert.Nil(t, status.Current)
+
+	for name, data := range files {
+		file, err := svc.GetFile(ctx, name)
+		require.NoError(t, err)
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, file.Body.Close())
+		require.NoError(t, err)
+		assert.Equal(t, data, got, name)
+	}
+	assert.Equal(t, 5*1024*1024, usedSpace(t, storageManager))
+
+	// The finished run is what the next start finds.
+	stateStorage, err = jsonfile.NewRebalanceStateStorage(path)
+	require.NoError(t, err)
+	saved, err := stateStorage.GetRebalanceStatus(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, status, saved)
+}
+
+func TestRebalancerDrain(t *testing.T) {
+	ctx := context.Background()
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 4)
+	svc := NewService(fileMetaStorage, storageManager, WithReplication(2))
+
+	files := map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 512*1024)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		name := fmt.Sprintf("file_%d", i)
+		files[name] = data
+		require.Equal(t, data, putAndGet(t, svc, name, data))
+	}
+
+	rebalancer := NewRebalancer(fileMetaStorage, storageManager, inmemory.NewRebalanceStateStorage(), log.NewNopLogger())
+	require.NoError(t, rebalancer.Drain(ctx, "storage_0"))
+
+	status := waitRebalanced(t, rebalancer)
+	assert.Zero(t, status.FailedMoves)
+
+	drain, err := rebalancer.DrainStatus(ctx, "storage_0")
+	require.NoError(t, err)
+	assert.Equal(t, domain.DrainStatus{URL: "storage_0", Removed: true}, drain)
+
+	_, err = storageManager.GetStorage(ctx, "storage_0")
+	assert.ErrorIs(t, err, domain.ErrStorageNotFound)
+
+	for name, data := range files {
+		meta, err := fileMetaStorage.GetFileMeta(ctx, name)
+		require.NoError(t, err)
+		for _, part := range meta.Parts {
+			assert.NotContains(t, part.Locations(), "storage_0")
+			assert.Len(t, part.Locations(), 2)
+		}
+
+		file, err := svc.GetFile(ctx, name)
+		require.NoError(t, err)
+
+		got, err := io.ReadAll(file.Body)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, name)
+	}
+
+	_, err = rebalancer.DrainStatus(ctx, "storage_9")
+	assert.ErrorIs(t, err, domain.ErrStorageNotFound)
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+const defaultHeartbeatTimeout = 30 * time.Second
+
+type storageRegistry struct {
+	storageManager   interfaces.StorageManager
+	registryStorage  interfaces.RegistryStorage
+	connector        interfaces.StorageConnector
+	nodeKey          []byte
+	heartbeatTimeout time.Duration
+	logger           log.Logger
+
+	m          sync.Mutex
+	heartbeats map[string]time.Time
+}
+
+// StorageRegistryOption configures optional behaviour of the storage registry.
+type StorageRegistryOption func(r *storageRegistry)
+
+// WithNodeKey lets storage nodes presenting key register themselves. Self-registration is disabled without it.
+func WithNodeKey(key string) StorageRegistryOption {
+	return func(r *storageRegistry) {
+		r.nodeKey = []byte(key)
+	}
+}
+
+// WithHeartbeatTimeout sets how long a self-registered node may stay silent before its probes fail.
+func WithHeartbeatTimeout(timeout time.Duration) StorageRegistryOption {
+	return func(r *storageRegistry) {
+		if timeout > 0 {
+			r.heartbeatTimeout = timeout
+		}
+	}
+}
+
+// NewStorageRegistry returns a registry adding storages to storageManager and remembering them in registryStorage.
+func NewStorageRegistry(storageManager interfaces.StorageManager, registryStorage interfaces.RegistryStorage,
+	connector interfaces.StorageConnector, logger log.Logger, opts ...StorageRegistryOption) server.StorageRegistry {
+	r := &storageRegistry{
+		storageManager:   storageManager,
+		registryStorage:  registryStorage,
+		connector:        connector,
+		heartbeatTimeout: defaultHeartbeatTimeout,
+		logger:           logger,
+		heartbeats:       map[string]time.Time{},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *storageRegistry) Register(ctx context.Context, reg domain.StorageRegistration) (domain.StorageRegistration, error) {
+	reg.URL = strings.TrimRight(reg.URL, "/")
+	if reg.URL == "" {
+		return domain.StorageRegistration{}, fmt.Errorf("%w: empty storage URL", domain.ErrInvalid)
+	}
+
+	existing, found, err := r.registryStorage.GetRegistration(ctx, reg.URL)
+	if err != nil {
+		return domain.StorageRegistration{}, fmt.Errorf("can't get registration: %w", err)
+	}
+
+	// A node registering again after its own restart keeps its registration.
+	if found {
+		if existing.Type != reg.Type || existing.Self != reg.Self {
+			return domain.StorageRegistration{}, fmt.Errorf("%w: %s is registered as %s", domain.ErrStorageExists,
+				reg.URL, existing.Type)
+		}
+
+		// The storage may have just been drained away, its registration not pruned yet.
+		if _, err = r.storageManager.GetStorage(ctx, reg.URL); errors.Is(err, domain.ErrStorageNotFound) {
+			if err = r.add(ctx, existing); err != nil {
+				return domain.StorageRegistration{}, err
+			}
+		}
+
+		return r.withHeartbeat(existing, true), nil
+	}
+
+	reg.RegisteredAt = time.Now().UTC()
+	if err = r.add(ctx, reg); err != nil {
+		return domain.StorageRegistration{}, err
+	}
+
+	if err = r.registryStorage.PutRegistration(ctx, reg); err != nil {
+		if removeErr := r.storageManager.RemoveStorage(ctx, reg.URL); removeErr != nil {
+			level.Error(r.logger).Log("msg", "can't remove storage after failed registration",
+				"storage", reg.URL,
+				"err", removeErr,
+			)
+		}
+
+		return domain.StorageRegistration{}, fmt.Errorf("can't put registration: %w", err)
+	}
+
+	level.Info(r.logger).Log("msg", "storage registered",
+		"storage", reg.URL,
+		"type", reg.Type,
+		"self", reg.Self,
+	)
+
+	return r.withHeartbeat(reg, true), nil
+}
+
+func (r *storageRegistry) Heartbeat(ctx context.Context, storageURL string) error {
+	storageURL = strings.TrimRight(storageURL, "/")
+
+	reg, found, err := r.registryStorage.GetRegistration(ctx, storageURL)
+	if err != nil {
+		return fmt.Errorf("can't get registration: %w", err)
+	}
+
+	// The node registers again when told it's unknown.
+	if !found || !reg.Self {
+		return fmt.Errorf("%w: %s", domain.ErrStorageNotFound, storageURL)
+	}
+
+	r.withHeartbeat(reg, true)
+
+	return nil
+}
+
+func (r *storageRegistry) CheckHeartbeat(ctx context.Context, storageURL string) error {
+	r.m.Lock()
+	last, ok := r.heartbeats[storageURL]
+	r.m.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if silent := time.Since(last); silent > r.heartbeatTimeout {
+		return fmt.Errorf("no heartbeat for %s", silent.Round(time.Second))
+	}
+
+	return nil
+}
+
+func (r *storageRegistry) List(ctx context.Context) ([]domain.StorageRegistration, error) {
+	regs, err := r.registryStorage.ListRegistrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't list registrations: %w", err)
+	}
+
+	for i := range regs {
+		regs[i] = r.withHeartbeat(regs[i], false)
+	}
+
+	return regs, nil
+}
+
+func (r *storageRegistry) VerifyNodeKey(key string) error {
+	if len(r.nodeKey) == 0 || subtle.ConstantTimeCompare(r.nodeKey, []byte(key)) != 1 {
+		return domain.ErrInvalidNodeKey
+	}
+
+	return nil
+}
+
+func (r *storageRegistry) Restore(ctx context.Context) error {
+	regs, err := r.registryStorage.ListRegistrations(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list registrations: %w", err)
+	}
+
+	for _, reg := range regs {
+		if err = r.add(ctx, reg); err != nil {
+			return err
+		}
+
+		// Nodes get a full heartbeat timeout to find the restarted server.
+		if reg.Self {
+			r.withHeartbeat(reg, true)
+		}
+	}
+
+	level.Info(r.logger).Log("msg", "storage registry restored",
+		"storages", len(regs),
+	)
+
+	return nil
+}
+
+func (r *storageRegistry) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.heartbeatTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := r.prune(ctx); err != nil {
+				level.Error(r.logger).Log("msg", "can't prune storage registry",
+					"err", err,
+				)
+			}
+		}
+	}
+}
+
+// prune forgets registrations of storages removed from the storage manager, e.g. after draining.
+func (r *storageRegistry) prune(ctx context.Context) error {
+	regs, err := r.registryStorage.ListRegistrations(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list registrations: %w", err)
+	}
+
+	for _, reg := range regs {
+		_, err = r.storageManager.GetStorage(ctx, reg.URL)
+		if !errors.Is(err, domain.ErrStorageNotFound) {
+			continue
+		}
+
+		if err = r.registryStorage.DeleteRegistration(ctx, reg.URL); err != nil {
+			return fmt.Errorf("can't delete registration: %w", err)
+		}
+
+		r.m.Lock()
+		delete(r.heartbeats, reg.URL)
+		r.m.Unlock()
+
+		level.Info(r.logger).Log("msg", "storage unregistered",
+			"storage", reg.URL,
+		)
+	}
+
+	return nil
+}
+
+// add connects to the storage and adds it to the storage manager.
+func (r *storageRegistry) add(ctx context.Context, reg domain.StorageRegistration) error {
+	storage, err := r.connector.Connect(ctx, reg)
+	if err != nil {
+		return fmt.Errorf("can't connect to storage: %w", err)
+	}
+
+	if err = r.storageManager.AddStorage(ctx, reg.URL, storage, reg.Labels); err != nil {
+		return fmt.Errorf("can't add storage: %w", err)
+	}
+
+	return nil
+}
+
+// withHeartbeat fills in the last heartbeat of a self-registered node, recording one now if beat is set.
+func (r *storageRegistry) withHeartbeat(reg domain.StorageRegistration, beat bool) domain.StorageRegistration {
+	if !reg.Self {
+		return reg
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if beat {
+		r.heartbeats[reg.URL] = time.Now().UTC()
+	}
+	reg.LastHeartbeat = r.heartbeats[reg.URL]
+
+	return reg
+}
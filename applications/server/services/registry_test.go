@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/adapters/connector"
+	"github.com/donmikel/karma8/applications/server/adapters/jsonfile"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+func newTestRegistry(t *testing.T, storageManager interfaces.StorageManager, path string) server.StorageRegistry {
+	t.Helper()
+
+	registryStorage, err := jsonfile.NewRegistryStorage(path)
+	require.NoError(t, err)
+
+	return NewStorageRegistry(storageManager, registryStorage, connector.New(nil, log.NewNopLogger()), log.NewNopLogger(),
+		WithNodeKey("secret"), WithHeartbeatTimeout(50*time.Millisecond))
+}
+
+func TestStorageRegistry(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	storageManager := newTestStorageManager(t, 0)
+	registry := newTestRegistry(t, storageManager, path)
+
+	_, err := registry.Register(ctx, domain.StorageRegistration{
+		URL:    "storage_0",
+		Type:   domain.StorageTypeMemory,
+		Labels: domain.StorageLabels{Zone: "a"},
+	})
+	require.NoError(t, err)
+
+	_, err = registry.Register(ctx, domain.StorageRegistration{URL: "storage_0", Type: domain.StorageTypeHTTP})
+	assert.ErrorIs(t, err, domain.ErrStorageExists)
+
+	_, err = registry.Register(ctx, domain.StorageRegistration{URL: "storage_1", Type: "tape"})
+	assert.Error(t, err)
+
+	node, err := registry.Register(ctx, domain.StorageRegistration{URL: "node_0/", Type: domain.StorageTypeMemory, Self: true})
+	require.NoError(t, err)
+	assert.Equal(t, "node_0", node.URL)
+	assert.False(t, node.LastHeartbeat.IsZero())
+
+	assert.NoError(t, registry.VerifyNodeKey("secret"))
+	assert.ErrorIs(t, registry.VerifyNodeKey("guess"), domain.ErrInvalidNodeKey)
+
+	assert.NoError(t, registry.CheckHeartbeat(ctx, "node_0"))
+	assert.Eventually(t, func() bool {
+		return registry.CheckHeartbeat(ctx, "node_0") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, registry.Heartbeat(ctx, "node_0"))
+	assert.NoError(t, registry.CheckHeartbeat(ctx, "node_0"))
+	assert.ErrorIs(t, registry.Heartbeat(ctx, "storage_0"), domain.ErrStorageNotFound)
+	assert.ErrorIs(t, registry.Heartbeat(ctx, "node_9"), domain.ErrStorageNotFound)
+
+	// A restarted server finds registered storages in the registry file.
+	restored := newTestStorageManager(t, 0)
+	require.NoError(t, newTestRegistry(t, restored, path).Restore(ctx))
+
+	storages, err := restored.ListStorages(ctx)
+	require.NoError(t, err)
+	require.Len(t, storages, 2)
+
+	labels, err := restored.GetStorageLabels(ctx, "storage_0")
+	require.NoError(t, err)
+	assert.Equal(t, domain.StorageLabels{Zone: "a"}, labels)
+
+	// Registrations of removed storages are pruned.
+	require.NoError(t, storageManager.RemoveStorage(ctx, "storage_0"))
+	require.NoError(t, registry.(*storageRegistry).prune(ctx))
+
+	regs, err := registry.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	assert.Equal(t, "node_0", regs[0].URL)
+	assert.True(t, regs[0].Self)
+}
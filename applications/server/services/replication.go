@@ -0,0 +1,320 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+const (
+	defaultReplicas = 1
+	// uploadAttempts is how many times a part is uploaded before giving up when storages fail.
+	uploadAttempts = 3
+	// maxReplayBuffer caps how much of a part is kept in memory to be uploaded again after a storage fails.
+	maxReplayBuffer = 64 * 1024 * 1024 // 64 MB
+)
+
+// partStorages resolves every location of the part to a storage.
+func (s *service) partStorages(ctx context.Context, part domain.FilePart) ([]interfaces.Storage, error) {
+	result := make([]interfaces.Storage, 0, len(part.Replicas)+1)
+	for _, url := range part.Locations() {
+		storage, err := s.storageManager.GetStorage(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("can't get storage error: %w", err)
+		}
+
+		result = append(result, storage)
+	}
+
+	return result, nil
+}
+
+// storageError is a failure of a storage, as opposed to a failure to read what is uploaded.
+type storageError struct {
+	url string
+	err error
+}
+
+func (e *storageError) Error() string {
+	return fmt.Sprintf("storage %s: %v", e.url, e.err)
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// bodyReader remembers an error of the reader it wraps, to tell it apart from errors of storages.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.err = err
+	}
+
+	return n, err
+}
+
+// uploadReplicated streams body to every storage at once. The body is read a single time;
+// if any storage fails, the others get an error from the body and the upload stops.
+// A failure of a storage is returned as *storageError naming the first storage that failed.
+func uploadReplicated(ctx context.Context, storages []interfaces.Storage, path string, body io.Reader) error {
+	src := &bodyReader{r: body}
+
+	if len(storages) == 1 {
+		err := storages[0].UploadFilePart(ctx, path, src)
+		if err != nil && src.err == nil {
+			return &storageError{url: storages[0].GetStorageURL(), err: err}
+		}
+
+		return err
+	}
+
+	var (
+		m            sync.Mutex
+		aborted      bool
+		firstFailure *storageError
+	)
+
+	group, ctx := errgroup.WithContext(ctx)
+	writers := make([]io.Writer, 0, len(storages))
+	pipes := make([]*io.PipeWriter, 0, len(storages))
+	for _, storage := range storages {
+		storage := storage
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		pipes = append(pipes, pw)
+
+		group.Go(func() error {
+			err := storage.UploadFilePart(ctx, path, pr)
+			if err != nil {
+				// The failure is recorded before the pipe closes, so storages failing only
+				// because the upload was aborted after it are not blamed.
+				m.Lock()
+				if firstFailure == nil && !aborted {
+					firstFailure = &storageError{url: storage.GetStorageURL(), err: err}
+				}
+				m.Unlock()
+			}
+
+			pr.CloseWithError(err)
+			if err != nil {
+				return fmt.Errorf("storage %s: %w", storage.GetStorageURL(), err)
+			}
+
+			return nil
+		})
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), src)
+	if err != nil {
+		m.Lock()
+		aborted = true
+		m.Unlock()
+	}
+
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+
+	waitErr := group.Wait()
+
+	switch {
+	case src.err != nil:
+		return src.err
+	case firstFailure != nil:
+		return firstFailure
+	case waitErr != nil:
+		return waitErr
+	default:
+		return err
+	}
+}
+
+// partBody is a part being uploaded, started over for every attempt to upload it.
+type partBody interface {
+	io.Reader
+	// rewind starts the part over. It returns false if it can't be.
+	rewind() bool
+}
+
+// memoryBody is a part held in memory as it's stored.
+type memoryBody struct {
+	*bytes.Reader
+}
+
+func (b memoryBody) rewind() bool {
+	_, err := b.Seek(0, io.SeekStart)
+	return err == nil
+}
+
+// uploadWithFailover uploads body to storages. When one of them fails, it's marked degraded and the part
+// is uploaded again to storages picked anew for key, as long as body can be rewound.
+// It returns storages keeping the part. When the upload fails, what its last attempt left is deleted.
+func (s *service) uploadWithFailover(ctx context.Context, key string, storages []interfaces.Storage, path string,
+	body partBody) ([]interfaces.Storage, error) {
+	for attempt := 1; ; attempt++ {
+		err := uploadReplicated(ctx, storages, path, body)
+		if err == nil {
+			return storages, nil
+		}
+
+		var failed *storageError
+		if !errors.As(err, &failed) || attempt == uploadAttempts || ctx.Err() != nil || !body.rewind() {
+			s.deleteAbandoned(ctx, storages, nil, path)
+			return nil, err
+		}
+
+		level.Warn(logging.With(ctx, s.logger)).Log("msg", "storage failed to take part, retrying elsewhere",
+			"storage", failed.url,
+			"path", path,
+			"err", failed.err,
+		)
+
+		if setErr := s.storageManager.SetStorageHealth(ctx, failed.url, domain.HealthDegraded); setErr != nil {
+			s.deleteAbandoned(ctx, storages, nil, path)
+			return nil, fmt.Errorf("can't mark storage degraded: %w", setErr)
+		}
+
+		picked, pickErr := s.storageManager.GetStorages(ctx, key, 1, len(storages))
+		if pickErr != nil {
+			s.deleteAbandoned(ctx, storages, nil, path)
+			// Storages running out of room is why none are left to retry with, so that's what's reported.
+			if errors.Is(err, domain.ErrNoSpace) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("can't get storages to retry upload after %v: %w", err, pickErr)
+		}
+
+		s.deleteAbandoned(ctx, storages, picked[0], path)
+		storages = picked[0]
+	}
+}
+
+// deleteAbandoned deletes what an attempt to upload the part at path left on storages it isn't retried with,
+// so a failover leaves no partial copies behind. Every upload writes to paths of its own, so nothing but what
+// the attempt wrote is there. Failures are only logged, as the retry goes on regardless.
+func (s *service) deleteAbandoned(ctx context.Context, attempted, retried []interfaces.Storage, path string) {
+	kept := make(map[string]bool, len(retried))
+	for _, storage := range retried {
+		kept[storage.GetStorageURL()] = true
+	}
+
+	for _, storage := range attempted {
+		if kept[storage.GetStorageURL()] {
+			continue
+		}
+
+		err := storage.DeleteFilePart(ctx, path)
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			level.Warn(logging.With(ctx, s.logger)).Log("msg", "can't delete part left by failed upload",
+				"storage", storage.GetStorageURL(),
+				"path", path,
+				"err", err,
+			)
+		}
+	}
+}
+
+// replayReader remembers what is read through it, up to limit bytes, so reading can start over.
+type replayReader struct {
+	r        io.Reader
+	buf      []byte
+	pos      int
+	limit    int
+	overflow bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.pos < len(r.buf) {
+		n := copy(p, r.buf[r.pos:])
+		r.pos += n
+
+		return n, nil
+	}
+
+	n, err := r.r.Read(p)
+	if !r.overflow {
+		if len(r.buf)+n > r.limit {
+			r.overflow = true
+			r.buf = nil
+		} else {
+			r.buf = append(r.buf, p[:n]...)
+		}
+		r.pos = len(r.buf)
+	}
+
+	return n, err
+}
+
+// rewind starts reading over. It returns false if too much was read to remember it all.
+func (r *replayReader) rewind() bool {
+	if r.overflow {
+		return false
+	}
+
+	r.pos = 0
+
+	return true
+}
+
+// deleteReplicated deletes the part from every storage keeping it. All storages are tried; the first error is returned.
+func (s *service) deleteReplicated(ctx context.Context, part domain.FilePart, keep []domain.FilePart) error {
+	var firstErr error
+	for _, url := range part.Locations() {
+		if keptAt(keep, url, part.Path) {
+			continue
+		}
+
+		storage, err := s.storageManager.GetStorage(ctx, url)
+		if err == nil {
+			err = storage.DeleteFilePart(ctx, part.Path)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("can't delete file part from %s: %w", url, err)
+		}
+	}
+
+	return firstErr
+}
+
+// keptAt reports whether one of parts is stored at url under path.
+func keptAt(parts []domain.FilePart, url, path string) bool {
+	for _, part := range parts {
+		if part.Path != path {
+			continue
+		}
+
+		for _, location := range part.Locations() {
+			if location == url {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// setLocations points the part at storages, the first one being primary.
+func setLocations(part *domain.FilePart, storages []interfaces.Storage) {
+	part.StorageURL = storages[0].GetStorageURL()
+	part.Replicas = make([]string, 0, len(storages)-1)
+	for _, storage := range storages[1:] {
+		part.Replicas = append(part.Replicas, storage.GetStorageURL())
+	}
+}
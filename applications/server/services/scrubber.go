@@ -0,0 +1,454 @@
+package services
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/cache"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+const (
+	defaultScrubInterval  = 24 * time.Hour
+	defaultScrubRateLimit = 10 * 1024 * 1024 // 10 MB/s
+	maxScrubFindings      = 1000
+)
+
+type scrubber struct {
+	fileMetaStorage interfaces.FileMetaStorage
+	storageManager  interfaces.StorageManager
+	interval        time.Duration
+	// rateLimit may be changed while a scrub is in progress.
+	rateLimit  atomic.Int64
+	keyWrapper interfaces.KeyWrapper
+	logger     log.Logger
+
+	m      sync.Mutex
+	report domain.ScrubReport
+}
+
+// ScrubberOption configures optional behaviour of the scrubber.
+type ScrubberOption func(s *scrubber)
+
+// WithScrubInterval sets how often Run scrubs every stored part.
+func WithScrubInterval(interval time.Duration) ScrubberOption {
+	return func(s *scrubber) {
+		if interval > 0 {
+			s.interval = interval
+		}
+	}
+}
+
+// WithScrubRateLimit caps how many bytes per second are read from storages. Zero means no limit.
+func WithScrubRateLimit(bytesPerSecond int64) ScrubberOption {
+	return func(s *scrubber) {
+		s.rateLimit.Store(bytesPerSecond)
+	}
+}
+
+// WithScrubDecryption opens every chunk of encrypted parts with data keys keyWrapper unwraps, so damage is found
+// in parts stored before checksums were kept too.
+func WithScrubDecryption(keyWrapper interfaces.KeyWrapper) ScrubberOption {
+	return func(s *scrubber) {
+		s.keyWrapper = keyWrapper
+	}
+}
+
+// NewScrubber returns a scrubber reading back every stored copy of every part of complete files. Copies of
+// the wrong length, not matching their checksum, or with encrypted chunks that don't open are replaced with
+// intact replicas where there are any.
+func NewScrubber(fileMetaStorage interfaces.FileMetaStorage, storageManager interfaces.StorageManager,
+	logger log.Logger, opts ...ScrubberOption) server.Scrubber {
+	s := &scrubber{
+		fileMetaStorage: fileMetaStorage,
+		storageManager:  storageManager,
+		interval:        defaultScrubInterval,
+		logger:          logger,
+	}
+	s.rateLimit.Store(defaultScrubRateLimit)
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *scrubber) Start(ctx context.Context) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+
+	// The scrub outlives the request that started it.
+	go s.scrub(context.Background())
+
+	return nil
+}
+
+func (s *scrubber) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if err := s.begin(); err != nil {
+			level.Info(s.logger).Log("msg", "periodic scrub skipped",
+				"err", err,
+			)
+			continue
+		}
+
+		s.scrub(ctx)
+	}
+}
+
+func (s *scrubber) Report(ctx context.Context) (domain.ScrubReport, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	report := s.report
+	report.Findings = append([]domain.ScrubFinding(nil), s.report.Findings...)
+
+	return report, nil
+}
+
+func (s *scrubber) SetRateLimit(bytesPerSecond int64) {
+	WithScrubRateLimit(bytesPerSecond)(s)
+}
+
+// begin resets the report for a new scrub, unless one is running.
+func (s *scrubber) begin() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.report.Running {
+		return domain.ErrScrubRunning
+	}
+
+	s.report = domain.ScrubReport{Running: true, StartedAt: time.Now().UTC()}
+
+	return nil
+}
+
+func (s *scrubber) scrub(ctx context.Context) {
+	err := s.checkAll(ctx)
+
+	s.m.Lock()
+	s.report.Running = false
+	s.report.FinishedAt = time.Now().UTC()
+	if err != nil {
+		s.report.LastError = err.Error()
+	}
+	report := s.report
+	s.m.Unlock()
+
+	level.Info(s.logger).Log("msg", "scrub finished",
+		"checked_parts", report.CheckedParts,
+		"skipped_parts", report.SkippedParts,
+		"damaged", report.Damaged,
+		"repaired", report.Repaired,
+		"err", err,
+	)
+}
+
+// checkAll checks every copy of every part once, even if several files share it.
+func (s *scrubber) checkAll(ctx context.Context) error {
+	files, err := s.fileMetaStorage.ListFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list files: %w", err)
+	}
+
+	checked := map[string]bool{}
+	for _, meta := range files {
+		aead := s.fileDecryption(meta)
+		for i, part := range meta.Parts {
+			check := partCheck{
+				part:      part,
+				size:      sealedLength(storedLength(part), meta.Encryption),
+				aead:      aead,
+				index:     i,
+				chunkSize: meta.Encryption.ChunkSize,
+			}
+
+			for _, url := range part.Locations() {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+
+				key := url + "\x00" + part.Path
+				if checked[key] {
+					continue
+				}
+				checked[key] = true
+
+				s.checkCopy(ctx, meta.Name, check, url)
+			}
+		}
+	}
+
+	return nil
+}
+
+// partCheck is what copies of a part are checked against.
+type partCheck struct {
+	part domain.FilePart
+	// size is how many bytes a copy holds.
+	size int64
+	// aead opens chunks of an encrypted part, the index-th of its file. It's nil for parts stored in plaintext,
+	// and when the scrubber can't unwrap the data key.
+	aead      cipher.AEAD
+	index     int
+	chunkSize int
+}
+
+// fileDecryption returns a cipher opening chunks of the file's parts, or nil if there is none to check them with.
+func (s *scrubber) fileDecryption(meta domain.FileMeta) cipher.AEAD {
+	if s.keyWrapper == nil || meta.Encryption.Algorithm == "" {
+		return nil
+	}
+
+	aead, err := fileDecryption(s.keyWrapper, meta.Encryption)
+	if err != nil {
+		level.Error(s.logger).Log("msg", "can't check encrypted chunks of file",
+			"file", meta.Name,
+			"err", err,
+		)
+
+		return nil
+	}
+
+	return aead
+}
+
+// checkCopy checks the copy of the part at url, and repairs it if it's damaged.
+func (s *scrubber) checkCopy(ctx context.Context, name string, check partCheck, url string) {
+	part := check.part
+	var (
+		read    int64
+		problem string
+	)
+
+	storage, err := s.healthyStorage(ctx, url)
+	switch {
+	case errors.Is(err, domain.ErrStorageNotFound):
+		problem = "storage is not registered"
+	case errors.Is(err, errStorageUnhealthy):
+		s.m.Lock()
+		s.report.SkippedParts++
+		s.m.Unlock()
+
+		return
+	case err != nil:
+		level.Error(s.logger).Log("msg", "can't get storage",
+			"storage", url,
+			"err", err,
+		)
+
+		return
+	default:
+		read, problem = s.verify(ctx, storage, check)
+	}
+
+	s.m.Lock()
+	s.report.CheckedParts++
+	s.report.CheckedBytes += read
+	s.m.Unlock()
+
+	// The part may have been moved, or its file deleted or replaced, while it was read.
+	if problem == "" || ctx.Err() != nil || !s.stillStored(ctx, name, part, url) {
+		return
+	}
+
+	finding := domain.ScrubFinding{
+		File:       name,
+		Path:       part.Path,
+		StorageURL: url,
+		Problem:    problem,
+		FoundAt:    time.Now().UTC(),
+	}
+
+	level.Warn(s.logger).Log("msg", "damaged part copy found",
+		"file", name,
+		"path", part.Path,
+		"storage", url,
+		"problem", problem,
+	)
+
+	if err = s.repair(ctx, check, url); err != nil {
+		finding.RepairError = err.Error()
+
+		level.Error(s.logger).Log("msg", "can't repair part copy",
+			"path", part.Path,
+			"storage", url,
+			"err", err,
+		)
+	} else {
+		finding.Repaired = true
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.report.Damaged++
+	if finding.Repaired {
+		s.report.Repaired++
+	}
+	if len(s.report.Findings) < maxScrubFindings {
+		s.report.Findings = append(s.report.Findings, finding)
+	}
+}
+
+// verify reads the copy of the part at storage through and returns how much was read, and what's wrong with
+// the copy if anything is.
+func (s *scrubber) verify(ctx context.Context, storage interfaces.Storage, check partCheck) (int64, string) {
+	// The copy is checked as the storage keeps it, not as it may be cached.
+	body, err := storage.ReadFilePart(cache.Bypass(ctx), check.part.Path)
+	if err != nil {
+		return 0, fmt.Sprintf("can't read part: %v", err)
+	}
+	defer body.Close()
+
+	var reader io.Reader = body
+	if rateLimit := s.rateLimit.Load(); rateLimit > 0 {
+		reader = newThrottledReader(ctx, reader, rateLimit)
+	}
+
+	counted := &countingReader{r: reader}
+	h := sha256.New()
+	stored := io.TeeReader(counted, h)
+
+	var notAuthentic error
+	if check.aead != nil {
+		_, err = io.Copy(io.Discard, newDecryptingReader(io.NopCloser(stored), check.aead, check.index, check.chunkSize))
+		if errors.Is(err, errChunkNotAuthentic) {
+			// The rest is read through, so a copy of the wrong length is reported as such.
+			notAuthentic = err
+			_, err = io.Copy(io.Discard, stored)
+		}
+	} else {
+		_, err = io.Copy(io.Discard, stored)
+	}
+
+	read := counted.n
+	if err != nil {
+		return read, fmt.Sprintf("can't read part: %v", err)
+	}
+
+	if read != check.size {
+		return read, fmt.Sprintf("stored %d bytes, expected %d", read, check.size)
+	}
+
+	if checksum := check.part.StoredChecksum(); checksum != "" && hex.EncodeToString(h.Sum(nil)) != checksum {
+		return read, "content doesn't match its checksum"
+	}
+
+	if notAuthentic != nil {
+		return read, notAuthentic.Error()
+	}
+
+	return read, ""
+}
+
+// repair replaces the damaged copy at url with the first intact copy found at other locations of the part.
+func (s *scrubber) repair(ctx context.Context, check partCheck, url string) error {
+	dst, err := s.healthyStorage(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	part := check.part
+	err = errors.New("no other copy to repair from")
+	for _, location := range part.Locations() {
+		if location == url {
+			continue
+		}
+
+		src, srcErr := s.healthyStorage(ctx, location)
+		if srcErr != nil {
+			err = srcErr
+			continue
+		}
+
+		if _, problem := s.verify(ctx, src, check); problem != "" {
+			err = fmt.Errorf("copy at %s is damaged too: %s", location, problem)
+			continue
+		}
+
+		sum, copyErr := copyPart(ctx, src, dst, part.Path, s.rateLimit.Load())
+		if copyErr == nil {
+			copyErr = verifyCopy(ctx, dst, part.Path, sum, part.StoredChecksum())
+		}
+		if copyErr != nil {
+			err = fmt.Errorf("can't copy part from %s: %w", location, copyErr)
+			continue
+		}
+
+		level.Info(s.logger).Log("msg", "part copy repaired",
+			"path", part.Path,
+			"storage", url,
+			"from", location,
+		)
+
+		return nil
+	}
+
+	return err
+}
+
+// errStorageUnhealthy is returned for storages whose copies can't be checked or written now.
+var errStorageUnhealthy = errors.New("storage is not healthy")
+
+func (s *scrubber) healthyStorage(ctx context.Context, url string) (interfaces.Storage, error) {
+	health, err := s.storageManager.GetStorageHealth(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if health != domain.HealthHealthy {
+		return nil, fmt.Errorf("%w: %s is %s", errStorageUnhealthy, url, health)
+	}
+
+	return s.storageManager.GetStorage(ctx, url)
+}
+
+// stillStored tells whether the file still keeps the same part at url.
+func (s *scrubber) stillStored(ctx context.Context, name string, part domain.FilePart, url string) bool {
+	meta, err := s.fileMetaStorage.GetFileMeta(ctx, name)
+	if err != nil {
+		return false
+	}
+
+	for _, current := range meta.Parts {
+		if current.Path != part.Path || current.ContentLength != part.ContentLength ||
+			current.CompressedLength != part.CompressedLength || current.Hash != part.Hash ||
+			current.Checksum != part.Checksum {
+			continue
+		}
+
+		for _, location := range current.Locations() {
+			if location == url {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+func waitScrubbed(t *testing.T, scrubber server.Scrubber) domain.ScrubReport {
+	t.Helper()
+
+	var report domain.ScrubReport
+	require.Eventually(t, func() bool {
+		var err error
+		report, err = scrubber.Report(context.Background())
+		require.NoError(t, err)
+
+		return !report.Running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return report
+}
+
+func TestScrubber(t *testing.T) {
+	ctx := context.Background()
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 4)
+
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	replicated := NewService(fileMetaStorage, storageManager, WithReplication(2))
+	single := NewService(fileMetaStorage, storageManager)
+	encrypted := NewService(fileMetaStorage, storageManager, WithCompression(domain.CodecGzip, nil), WithEncryption(keyWrapper))
+
+	files := map[string][]byte{}
+	for name, svc := range map[string]server.FileService{"replicated": replicated, "single": single, "encrypted": encrypted} {
+		data := make([]byte, 300*1024)
+		_, err = rand.Read(data)
+		require.NoError(t, err)
+
+		files[name] = data
+		require.Equal(t, data, putAndGet(t, svc, name, data))
+	}
+
+	scrubber := NewScrubber(fileMetaStorage, storageManager, log.NewNopLogger(), WithScrubRateLimit(0))
+	require.NoError(t, scrubber.Start(ctx))
+	report := waitScrubbed(t, scrubber)
+	assert.Zero(t, report.Damaged)
+	assert.Greater(t, report.CheckedParts, 0)
+
+	storageOf := func(url string) interfaces.Storage {
+		storage, err := storageManager.GetStorage(ctx, url)
+		require.NoError(t, err)
+
+		return storage
+	}
+
+	// One copy of a replicated part is truncated and another one lost; a part without replicas is overwritten.
+	meta, err := fileMetaStorage.GetFileMeta(ctx, "replicated")
+	require.NoError(t, err)
+	truncated, lost := meta.Parts[0], meta.Parts[1]
+	require.NoError(t, storageOf(truncated.StorageURL).UploadFilePart(ctx, truncated.Path, bytes.NewReader([]byte("short"))))
+	require.NoError(t, storageOf(lost.Replicas[0]).DeleteFilePart(ctx, lost.Path))
+
+	meta, err = fileMetaStorage.GetFileMeta(ctx, "single")
+	require.NoError(t, err)
+	overwritten := meta.Parts[0]
+	require.NoError(t, storageOf(overwritten.StorageURL).UploadFilePart(ctx, overwritten.Path,
+		bytes.NewReader(make([]byte, overwritten.ContentLength+1))))
+
+	require.NoError(t, scrubber.Start(ctx))
+	report = waitScrubbed(t, scrubber)
+	assert.Equal(t, 3, report.Damaged)
+	assert.Equal(t, 2, report.Repaired)
+	require.Len(t, report.Findings, 3)
+
+	byPath := map[string]domain.ScrubFinding{}
+	for _, finding := range report.Findings {
+		byPath[finding.Path] = finding
+	}
+	assert.True(t, byPath[truncated.Path].Repaired)
+	assert.Equal(t, truncated.StorageURL, byPath[truncated.Path].StorageURL)
+	assert.True(t, byPath[lost.Path].Repaired)
+	assert.Equal(t, lost.Replicas[0], byPath[lost.Path].StorageURL)
+	assert.False(t, byPath[overwritten.Path].Repaired)
+	assert.NotEmpty(t, byPath[overwritten.Path].RepairError)
+
+	file, err := replicated.GetFile(ctx, "replicated")
+	require.NoError(t, err)
+	got, err := io.ReadAll(file.Body)
+	require.NoError(t, err)
+	assert.Equal(t, files["replicated"], got)
+
+	// Only the part without an intact copy is still damaged.
+	require.NoError(t, scrubber.Start(ctx))
+	report = waitScrubbed(t, scrubber)
+	assert.Equal(t, 1, report.Damaged)
+	assert.Zero(t, report.Repaired)
+}
+
+func TestScrubberFindsFlippedBytes(t *testing.T) {
+	ctx := context.Background()
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	data := make([]byte, 300*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		// withoutChecksum stands for parts stored before checksums were kept, which only opening chunks tells apart.
+		withoutChecksum bool
+		opts            []ScrubberOption
+	}{
+		{name: "checksum"},
+		{name: "encrypted chunks", withoutChecksum: true, opts: []ScrubberOption{WithScrubDecryption(keyWrapper)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileMetaStorage := inmemory.NewFileMetaStorage()
+			storageManager := newTestStorageManager(t, 4)
+			svc := NewService(fileMetaStorage, storageManager, WithReplication(2), WithEncryption(keyWrapper))
+			require.Equal(t, data, putAndGet(t, svc, "file", data))
+
+			meta, err := fileMetaStorage.GetFileMeta(ctx, "file")
+			require.NoError(t, err)
+			if tt.withoutChecksum {
+				for i := range meta.Parts {
+					meta.Parts[i].Checksum = ""
+				}
+				require.NoError(t, fileMetaStorage.StartProcessingFileMeta(ctx, meta))
+				require.NoError(t, fileMetaStorage.CompleteFileMeta(ctx, meta))
+			}
+
+			// A byte in the middle of a copy is flipped; its length stays the same.
+			part := meta.Parts[1]
+			storage, err := storageManager.GetStorage(ctx, part.StorageURL)
+			require.NoError(t, err)
+			body, err := storage.ReadFilePart(ctx, part.Path)
+			require.NoError(t, err)
+			stored, err := io.ReadAll(body)
+			require.NoError(t, err)
+			require.NoError(t, body.Close())
+			stored[len(stored)/2] ^= 1
+			require.NoError(t, storage.UploadFilePart(ctx, part.Path, bytes.NewReader(stored)))
+
+			scrubber := NewScrubber(fileMetaStorage, storageManager, log.NewNopLogger(),
+				append([]ScrubberOption{WithScrubRateLimit(0)}, tt.opts...)...)
+			require.NoError(t, scrubber.Start(ctx))
+			report := waitScrubbed(t, scrubber)
+			assert.Equal(t, 1, report.Damaged)
+			assert.Equal(t, 1, report.Repaired)
+			require.Len(t, report.Findings, 1)
+			assert.Equal(t, part.StorageURL, report.Findings[0].StorageURL)
+
+			require.NoError(t, scrubber.Start(ctx))
+			assert.Zero(t, waitScrubbed(t, scrubber).Damaged)
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 
+	"github.com/go-kit/log"
+	"golang.org/x/sync/semaphore"
+
 	"github.com/donmikel/karma8/applications/server"
 	"github.com/donmikel/karma8/applications/server/domain"
 	"github.com/donmikel/karma8/applications/server/interfaces"
@@ -21,133 +27,484 @@ type service struct {
 	storageManager      interfaces.StorageManager
 	partsNumToSplit     int
 	minChunkSizeInBytes int64
+	keyWrapper          interfaces.KeyWrapper
+	encryptionChunkSize int
+	compression         compressionPolicy
+	dedup               dedupPolicy
+	replicas            int
+	upload              uploadPolicy
+	download            downloadPolicy
+	logger              log.Logger
+	// partLocks are taken per hash from taking a reference to a deduplicated part until it's recorded, and from
+	// dropping the last reference until the part is deleted, so a part is never deleted from under a file that was
+	// just given it. They are kept with deduplication off too, as files stored with it on may still be deleted.
+	partLocks *hashLocks
+}
+
+// ServiceOption configures optional behaviour of the file service.
+type ServiceOption func(s *service)
+
+// WithEncryption encrypts parts of new files with per-file data keys wrapped by keyWrapper.
+func WithEncryption(keyWrapper interfaces.KeyWrapper) ServiceOption {
+	return func(s *service) {
+		s.keyWrapper = keyWrapper
+	}
+}
+
+// WithCompression compresses parts of new files with codec, except for files of content types in skipTypes.
+// When skipTypes is empty, a built-in list of already compressed types is used.
+func WithCompression(codec string, skipTypes []string) ServiceOption {
+	return func(s *service) {
+		if len(skipTypes) == 0 {
+			skipTypes = defaultIncompressibleTypes()
+		}
+
+		s.compression = compressionPolicy{codec: codec, skipTypes: skipTypes}
+	}
+}
+
+// WithDeduplication stores parts under their content hash so identical parts are kept once.
+// Chunking is ChunkingFixed, cutting parts of chunkSize bytes, or ChunkingCDC, cutting parts of chunkSize bytes
+// on average.
+func WithDeduplication(chunking string, chunkSize int) ServiceOption {
+	return func(s *service) {
+		if chunkSize <= 0 || chunking == ChunkingCDC && chunkSize < minCDCAvgChunkSize {
+			chunkSize = defaultDedupChunkSize
+		}
+
+		s.dedup = dedupPolicy{enabled: true, chunking: chunking, chunkSize: chunkSize}
+	}
+}
+
+// WithReplication keeps replicas copies of every part of new files, each in a different zone.
+func WithReplication(replicas int) ServiceOption {
+	return func(s *service) {
+		if replicas > 0 {
+			s.replicas = replicas
+		}
+	}
 }
 
-func NewService(fileMetaStorage interfaces.FileMetaStorage, storageManager interfaces.StorageManager) server.FileService {
-	return &service{
+// WithSplit splits files into at most parts parts, none smaller than minPartSize bytes but the last one.
+func WithSplit(parts int, minPartSize int64) ServiceOption {
+	return func(s *service) {
+		if parts > 0 {
+			s.partsNumToSplit = parts
+		}
+		if minPartSize > 0 {
+			s.minChunkSizeInBytes = minPartSize
+		}
+	}
+}
+
+// WithParallelUploads uploads up to concurrency parts of a file at once. Parts are read from the body ahead of
+// their upload into buffers, which take no more than memoryBudget bytes across every upload of the service;
+// parts too big for the budget are streamed as without the option.
+func WithParallelUploads(concurrency int, memoryBudget int64) ServiceOption {
+	return func(s *service) {
+		if concurrency > 1 && memoryBudget > 0 {
+			s.upload = uploadPolicy{
+				concurrency: concurrency,
+				budget:      memoryBudget,
+				buffers:     semaphore.NewWeighted(memoryBudget),
+			}
+		}
+	}
+}
+
+// WithPrefetch reads up to parts parts of a file ahead of the one a download streams, so that moving on to the next
+// part doesn't wait for its storage. Prefetched parts take no more than memoryBudget bytes across every download
+// of the service; parts there's no room for are read when the download reaches them.
+func WithPrefetch(parts int, memoryBudget int64) ServiceOption {
+	return func(s *service) {
+		if parts > 0 && memoryBudget > 0 {
+			s.download = downloadPolicy{
+				prefetch: parts,
+				buffers:  semaphore.NewWeighted(memoryBudget),
+			}
+		}
+	}
+}
+
+// WithLogger logs what the service does on its own, like retrying uploads on other storages.
+func WithLogger(logger log.Logger) ServiceOption {
+	return func(s *service) {
+		s.logger = logger
+	}
+}
+
+func NewService(fileMetaStorage interfaces.FileMetaStorage, storageManager interfaces.StorageManager, opts ...ServiceOption) server.FileService {
+	s := &service{
 		fileMetaStorage:     fileMetaStorage,
 		storageManager:      storageManager,
 		partsNumToSplit:     defaultPartsNumToSplit,
 		minChunkSizeInBytes: defaultMinChunkSizeInBytes,
+		encryptionChunkSize: defaultEncryptionChunk,
+		replicas:            defaultReplicas,
+		partLocks:           newHashLocks(),
+		logger:              log.NewNopLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	return s
 }
 
 func (s *service) PutFile(ctx context.Context, file domain.File) error {
+	if s.dedup.enabled {
+		return s.putFileDeduplicated(ctx, file)
+	}
+
+	previous, hadPrevious := s.previousFileMeta(ctx, file.Meta.Name)
 	partSizes := s.calculatePartsSize(file.Meta.ContentLength, s.partsNumToSplit)
 
-	storages, err := s.storageManager.GetStorages(ctx, len(partSizes))
+	version, err := newVersion()
+	if err != nil {
+		return fmt.Errorf("can't generate file version: %w", err)
+	}
+
+	storages, err := s.storageManager.GetStorages(ctx, file.Meta.Name, len(partSizes), s.replicas)
 	if err != nil {
 		return fmt.Errorf("can't get storages error: %w", err)
 	}
 
-	fileParts := s.getFileParts(storages, file.Meta, partSizes)
+	codec := s.compression.codecFor(file.Meta.ContentType)
+	if !validCodec(codec) {
+		return fmt.Errorf("unknown compression codec %q", codec)
+	}
+
+	fileParts := s.getFileParts(storages, file.Meta, version, partSizes, codec)
 	file.Meta.Parts = fileParts
 
+	var aead cipher.AEAD
+	if s.keyWrapper != nil {
+		file.Meta.Encryption, aead, err = newFileEncryption(s.keyWrapper, s.encryptionChunkSize)
+		if err != nil {
+			return fmt.Errorf("can't set up file encryption: %w", err)
+		}
+	}
+
+	// Parts of every version are stored under paths of their own, and the version is only published once all
+	// of them are stored, so the previous version stays readable until then and a failed upload leaves it be.
+	if file.Meta.Parts, err = s.uploadParts(ctx, file, aead); err != nil {
+		return err
+	}
+
+	file.Meta.ContentLength = 0
+	for _, part := range file.Meta.Parts {
+		file.Meta.ContentLength += part.ContentLength
+	}
+
 	if err = s.fileMetaStorage.StartProcessingFileMeta(ctx, file.Meta); err != nil {
+		s.deleteUploaded(ctx, file.Meta.Parts)
 		return fmt.Errorf("can't put starting file meta: %w", err)
 	}
 
-	for _, filePart := range fileParts {
-		body := io.LimitReader(file.Body, filePart.ContentLength)
-		storage, err := s.storageManager.GetStorage(ctx, filePart.StorageURL)
-		if err != nil {
-			return fmt.Errorf("can't get storage error: %w", err)
+	if err = s.fileMetaStorage.CompleteFileMeta(ctx, file.Meta); err != nil {
+		s.deleteUploaded(ctx, file.Meta.Parts)
+		// The previous version was replaced already, so nothing refers to its parts anymore.
+		if hadPrevious {
+			s.releaseParts(ctx, previous.Parts, nil)
 		}
 
-		if err = storage.UploadFilePart(ctx, filePart.Path, body); err != nil {
-			return fmt.Errorf("can't upload file part: %w", err)
-		}
+		return fmt.Errorf("can't complete file meta: %w", err)
 	}
 
-	if err = s.fileMetaStorage.CompleteFileMeta(ctx, file.Meta.Name); err != nil {
-		return fmt.Errorf("can't complete file meta: %w", err)
+	if hadPrevious {
+		if err = s.releaseParts(ctx, previous.Parts, file.Meta.Parts); err != nil {
+			return fmt.Errorf("can't release replaced file parts: %w", err)
+		}
 	}
 
 	return nil
 }
 
-type filePartsReader struct {
-	currentPart     int
-	storageManger   interfaces.StorageManager
-	currentPartBody io.ReadCloser
-	meta            domain.FileMeta
-	ctx             context.Context
-}
+// PlanPlacement returns parts a file of the given size would be split into and the storages they would go to,
+// without storing anything. Policies involving randomness or rotation may place the actual upload differently.
+func (s *service) PlanPlacement(ctx context.Context, name string, size int64) ([]domain.PlannedPart, error) {
+	partSizes := s.calculatePartsSize(size, s.partsNumToSplit)
 
-func (f *filePartsReader) getNextStorage() error {
-	if f.currentPart >= len(f.meta.Parts) {
-		return io.EOF
+	storages, err := s.storageManager.GetStorages(ctx, name, len(partSizes), s.replicas)
+	if err != nil {
+		return nil, fmt.Errorf("can't get storages error: %w", err)
 	}
 
-	part := f.meta.Parts[f.currentPart]
-	storage, err := f.storageManger.GetStorage(f.ctx, part.StorageURL)
-	if err != nil {
-		return fmt.Errorf("can't get storage by URL, error: %w", err)
+	result := make([]domain.PlannedPart, 0, len(partSizes))
+	for i, size := range partSizes {
+		refs := make([]domain.StorageRef, 0, len(storages[i]))
+		for _, storage := range storages[i] {
+			labels, err := s.storageManager.GetStorageLabels(ctx, storage.GetStorageURL())
+			if err != nil {
+				return nil, fmt.Errorf("can't get storage labels: %w", err)
+			}
+
+			refs = append(refs, domain.StorageRef{URL: storage.GetStorageURL(), Labels: labels})
+		}
+
+		result = append(result, domain.PlannedPart{ContentLength: size, Storages: refs})
 	}
 
-	body, err := storage.ReadFilePart(f.ctx, part.Path)
+	return result, nil
+}
+
+func (s *service) DeleteFile(ctx context.Context, id string) error {
+	meta, err := s.fileMetaStorage.DeleteFileMeta(ctx, id)
 	if err != nil {
-		f.currentPartBody = nil
-		return fmt.Errorf("can't read part from storage, error: %w", err)
+		return fmt.Errorf("can't delete file meta: %w", err)
 	}
 
-	f.currentPartBody = body
-	f.currentPart++
+	if err = s.releaseParts(ctx, meta.Parts, nil); err != nil {
+		return fmt.Errorf("can't release file parts: %w", err)
+	}
 
 	return nil
 }
 
-func (f *filePartsReader) Read(p []byte) (n int, err error) {
-	if f.currentPartBody == nil {
-		if err = f.getNextStorage(); err != nil {
-			return 0, fmt.Errorf("1. can't get next storage, error: %w", err)
-		}
+// previousFileMeta returns metadata of a file about to be replaced, if there is one.
+func (s *service) previousFileMeta(ctx context.Context, id string) (domain.FileMeta, bool) {
+	meta, err := s.fileMetaStorage.GetFileMeta(ctx, id)
+	if err != nil {
+		return domain.FileMeta{}, false
 	}
 
-	n, err = f.currentPartBody.Read(p)
-	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			return 0, err
+	return meta, true
+}
+
+// releaseParts drops references to deduplicated parts and deletes parts nothing refers to anymore.
+// Parts stored at the same location as one of keep are left alone. All parts are tried even if some fail;
+// the first error is returned.
+func (s *service) releaseParts(ctx context.Context, parts []domain.FilePart, keep []domain.FilePart) error {
+	var firstErr error
+	for _, part := range parts {
+		if err := s.releasePart(ctx, part, keep); err != nil && firstErr == nil {
+			firstErr = err
 		}
+	}
+
+	return firstErr
+}
 
-		if err = f.currentPartBody.Close(); err != nil {
-			return n, fmt.Errorf("can't close body, error: %w", err)
+func (s *service) releasePart(ctx context.Context, part domain.FilePart, keep []domain.FilePart) error {
+	if part.Hash != "" {
+		// Held until the part is deleted, so no upload takes the part in the meantime.
+		unlock := s.partLocks.lock(part.Hash)
+		defer unlock()
+
+		remaining, err := s.fileMetaStorage.ReleasePart(ctx, part.Hash)
+		if err != nil {
+			return fmt.Errorf("can't release part: %w", err)
 		}
 
-		if err = f.getNextStorage(); err != nil {
-			return n, err //fmt.Errorf("2. can't get next storage, error: %w", err)
+		if remaining > 0 {
+			return nil
 		}
 
-		return n, nil
+		// Nothing else refers to the part, so every copy goes regardless of keep.
+		keep = nil
 	}
 
-	return n, nil
+	return s.deleteReplicated(ctx, part, keep)
 }
 
-func (f *filePartsReader) Close() error {
-	if f.currentPartBody != nil {
-		return f.currentPartBody.Close()
+// uploadPart streams body of the i-th part of the file to its storages, compressing and encrypting it on the way,
+// and returns the part with its size after compression and storages it ended up on. A part already read into memory,
+// passed as *bytes.Reader, is encoded anew from it for a retry after a storage fails; one streamed from the file's body
+// is replayed from memory as it was encoded.
+func (s *service) uploadPart(ctx context.Context, file domain.File, i int, body io.Reader, aead cipher.AEAD) (domain.FilePart, error) {
+	filePart := file.Meta.Parts[i]
+	encode := func(r io.Reader) *partEncoding {
+		return newPartEncoding(r, filePart.Codec, aead, i, file.Meta.Encryption.ChunkSize)
 	}
 
-	return nil
+	var (
+		upload     partBody
+		encoding   *partEncoding
+		reencoding *reencodingBody
+	)
+	if buffered, ok := body.(*bytes.Reader); ok {
+		reencoding = newReencodingBody(buffered, encode)
+		defer func() { reencoding.Close() }()
+		upload = reencoding
+	} else {
+		encoding = encode(body)
+		defer encoding.Close()
+		upload = &replayReader{r: encoding, limit: maxReplayBuffer}
+	}
+
+	storages, err := s.partStorages(ctx, filePart)
+	if err != nil {
+		return domain.FilePart{}, err
+	}
+
+	storages, err = s.uploadWithFailover(ctx, file.Meta.Name, storages, filePart.Path, upload)
+	if err != nil {
+		return domain.FilePart{}, fmt.Errorf("can't upload file part: %w", err)
+	}
+
+	// What the last attempt stored is what's described.
+	if reencoding != nil {
+		encoding = reencoding.partEncoding
+	}
+
+	setLocations(&filePart, storages)
+	filePart.ContentLength = encoding.plain.n
+	filePart.CompressedLength = filePart.ContentLength
+	if encoding.compressed != nil {
+		filePart.CompressedLength = encoding.compressed.n
+	}
+	filePart.Checksum = hex.EncodeToString(encoding.checksum.Sum(nil))
+
+	return filePart, nil
+}
+
+// GetFile returns a file with a body decompressed, unless the file's codec is one of acceptEncodings.
+// In that case the body is left compressed and File.ContentEncoding names the codec.
+func (s *service) GetFile(ctx context.Context, id string, acceptEncodings ...string) (domain.File, error) {
+	meta, err := s.fileMetaStorage.GetFileMeta(ctx, id)
+	if err != nil {
+		return domain.File{}, fmt.Errorf("can't get file metadata, error: %w", err)
+	}
+
+	var contentEncoding string
+	if codec := meta.Codec(); codec != domain.CodecNone {
+		for _, accepted := range acceptEncodings {
+			if accepted == codec {
+				contentEncoding = codec
+				break
+			}
+		}
+	}
+
+	body, err := s.openFile(ctx, meta, contentEncoding == "", 0, meta.ContentLength)
+	if err != nil {
+		return domain.File{}, err
+	}
+
+	return domain.File{
+		Meta:            meta,
+		ContentEncoding: contentEncoding,
+		Body:            body,
+	}, nil
 }
 
-func (s *service) GetFile(ctx context.Context, id string) (domain.File, error) {
+// GetFileRange returns a file with a body holding only rng of its content. Parts before the range aren't read,
+// and the part it starts in is read from the encrypted chunk holding its start, unless the part is compressed
+// and has to be decompressed from its beginning.
+func (s *service) GetFileRange(ctx context.Context, id string, rng domain.ByteRange) (domain.File, error) {
 	meta, err := s.fileMetaStorage.GetFileMeta(ctx, id)
 	if err != nil {
 		return domain.File{}, fmt.Errorf("can't get file metadata, error: %w", err)
 	}
 
+	rng, err = resolveRange(rng, meta.ContentLength)
+	if err != nil {
+		return domain.File{}, err
+	}
+
+	body, err := s.openFile(ctx, meta, true, rng.Start, rng.Length)
+	if err != nil {
+		return domain.File{}, err
+	}
+
 	return domain.File{
-		Meta: meta,
-		Body: &filePartsReader{
-			storageManger: s.storageManager,
-			meta:          meta,
-			ctx:           ctx,
-		},
+		Meta:  meta,
+		Range: &rng,
+		Body:  body,
 	}, nil
 }
 
+// resolveRange turns rng into an offset and a length within a file of size bytes.
+func resolveRange(rng domain.ByteRange, size int64) (domain.ByteRange, error) {
+	if rng.Start < 0 {
+		rng.Start, rng.Length = size+rng.Start, -1
+		if rng.Start < 0 {
+			rng.Start = 0
+		}
+	}
+
+	if rng.Start >= size {
+		return domain.ByteRange{}, &domain.RangeError{Size: size}
+	}
+
+	if rng.Length < 0 || rng.Length > size-rng.Start {
+		rng.Length = size - rng.Start
+	}
+
+	return rng, nil
+}
+
+// openFile returns a reader of length bytes of the file's content from offset, decompressed if decompress is set.
+// Compressed content is only read whole, from a zero offset.
+func (s *service) openFile(ctx context.Context, meta domain.FileMeta, decompress bool, offset,
+	length int64) (io.ReadCloser, error) {
+	aead, err := fileDecryption(s.keyWrapper, meta.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("can't set up file decryption, error: %w", err)
+	}
+
+	// Parts past the end of what's read are left out; those before it are skipped, but keep their indexes,
+	// which chunks are sealed with.
+	first, last := 0, len(meta.Parts)
+	var skipped, end int64
+	for i, part := range meta.Parts {
+		end += part.ContentLength
+		if end <= offset && i < len(meta.Parts)-1 {
+			first, skipped = i+1, end
+		}
+		if offset+length < meta.ContentLength && end >= offset+length {
+			last = i + 1
+			break
+		}
+	}
+	parts := meta.Parts[:last]
+
+	// Every part is checked to have a storage to read it from, and the first part is opened, before the file
+	// is returned, so that these failures are reported before any of the body is sent.
+	locations := make([][]interfaces.Storage, len(parts))
+	for i := first; i < len(parts); i++ {
+		storages, err := s.readLocations(ctx, parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("can't get part storages, error: %w", err)
+		}
+
+		locations[i] = storages
+	}
+
+	// Prefetching stops with the request, or when the body is closed before the end.
+	ctx, cancel := context.WithCancel(ctx)
+	meta.Parts = parts
+	body := &filePartsReader{
+		ctx:         ctx,
+		cancel:      cancel,
+		meta:        meta,
+		locations:   locations,
+		aead:        aead,
+		decompress:  decompress,
+		download:    s.download,
+		logger:      s.logger,
+		currentPart: first,
+		skip:        offset - skipped,
+	}
+	if err = body.openPart(); err != nil && !errors.Is(err, io.EOF) {
+		body.Close()
+		return nil, fmt.Errorf("can't read first part, error: %w", err)
+	}
+
+	if length == meta.ContentLength {
+		return body, nil
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(body, length), Closer: body}, nil
+}
+
+// limitedReadCloser stops reading short of the end of what it closes.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
@@ -155,20 +512,44 @@ func minInt64(a, b int64) int64 {
 	return b
 }
 
-func (s *service) getFileParts(storages []interfaces.Storage, fileMeta domain.FileMeta, partSizes []int64) []domain.FilePart {
+func (s *service) getFileParts(storages [][]interfaces.Storage, fileMeta domain.FileMeta, version string, partSizes []int64,
+	codec string) []domain.FilePart {
 	fileParts := make([]domain.FilePart, 0, len(partSizes))
 
 	for i, size := range partSizes {
+		replicas := make([]string, 0, len(storages[i])-1)
+		for _, storage := range storages[i][1:] {
+			replicas = append(replicas, storage.GetStorageURL())
+		}
+
 		fileParts = append(fileParts, domain.FilePart{
-			StorageURL:    storages[i].GetStorageURL(),
-			Path:          fileMeta.Name,
+			StorageURL:    storages[i][0].GetStorageURL(),
+			Replicas:      replicas,
+			Path:          partPath(fileMeta.Name, version, i),
 			ContentLength: size,
+			Codec:         codec,
 		})
 	}
 
 	return fileParts
 }
 
+// partPath returns a path the i-th part of a version of a file is stored under. Parts get distinct paths,
+// since a storage may keep several parts of one file, and parts of several versions while one replaces another.
+func partPath(name, version string, i int) string {
+	return fmt.Sprintf("%s.%s.part%d", name, version, i)
+}
+
+// newVersion returns a random ID telling versions of a file apart.
+func newVersion() (string, error) {
+	b, err := randomBytes(8)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
 func (s *service) calculatePartsSize(total int64, splitCount int) []int64 {
 	result := make([]int64, 0, splitCount)
 
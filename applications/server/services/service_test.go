@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+func newTestStorageManager(t *testing.T, count int) interfaces.StorageManager {
+	t.Helper()
+
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	for i := 0; i < count; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		require.NoError(t, storageManager.AddStorage(context.Background(), url, inmemory.NewStorage(url, log.NewNopLogger()), domain.StorageLabels{}))
+	}
+
+	return storageManager
+}
+
+func putAndGet(t *testing.T, svc server.FileService, name string, data []byte) []byte {
+	t.Helper()
+
+	err := svc.PutFile(context.Background(), domain.File{
+		Meta: domain.FileMeta{Name: name, ContentLength: int64(len(data))},
+		Body: io.NopCloser(bytes.NewReader(data)),
+	})
+	require.NoError(t, err)
+
+	file, err := svc.GetFile(context.Background(), name)
+	require.NoError(t, err)
+	defer file.Body.Close()
+
+	got, err := io.ReadAll(file.Body)
+	require.NoError(t, err)
+
+	return got
+}
+
+func readStoredParts(t *testing.T, storageManager interfaces.StorageManager, meta domain.FileMeta) []byte {
+	t.Helper()
+
+	var stored []byte
+	for _, part := range meta.Parts {
+		storage, err := storageManager.GetStorage(context.Background(), part.StorageURL)
+		require.NoError(t, err)
+
+		body, err := storage.ReadFilePart(context.Background(), part.Path)
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		stored = append(stored, data...)
+	}
+
+	return stored
+}
+
+func TestServiceEncryption(t *testing.T) {
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 5)
+	svc := NewService(fileMetaStorage, storageManager, WithEncryption(keyWrapper))
+	svc.(*service).encryptionChunkSize = 1000
+
+	for _, size := range []int{1, 999, 1000, 1001, 300 * 1024} {
+		data := make([]byte, size)
+		_, err = rand.Read(data)
+		require.NoError(t, err)
+
+		name := fmt.Sprintf("file_%d", size)
+		assert.Equal(t, data, putAndGet(t, svc, name, data), "size %d", size)
+
+		meta, err := fileMetaStorage.GetFileMeta(context.Background(), name)
+		require.NoError(t, err)
+		assert.Equal(t, algorithmAES256GCMChunked, meta.Encryption.Algorithm)
+		if size > 16 {
+			assert.NotContains(t, string(readStoredParts(t, storageManager, meta)), string(data))
+		}
+	}
+
+	plain := NewService(fileMetaStorage, storageManager)
+	_, err = plain.GetFile(context.Background(), "file_1")
+	assert.Error(t, err)
+}
+
+func TestServiceChecksums(t *testing.T) {
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	storageManager := newTestStorageManager(t, 5)
+	svc := NewService(fileMetaStorage, storageManager, WithCompression(domain.CodecGzip, nil), WithEncryption(keyWrapper))
+
+	data := bytes.Repeat([]byte("checksum "), 20000)
+	assert.Equal(t, data, putAndGet(t, svc, "file", data))
+
+	meta, err := fileMetaStorage.GetFileMeta(context.Background(), "file")
+	require.NoError(t, err)
+	for _, part := range meta.Parts {
+		stored := readStoredParts(t, storageManager, domain.FileMeta{Parts: []domain.FilePart{part}})
+		sum := sha256.Sum256(stored)
+		assert.Equal(t, hex.EncodeToString(sum[:]), part.Checksum, part.Path)
+	}
+}
+
+func TestDecryptingReaderDetectsTruncation(t *testing.T) {
+	aead, err := newDataKeyAEAD(bytes.Repeat([]byte{1}, dataKeySizeInBytes))
+	require.NoError(t, err)
+
+	sealed, err := io.ReadAll(newEncryptingReader(bytes.NewReader(make([]byte, 3000)), aead, 0, 1000))
+	require.NoError(t, err)
+
+	chunk := 1000 + aead.Overhead()
+	_, err = io.ReadAll(newDecryptingReader(io.NopCloser(bytes.NewReader(sealed[:2*chunk])), aead, 0, 1000))
+	assert.Error(t, err)
+
+	_, err = io.ReadAll(newDecryptingReader(io.NopCloser(bytes.NewReader(sealed)), aead, 1, 1000))
+	assert.Error(t, err)
+}
+
+func TestServiceCompression(t *testing.T) {
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`+"\n"), 10000)
+
+	for _, codec := range []string{domain.CodecGzip, domain.CodecZstd} {
+		t.Run(codec, func(t *testing.T) {
+			fileMetaStorage := inmemory.NewFileMetaStorage()
+			svc := NewService(fileMetaStorage, newTestStorageManager(t, 5),
+				WithCompression(codec, nil), WithEncryption(keyWrapper))
+
+			assert.Equal(t, data, putAndGet(t, svc, "app.log", data))
+
+			meta, err := fileMetaStorage.GetFileMeta(context.Background(), "app.log")
+			require.NoError(t, err)
+			assert.Equal(t, codec, meta.Codec())
+			assert.Less(t, meta.CompressedLength(), meta.ContentLength/10)
+
+			file, err := svc.GetFile(context.Background(), "app.log", "br", codec)
+			require.NoError(t, err)
+			assert.Equal(t, codec, file.ContentEncoding)
+
+			raw, err := io.ReadAll(file.Body)
+			require.NoError(t, err)
+			assert.Equal(t, meta.CompressedLength(), int64(len(raw)))
+
+			decoded, err := newDecompressingReader(io.NopCloser(bytes.NewReader(raw)), codec)
+			require.NoError(t, err)
+			got, err := io.ReadAll(decoded)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	policy := compressionPolicy{codec: domain.CodecZstd, skipTypes: defaultIncompressibleTypes()}
+
+	assert.Equal(t, domain.CodecZstd, policy.codecFor("application/json; charset=utf-8"))
+	assert.Equal(t, domain.CodecZstd, policy.codecFor(""))
+	assert.Equal(t, domain.CodecNone, policy.codecFor("image/png"))
+	assert.Equal(t, domain.CodecNone, policy.codecFor("Application/Zip"))
+	assert.Equal(t, domain.CodecNone, compressionPolicy{}.codecFor("text/plain"))
+}
+
+func TestServiceReplication(t *testing.T) {
+	storageManager := inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())
+	for i, zone := range []string{"a", "a", "b", "b", "c"} {
+		url := fmt.Sprintf("storage_%d", i)
+		require.NoError(t, storageManager.AddStorage(context.Background(), url,
+			inmemory.NewStorage(url, log.NewNopLogger()), domain.StorageLabels{Zone: zone}))
+	}
+
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	svc := NewService(fileMetaStorage, storageManager, WithReplication(3))
+
+	data := make([]byte, 100*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, putAndGet(t, svc, "a", data))
+
+	meta, err := fileMetaStorage.GetFileMeta(context.Background(), "a")
+	require.NoError(t, err)
+	for _, part := range meta.Parts {
+		require.Len(t, part.Locations(), 3)
+		for _, url := range part.Locations() {
+			storage, err := storageManager.GetStorage(context.Background(), url)
+			require.NoError(t, err)
+
+			body, err := storage.ReadFilePart(context.Background(), part.Path)
+			require.NoError(t, err)
+			stored, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Len(t, stored, int(part.ContentLength))
+		}
+	}
+
+	_, err = svc.PlanPlacement(context.Background(), "b", 100*1024)
+	assert.NoError(t, err)
+
+	require.NoError(t, svc.DeleteFile(context.Background(), "a"))
+	for i := 0; i < 5; i++ {
+		storage, err := storageManager.GetStorage(context.Background(), fmt.Sprintf("storage_%d", i))
+		require.NoError(t, err)
+		free, err := storage.GetFreeSpace()
+		require.NoError(t, err)
+		assert.Equal(t, 100*1024*1024, free)
+	}
+
+	_, err = NewService(fileMetaStorage, storageManager, WithReplication(4)).PlanPlacement(context.Background(), "c", 1)
+	assert.Error(t, err)
+}
+
+func TestServiceFailedOverwrite(t *testing.T) {
+	for name, opts := range map[string][]ServiceOption{
+		"sequential": nil,
+		"parallel":   {WithParallelUploads(3, 1024*1024)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			storageManager := newTestStorageManager(t, 3)
+			svc := NewService(inmemory.NewFileMetaStorage(), storageManager, opts...)
+
+			data := make([]byte, 100*1024)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+			require.Equal(t, data, putAndGet(t, svc, "file", data))
+			used := usedSpace(t, storageManager)
+
+			// The new version's body breaks off after a few parts.
+			err = svc.PutFile(ctx, domain.File{
+				Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+				Body: io.NopCloser(io.MultiReader(bytes.NewReader(data[:70*1024]),
+					&failingReader{err: errors.New("connection reset")})),
+			})
+			require.Error(t, err)
+
+			// The previous version is still whole, and nothing of the new one is left.
+			file, err := svc.GetFile(ctx, "file")
+			require.NoError(t, err)
+			got, err := io.ReadAll(file.Body)
+			require.NoError(t, file.Body.Close())
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			assert.Equal(t, used, usedSpace(t, storageManager))
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donmikel/karma8/applications/server"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type statusReporter struct {
+	fileMetaStorage interfaces.FileMetaStorage
+	storageManager  interfaces.StorageManager
+	health          server.HealthChecker
+	minStorages     int
+	version         string
+	startedAt       time.Time
+
+	shuttingDown atomic.Bool
+}
+
+// StatusReporterOption configures optional behaviour of the status reporter.
+type StatusReporterOption func(r *statusReporter)
+
+// WithMinStorages makes the server ready only while at least count storages take new parts.
+func WithMinStorages(count int) StatusReporterOption {
+	return func(r *statusReporter) {
+		if count > 0 {
+			r.minStorages = count
+		}
+	}
+}
+
+// WithVersion reports version as the version of the server.
+func WithVersion(version string) StatusReporterOption {
+	return func(r *statusReporter) {
+		r.version = version
+	}
+}
+
+// NewStatusReporter returns a reporter checking fileMetaStorage and storages of storageManager,
+// whose health is told by health.
+func NewStatusReporter(fileMetaStorage interfaces.FileMetaStorage, storageManager interfaces.StorageManager,
+	health server.HealthChecker, opts ...StatusReporterOption) server.StatusReporter {
+	r := &statusReporter{
+		fileMetaStorage: fileMetaStorage,
+		storageManager:  storageManager,
+		health:          health,
+		minStorages:     1,
+		startedAt:       time.Now().UTC(),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *statusReporter) Ready(ctx context.Context) domain.Readiness {
+	readiness, _ := r.readiness(ctx)
+
+	return readiness
+}
+
+func (r *statusReporter) Status(ctx context.Context) (domain.ServerStatus, error) {
+	status := domain.ServerStatus{
+		Version:     r.version,
+		StartedAt:   r.startedAt,
+		MinStorages: r.minStorages,
+	}
+	status.Readiness, status.AvailableStorages = r.readiness(ctx)
+
+	statuses, err := r.health.Statuses(ctx)
+	if err != nil {
+		return domain.ServerStatus{}, fmt.Errorf("can't get storage statuses: %w", err)
+	}
+
+	parts, err := r.fileMetaStorage.ListParts(ctx)
+	if err != nil {
+		return domain.ServerStatus{}, fmt.Errorf("can't list parts: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, part := range parts {
+		for _, url := range part.Locations() {
+			counts[url]++
+		}
+	}
+
+	status.Storages = make([]domain.StorageState, len(statuses))
+
+	// Free space is asked of every storage at once, so a hanging one doesn't hold up the others.
+	var wg sync.WaitGroup
+	for i, storageStatus := range statuses {
+		i, storageStatus := i, storageStatus
+
+		state := &status.Storages[i]
+		state.StorageStatus = storageStatus
+		state.Parts = counts[storageStatus.URL]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			storage, err := r.storageManager.GetStorage(ctx, storageStatus.URL)
+			if err != nil {
+				state.FreeSpaceError = err.Error()
+				return
+			}
+
+			free, err := storage.GetFreeSpace()
+			if err != nil {
+				state.FreeSpaceError = err.Error()
+				return
+			}
+			state.FreeSpace = int64(free)
+		}()
+	}
+	wg.Wait()
+
+	return status, nil
+}
+
+func (r *statusReporter) BeginShutdown() {
+	r.shuttingDown.Store(true)
+}
+
+// readiness checks whether the server may take traffic, and counts storages taking new parts.
+func (r *statusReporter) readiness(ctx context.Context) (domain.Readiness, int) {
+	var reasons []string
+
+	if r.shuttingDown.Load() {
+		reasons = append(reasons, "shutting down")
+	}
+
+	if err := r.fileMetaStorage.Ping(ctx); err != nil {
+		reasons = append(reasons, fmt.Sprintf("metadata store unavailable: %v", err))
+	}
+
+	available, err := r.availableStorages(ctx)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	} else if available < r.minStorages {
+		reasons = append(reasons, fmt.Sprintf("%d storages take new parts, %d needed", available, r.minStorages))
+	}
+
+	return domain.Readiness{Ready: len(reasons) == 0, Reasons: reasons}, available
+}
+
+// availableStorages counts healthy storages that aren't draining.
+func (r *statusReporter) availableStorages(ctx context.Context) (int, error) {
+	storages, err := r.storageManager.ListStorages(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("can't list storages: %w", err)
+	}
+
+	var available int
+	for _, storage := range storages {
+		url := storage.GetStorageURL()
+
+		health, err := r.storageManager.GetStorageHealth(ctx, url)
+		if err != nil {
+			return 0, fmt.Errorf("can't get storage health: %w", err)
+		}
+
+		draining, err := r.storageManager.IsDraining(ctx, url)
+		if err != nil {
+			return 0, fmt.Errorf("can't get storage: %w", err)
+		}
+
+		if health == domain.HealthHealthy && !draining {
+			available++
+		}
+	}
+
+	return available, nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/domain"
+)
+
+func TestStatusReporter(t *testing.T) {
+	ctx := context.Background()
+	storageManager := newTestStorageManager(t, 3)
+	fileMetaStorage := inmemory.NewFileMetaStorage()
+	health := NewHealthChecker(storageManager, log.NewNopLogger())
+	status := NewStatusReporter(fileMetaStorage, storageManager, health, WithMinStorages(3), WithVersion("v1.2.3"))
+
+	assert.Equal(t, domain.Readiness{Ready: true}, status.Ready(ctx))
+
+	svc := NewService(fileMetaStorage, storageManager, WithSplit(3, 1))
+	putAndGet(t, svc, "file", []byte("some file contents"))
+
+	require.NoError(t, storageManager.DrainStorage(ctx, "storage_1"))
+	assert.Equal(t, domain.Readiness{Reasons: []string{"2 storages take new parts, 3 needed"}}, status.Ready(ctx))
+
+	serverStatus, err := status.Status(ctx)
+	require.NoError(t, err)
+	assert.False(t, serverStatus.Readiness.Ready)
+	assert.Equal(t, "v1.2.3", serverStatus.Version)
+	assert.Equal(t, 2, serverStatus.AvailableStorages)
+	assert.Equal(t, 3, serverStatus.MinStorages)
+	require.Len(t, serverStatus.Storages, 3)
+	for _, state := range serverStatus.Storages {
+		assert.Equal(t, 1, state.Parts, state.URL)
+		assert.Positive(t, state.FreeSpace, state.URL)
+	}
+	assert.True(t, serverStatus.Storages[1].Draining)
+
+	status = NewStatusReporter(fileMetaStorage, storageManager, health, WithMinStorages(2))
+	assert.True(t, status.Ready(ctx).Ready)
+
+	status.BeginShutdown()
+	assert.Equal(t, domain.Readiness{Reasons: []string{"shutting down"}}, status.Ready(ctx))
+}
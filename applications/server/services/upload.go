@@ -0,0 +1,220 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/logging"
+)
+
+// uploadPolicy describes uploading parts of a file at once. The zero value uploads them one after another.
+type uploadPolicy struct {
+	concurrency int
+	// budget is how many bytes buffers may take; buffers holds what's left of it.
+	budget  int64
+	buffers *semaphore.Weighted
+}
+
+// uploadParts uploads parts of the file from its body and returns them pointed at storages they ended up on.
+// A body shorter than announced ends the file early rather than failing it; parts past its end are left out.
+// When the upload fails, parts already stored are deleted.
+func (s *service) uploadParts(ctx context.Context, file domain.File, aead cipher.AEAD) ([]domain.FilePart, error) {
+	body := bufio.NewReader(file.Body)
+	if s.upload.concurrency > 1 && len(file.Meta.Parts) > 1 {
+		return s.uploadPartsParallel(ctx, file, body, aead)
+	}
+
+	parts := make([]domain.FilePart, 0, len(file.Meta.Parts))
+	for i, part := range file.Meta.Parts {
+		if i > 0 && drained(body) {
+			break
+		}
+
+		uploaded, err := s.uploadPart(ctx, file, i, io.LimitReader(body, part.ContentLength), aead)
+		if err != nil {
+			s.deleteUploaded(ctx, parts)
+			return nil, err
+		}
+
+		parts = append(parts, uploaded)
+	}
+
+	return parts, nil
+}
+
+// deleteUploaded deletes parts of an upload that failed. Failures are only logged, as the upload's error is
+// what's reported.
+func (s *service) deleteUploaded(ctx context.Context, parts []domain.FilePart) {
+	for _, part := range parts {
+		if err := s.deleteReplicated(ctx, part, nil); err != nil {
+			level.Warn(logging.With(ctx, s.logger)).Log("msg", "can't delete part of failed upload",
+				"path", part.Path,
+				"err", err,
+			)
+		}
+	}
+}
+
+// drained tells whether nothing is left to read from body.
+func drained(body *bufio.Reader) bool {
+	_, err := body.Peek(1)
+	return errors.Is(err, io.EOF)
+}
+
+// uploadPartsParallel reads parts from the body into buffers and uploads them in the background, so that
+// reading the next part doesn't wait for storages to take the previous ones. Reading pauses while as many
+// parts as allowed are uploading, or while the memory budget is used up.
+func (s *service) uploadPartsParallel(ctx context.Context, file domain.File, body *bufio.Reader,
+	aead cipher.AEAD) ([]domain.FilePart, error) {
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(s.upload.concurrency)
+
+	// Uploads fill in parts by index, and mark those stored.
+	parts := file.Meta.Parts
+	stored := make([]bool, len(parts))
+	count := 0
+
+	// A failed upload cancels groupCtx, which is what failures of reading show up as then; the upload's
+	// error says more.
+	fail := func(err error) ([]domain.FilePart, error) {
+		if waitErr := group.Wait(); waitErr != nil {
+			err = waitErr
+		}
+
+		var uploaded []domain.FilePart
+		for i, part := range parts {
+			if stored[i] {
+				uploaded = append(uploaded, part)
+			}
+		}
+		s.deleteUploaded(ctx, uploaded)
+
+		return nil, err
+	}
+	for i, part := range file.Meta.Parts {
+		i, size := i, part.ContentLength
+		if i > 0 && drained(body) {
+			break
+		}
+		count = i + 1
+
+		if size > s.upload.budget {
+			uploaded, err := s.uploadPart(groupCtx, file, i, io.LimitReader(body, size), aead)
+			if err != nil {
+				return fail(err)
+			}
+
+			parts[i], stored[i] = uploaded, true
+			continue
+		}
+
+		if err := s.upload.buffers.Acquire(groupCtx, size); err != nil {
+			return fail(fmt.Errorf("can't get memory for part %d: %w", i, err))
+		}
+
+		buf := make([]byte, size)
+		n, err := io.ReadFull(body, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			s.upload.buffers.Release(size)
+			return fail(fmt.Errorf("can't read part %d of the body: %w", i, err))
+		}
+		buf = buf[:n]
+
+		group.Go(func() error {
+			defer s.upload.buffers.Release(size)
+
+			// A retry after a storage fails is encoded anew from buf, so it takes no memory past the budget.
+			uploaded, err := s.uploadPart(groupCtx, file, i, bytes.NewReader(buf), aead)
+			if err != nil {
+				return err
+			}
+
+			parts[i], stored[i] = uploaded, true
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return fail(err)
+	}
+
+	return parts[:count], nil
+}
+
+// partEncoding compresses and encrypts a part as it's read, counting what is read and what is compressed,
+// and hashing what is stored.
+type partEncoding struct {
+	io.Reader
+	plain *countingReader
+	// compressing is nil for parts stored uncompressed, and so is compressed.
+	compressing io.Closer
+	compressed  *countingReader
+	checksum    hash.Hash
+}
+
+func newPartEncoding(body io.Reader, codec string, aead cipher.AEAD, i, chunkSize int) *partEncoding {
+	e := &partEncoding{plain: &countingReader{r: body}, checksum: sha256.New()}
+	body = e.plain
+	if codec != domain.CodecNone {
+		compressing := newCompressingReader(body, codec)
+		e.compressing = compressing
+		e.compressed = &countingReader{r: compressing}
+		body = e.compressed
+	}
+
+	if aead != nil {
+		body = newEncryptingReader(body, aead, i, chunkSize)
+	}
+
+	e.Reader = io.TeeReader(body, e.checksum)
+
+	return e
+}
+
+// Close stops compression, if it's still running.
+func (e *partEncoding) Close() error {
+	if e.compressing == nil {
+		return nil
+	}
+
+	return e.compressing.Close()
+}
+
+// reencodingBody encodes a part held in memory anew for every attempt to upload it, so a retry needs no copy
+// of what was stored.
+type reencodingBody struct {
+	*partEncoding
+	src    *bytes.Reader
+	encode func(io.Reader) *partEncoding
+}
+
+func newReencodingBody(src *bytes.Reader, encode func(io.Reader) *partEncoding) *reencodingBody {
+	b := &reencodingBody{src: src, encode: encode}
+	b.rewind()
+
+	return b
+}
+
+func (b *reencodingBody) rewind() bool {
+	if b.partEncoding != nil {
+		b.partEncoding.Close()
+	}
+
+	// Every attempt reads through a reader of its own, as compression of an abandoned one may still be reading.
+	b.partEncoding = b.encode(io.NewSectionReader(b.src, 0, b.src.Size()))
+
+	return true
+}
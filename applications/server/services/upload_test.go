@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/donmikel/karma8/applications/server/adapters/inmemory"
+	"github.com/donmikel/karma8/applications/server/adapters/localkms"
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+	"github.com/donmikel/karma8/applications/server/placement"
+)
+
+// slowStorage takes a while to accept every upload, like a storage across a slow link.
+// It counts how many uploads run on all slow storages at once.
+type slowStorage struct {
+	interfaces.Storage
+	delay   time.Duration
+	fail    bool
+	running *int32
+	peak    *int32
+}
+
+func (s *slowStorage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	running := atomic.AddInt32(s.running, 1)
+	defer atomic.AddInt32(s.running, -1)
+	for {
+		peak := atomic.LoadInt32(s.peak)
+		if running <= peak || atomic.CompareAndSwapInt32(s.peak, peak, running) {
+			break
+		}
+	}
+
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if s.fail {
+		return errors.New("disk failure")
+	}
+
+	return s.Storage.UploadFilePart(ctx, path, body)
+}
+
+type slowStorages struct {
+	storageManager interfaces.StorageManager
+	running, peak  int32
+}
+
+func newSlowStorages(tb testing.TB, count int, delay time.Duration) *slowStorages {
+	tb.Helper()
+
+	result := &slowStorages{storageManager: inmemory.NewStorageManager(log.NewNopLogger(), placement.NewMostFree())}
+	for i := 0; i < count; i++ {
+		url := fmt.Sprintf("storage_%d", i)
+		storage := &slowStorage{
+			Storage: inmemory.NewStorage(url, log.NewNopLogger(), inmemory.WithCapacity(1<<30)),
+			delay:   delay,
+			running: &result.running,
+			peak:    &result.peak,
+		}
+		require.NoError(tb, result.storageManager.AddStorage(context.Background(), url, storage, domain.StorageLabels{}))
+	}
+
+	return result
+}
+
+func TestServiceParallelUpload(t *testing.T) {
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	data := make([]byte, 500*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		budget   int64
+		opts     []ServiceOption
+		wantPeak int32
+	}{
+		{name: "buffered", budget: 1 << 20, wantPeak: 3},
+		{name: "compressed and encrypted", budget: 1 << 20, wantPeak: 3,
+			opts: []ServiceOption{WithCompression(domain.CodecZstd, nil), WithEncryption(keyWrapper)}},
+		// Parts of 100 kB don't fit, so they are streamed one by one.
+		{name: "over budget", budget: 50 * 1024, wantPeak: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storages := newSlowStorages(t, 5, 20*time.Millisecond)
+			opts := append([]ServiceOption{WithParallelUploads(3, tt.budget)}, tt.opts...)
+			svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager, opts...)
+
+			assert.Equal(t, data, putAndGet(t, svc, "file", data))
+			assert.Equal(t, tt.wantPeak, atomic.LoadInt32(&storages.peak))
+			assert.Equal(t, tt.budget, svc.(*service).upload.budget)
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		storages := newSlowStorages(t, 5, 20*time.Millisecond)
+		for i := 0; i < 5; i++ {
+			storage, err := storages.storageManager.GetStorage(context.Background(), fmt.Sprintf("storage_%d", i))
+			require.NoError(t, err)
+			storage.(*slowStorage).fail = true
+		}
+		svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager, WithParallelUploads(3, 1<<20))
+
+		err := svc.PutFile(context.Background(), domain.File{
+			Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+			Body: io.NopCloser(bytes.NewReader(data)),
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "disk failure")
+		// Every buffer is given back.
+		assert.True(t, svc.(*service).upload.buffers.TryAcquire(1<<20))
+	})
+}
+
+func TestServiceShortBody(t *testing.T) {
+	ctx := context.Background()
+	keyWrapper, err := localkms.NewKeyWrapper(bytes.Repeat([]byte{7}, localkms.MasterKeySize))
+	require.NoError(t, err)
+
+	// 500 kB are announced, as for a multipart form, and 230 kB of them are the file: 2 parts of 100 kB and
+	// one of 30 kB, with the rest left out.
+	data := make([]byte, 230*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opts []ServiceOption
+	}{
+		{name: "sequential", opts: []ServiceOption{WithEncryption(keyWrapper)}},
+		{name: "parallel", opts: []ServiceOption{WithParallelUploads(3, 1<<20), WithCompression(domain.CodecGzip, nil)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileMetaStorage := inmemory.NewFileMetaStorage()
+			storageManager := newTestStorageManager(t, 5)
+			svc := NewService(fileMetaStorage, storageManager, tt.opts...)
+
+			require.NoError(t, svc.PutFile(ctx, domain.File{
+				Meta: domain.FileMeta{Name: "file", ContentLength: 500 * 1024},
+				Body: io.NopCloser(bytes.NewReader(data)),
+			}))
+
+			meta, err := fileMetaStorage.GetFileMeta(ctx, "file")
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), meta.ContentLength)
+			require.Len(t, meta.Parts, 3)
+			assert.Equal(t, int64(30*1024), meta.Parts[2].ContentLength)
+
+			file, err := svc.GetFile(ctx, "file")
+			require.NoError(t, err)
+			got, err := io.ReadAll(file.Body)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+// BenchmarkPutFile uploads a 5 MB file split into 5 parts to storages taking 10 ms to accept a part.
+func BenchmarkPutFile(b *testing.B) {
+	data := make([]byte, 5*1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(b, err)
+
+	for _, concurrency := range []int{1, 2, 5} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			storages := newSlowStorages(b, 5, 10*time.Millisecond)
+			svc := NewService(inmemory.NewFileMetaStorage(), storages.storageManager,
+				WithParallelUploads(concurrency, 64*1024*1024))
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := svc.PutFile(context.Background(), domain.File{
+					Meta: domain.FileMeta{Name: "file", ContentLength: int64(len(data))},
+					Body: io.NopCloser(bytes.NewReader(data)),
+				})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type fileMetaStorage struct {
+	next   interfaces.FileMetaStorage
+	tracer trace.Tracer
+}
+
+// NewFileMetaStorage returns next tracing its operations.
+func NewFileMetaStorage(next interfaces.FileMetaStorage, provider trace.TracerProvider) interfaces.FileMetaStorage {
+	return &fileMetaStorage{
+		next:   next,
+		tracer: provider.Tracer(instrumentationName),
+	}
+}
+
+func (s *fileMetaStorage) StartProcessingFileMeta(ctx context.Context, meta domain.FileMeta) (err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.StartProcessingFileMeta", fileIDKey.String(meta.Name))
+	defer done(&err)
+
+	return s.next.StartProcessingFileMeta(ctx, meta)
+}
+
+func (s *fileMetaStorage) CompleteFileMeta(ctx context.Context, meta domain.FileMeta) (err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.CompleteFileMeta", fileIDKey.String(meta.Name))
+	defer done(&err)
+
+	return s.next.CompleteFileMeta(ctx, meta)
+}
+
+func (s *fileMetaStorage) GetFileMeta(ctx context.Context, id string) (_ domain.FileMeta, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.GetFileMeta", fileIDKey.String(id))
+	defer done(&err)
+
+	return s.next.GetFileMeta(ctx, id)
+}
+
+func (s *fileMetaStorage) DeleteFileMeta(ctx context.Context, id string) (_ domain.FileMeta, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.DeleteFileMeta", fileIDKey.String(id))
+	defer done(&err)
+
+	return s.next.DeleteFileMeta(ctx, id)
+}
+
+func (s *fileMetaStorage) AcquirePart(ctx context.Context, hash string) (_ domain.FilePart, _ bool, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.AcquirePart", hashKey.String(hash))
+	defer done(&err)
+
+	return s.next.AcquirePart(ctx, hash)
+}
+
+func (s *fileMetaStorage) PutPart(ctx context.Context, hash string, part domain.FilePart) (_ domain.FilePart, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.PutPart", hashKey.String(hash))
+	defer done(&err)
+
+	return s.next.PutPart(ctx, hash, part)
+}
+
+func (s *fileMetaStorage) ReleasePart(ctx context.Context, hash string) (_ int, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.ReleasePart", hashKey.String(hash))
+	defer done(&err)
+
+	return s.next.ReleasePart(ctx, hash)
+}
+
+func (s *fileMetaStorage) ListFiles(ctx context.Context) (_ []domain.FileMeta, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.ListFiles")
+	defer done(&err)
+
+	return s.next.ListFiles(ctx)
+}
+
+func (s *fileMetaStorage) ListParts(ctx context.Context) (_ []domain.FilePart, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.ListParts")
+	defer done(&err)
+
+	return s.next.ListParts(ctx)
+}
+
+func (s *fileMetaStorage) MovePart(ctx context.Context, path, checksum, from, to string) (_ bool, err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.MovePart", partPathKey.String(path))
+	defer done(&err)
+
+	return s.next.MovePart(ctx, path, checksum, from, to)
+}
+
+func (s *fileMetaStorage) Ping(ctx context.Context) (err error) {
+	ctx, done := s.start(ctx, "FileMetaStorage.Ping")
+	defer done(&err)
+
+	return s.next.Ping(ctx)
+}
+
+// start starts a span of an operation; done ends it with the error the operation returned.
+func (s *fileMetaStorage) start(ctx context.Context, name string,
+	attrs ...attribute.KeyValue) (_ context.Context, done func(err *error)) {
+	ctx, span, traced := startChild(ctx, s.tracer, name, attrs...)
+	if !traced {
+		return ctx, func(*error) {}
+	}
+
+	return ctx, func(err *error) {
+		end(span, *err)
+	}
+}
@@ -0,0 +1,118 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type storage struct {
+	next   interfaces.Storage
+	tracer trace.Tracer
+}
+
+// NewStorage returns next tracing transfers of parts, tagged with the storage URL and the bytes transferred.
+// A read is traced until its body is closed, so a slow storage shows up even when it answers at once.
+func NewStorage(next interfaces.Storage, provider trace.TracerProvider) interfaces.Storage {
+	return &storage{
+		next:   next,
+		tracer: provider.Tracer(instrumentationName),
+	}
+}
+
+func (s *storage) UploadFilePart(ctx context.Context, path string, body io.Reader) error {
+	ctx, span, traced := s.start(ctx, "Storage.UploadFilePart", path)
+	if !traced {
+		return s.next.UploadFilePart(ctx, path, body)
+	}
+
+	counter := &countingReader{Reader: body}
+	err := s.next.UploadFilePart(ctx, path, counter)
+	span.SetAttributes(bytesKey.Int64(counter.n))
+	end(span, err)
+
+	return err
+}
+
+func (s *storage) ReadFilePart(ctx context.Context, path string) (io.ReadCloser, error) {
+	ctx, span, traced := s.start(ctx, "Storage.ReadFilePart", path)
+	if !traced {
+		return s.next.ReadFilePart(ctx, path)
+	}
+
+	body, err := s.next.ReadFilePart(ctx, path)
+	if err != nil {
+		end(span, err)
+		return nil, err
+	}
+
+	return &tracedBody{
+		ReadCloser: body,
+		counter:    countingReader{Reader: body},
+		span:       span,
+	}, nil
+}
+
+func (s *storage) DeleteFilePart(ctx context.Context, path string) error {
+	ctx, span, traced := s.start(ctx, "Storage.DeleteFilePart", path)
+	if !traced {
+		return s.next.DeleteFilePart(ctx, path)
+	}
+
+	err := s.next.DeleteFilePart(ctx, path)
+	end(span, err)
+
+	return err
+}
+
+func (s *storage) GetFreeSpace() (int, error) {
+	return s.next.GetFreeSpace()
+}
+
+func (s *storage) GetStorageURL() string {
+	return s.next.GetStorageURL()
+}
+
+func (s *storage) Ping(ctx context.Context) error {
+	return s.next.Ping(ctx)
+}
+
+func (s *storage) start(ctx context.Context, name, path string) (context.Context, trace.Span, bool) {
+	return startChild(ctx, s.tracer, name,
+		storageURLKey.String(s.next.GetStorageURL()),
+		partPathKey.String(path),
+	)
+}
+
+// tracedBody ends the span of a read once the body is closed.
+type tracedBody struct {
+	io.ReadCloser
+	counter countingReader
+	span    trace.Span
+	err     error
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.counter.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.span.IsRecording() {
+		b.span.SetAttributes(bytesKey.Int64(b.counter.n))
+		if b.err == nil {
+			b.err = err
+		}
+		end(b.span, b.err)
+	}
+
+	return err
+}
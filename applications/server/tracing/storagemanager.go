@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/donmikel/karma8/applications/server/domain"
+	"github.com/donmikel/karma8/applications/server/interfaces"
+)
+
+type storageManager struct {
+	interfaces.StorageManager
+	provider trace.TracerProvider
+}
+
+// NewStorageManager returns next instrumenting storages added through it with NewStorage.
+func NewStorageManager(next interfaces.StorageManager, provider trace.TracerProvider) interfaces.StorageManager {
+	return &storageManager{
+		StorageManager: next,
+		provider:       provider,
+	}
+}
+
+func (m *storageManager) AddStorage(ctx context.Context, storageURL string, storage interfaces.Storage,
+	labels domain.StorageLabels) error {
+	return m.StorageManager.AddStorage(ctx, storageURL, NewStorage(storage, m.provider), labels)
+}
@@ -0,0 +1,150 @@
+// Package tracing traces requests with OpenTelemetry, through decorators around components of the server.
+//
+// Decorators only start spans within a traced request, so background jobs such as scrubbing or health probes
+// don't flood the exporter.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer spans of the server are started with.
+const instrumentationName = "github.com/donmikel/karma8/applications/server"
+
+// serviceName is how the server is known to tracing backends.
+const serviceName = "karma8"
+
+// Exporters spans are sent with.
+const (
+	// ExporterStdout writes spans to stdout as JSON, one span per line.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+)
+
+// Attributes of spans besides the semantic conventions.
+const (
+	storageURLKey = attribute.Key("karma8.storage.url")
+	partPathKey   = attribute.Key("karma8.part.path")
+	hashKey       = attribute.Key("karma8.part.hash")
+	bytesKey      = attribute.Key("karma8.bytes")
+	fileIDKey     = attribute.Key("karma8.file.id")
+)
+
+type providerOptions struct {
+	endpoint    string
+	insecure    bool
+	sampleRatio float64
+	version     string
+}
+
+// ProviderOption configures optional behaviour of the tracer provider.
+type ProviderOption func(o *providerOptions)
+
+// WithEndpoint sends spans to the OTLP collector at endpoint, a host:port, over plain HTTP if insecure is set.
+func WithEndpoint(endpoint string, insecure bool) ProviderOption {
+	return func(o *providerOptions) {
+		o.endpoint = endpoint
+		o.insecure = insecure
+	}
+}
+
+// WithSampleRatio traces the ratio of requests, from 0 to 1. Requests carrying a sampled trace from the caller are
+// always traced.
+func WithSampleRatio(ratio float64) ProviderOption {
+	return func(o *providerOptions) {
+		o.sampleRatio = ratio
+	}
+}
+
+// WithVersion tags spans with the version of the server.
+func WithVersion(version string) ProviderOption {
+	return func(o *providerOptions) {
+		o.version = version
+	}
+}
+
+// NewProvider returns a tracer provider sending spans to exporter, ExporterStdout or ExporterOTLP, in batches.
+// It must be shut down to flush the last batch.
+func NewProvider(ctx context.Context, exporter string, opts ...ProviderOption) (*sdktrace.TracerProvider, error) {
+	o := providerOptions{sampleRatio: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var (
+		spanExporter sdktrace.SpanExporter
+		err          error
+	)
+	switch exporter {
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	case ExporterOTLP:
+		clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(o.endpoint)}
+		if o.insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		spanExporter, err = otlptracehttp.New(ctx, clientOpts...)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't create %s exporter: %w", exporter, err)
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(serviceName)}
+	if o.version != "" {
+		attrs = append(attrs, semconv.ServiceVersionKey.String(o.version))
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+	), nil
+}
+
+// startChild starts a span only when ctx already carries one; traced is false otherwise, and ctx is returned as is.
+func startChild(ctx context.Context, tracer trace.Tracer, name string,
+	attrs ...attribute.KeyValue) (_ context.Context, _ trace.Span, traced bool) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil, false
+	}
+
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+
+	return ctx, span, true
+}
+
+// end records err on span, if any, and ends it.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
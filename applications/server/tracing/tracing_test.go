@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/donmikel/karma8/applications/server/adapters/httpstorage"
+)
+
+func TestStorageSpans(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	var (
+		m           sync.Mutex
+		parts       = map[string][]byte{}
+		traceparent []string
+	)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		traceparent = append(traceparent, r.Header.Get("traceparent"))
+		path := strings.TrimPrefix(r.URL.Path, "/parts/")
+		switch r.Method {
+		case http.MethodPut:
+			parts[path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			_, _ = w.Write(parts[path])
+		}
+	}))
+	defer node.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	storage := NewStorage(httpstorage.NewStorage(node.URL, node.Client()), provider)
+
+	// Without a request being traced, nothing is.
+	require.NoError(t, storage.UploadFilePart(context.Background(), "untraced", bytes.NewReader([]byte("data"))))
+	assert.Empty(t, recorder.Ended())
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	data := bytes.Repeat([]byte("part"), 1000)
+	require.NoError(t, storage.UploadFilePart(ctx, "part", bytes.NewReader(data)))
+
+	body, err := storage.ReadFilePart(ctx, "part")
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	for i, name := range []string{"Storage.UploadFilePart", "Storage.ReadFilePart"} {
+		span := spans[i]
+		assert.Equal(t, name, span.Name())
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Contains(t, span.Attributes(), storageURLKey.String(node.URL))
+		assert.Contains(t, span.Attributes(), attribute.Int64("karma8.bytes", int64(len(data))))
+
+		// The node is told which span the part is transferred in.
+		assert.Contains(t, traceparent[i+1], span.SpanContext().SpanID().String())
+	}
+	assert.Empty(t, traceparent[0])
+}